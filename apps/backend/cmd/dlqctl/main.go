@@ -0,0 +1,294 @@
+// Command dlqctl lists messages of dead letter topic and replays them to their original topics
+//
+// Usage:
+//
+//	dlqctl list [flags]
+//	dlqctl replay [flags]
+//
+// Brokers and DLQ topic are taken from KAFKA_BROKERS and KAFKA_DLQ_TOPIC like in backend,
+// flags override them. Reading DLQ does not commit any offsets, so replayed messages stay in DLQ.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/kafka"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = list(ctx, os.Args[2:], os.Stdout)
+	case "replay":
+		err = replay(ctx, os.Args[2:], os.Stdout)
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "dlqctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  dlqctl list [flags]     print messages of DLQ with their headers
+  dlqctl replay [flags]   publish selected messages of DLQ to their original topics
+
+Run "dlqctl <command> -h" for flags.`)
+}
+
+// options are flags shared by commands
+type options struct {
+	brokers string
+	topic   string
+	filter  kafka.DeadLetterFilter
+	since   string
+	until   string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	defaults := config.Default().Kafka
+	fs.StringVar(&o.brokers, "brokers", envOr("KAFKA_BROKERS", strings.Join(defaults.Brokers, ",")), "comma separated kafka brokers")
+	fs.StringVar(&o.topic, "topic", envOr("KAFKA_DLQ_TOPIC", defaults.DLQTopic), "dead letter topic")
+	fs.StringVar(&o.filter.ErrorContains, "error", "", "select messages which error contains substring")
+	fs.StringVar(&o.filter.Key, "key", "", "select messages with key")
+	fs.StringVar(&o.since, "since", "", "select messages failed at or after time, RFC3339")
+	fs.StringVar(&o.until, "until", "", "select messages failed before time, RFC3339")
+}
+
+// parse reads time range of filter
+func (o *options) parse() error {
+	for _, t := range []struct {
+		name  string
+		value string
+		dst   *time.Time
+	}{
+		{"since", o.since, &o.filter.Since},
+		{"until", o.until, &o.filter.Until},
+	} {
+		if t.value == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %w", t.name, err)
+		}
+		*t.dst = v
+	}
+	return nil
+}
+
+func (o *options) brokerList() []string {
+	var brokers []string
+	for _, b := range strings.Split(o.brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	return brokers
+}
+
+// list prints messages of DLQ matching filter
+func list(ctx context.Context, args []string, out io.Writer) error {
+	opts := options{}
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	opts.register(fs)
+	values := fs.Bool("values", false, "print message values")
+	limit := fs.Int("limit", 0, "max number of printed messages, 0 means no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.parse(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tOFFSET\tKEY\tFAILED AT\tORIGINAL TOPIC\tRETRIES\tERROR")
+
+	printed := 0
+	errLimit := errors.New("limit reached")
+	err := kafka.ReadDeadLetters(ctx, opts.brokerList(), opts.topic, func(msg *kafkago.Message) error {
+		if !opts.filter.Match(msg) {
+			return nil
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			msg.Partition, msg.Offset, msg.Key,
+			kafka.FailedAt(msg).Format(time.RFC3339),
+			kafka.Header(msg, kafka.HeaderOriginalTopic),
+			orDash(kafka.Header(msg, kafka.HeaderRetryAttempt)),
+			kafka.Header(msg, kafka.HeaderError))
+		if *values {
+			fmt.Fprintf(w, "\t\t%s\n", msg.Value)
+		}
+
+		printed++
+		if *limit > 0 && printed >= *limit {
+			return errLimit
+		}
+		return nil
+	})
+	if errors.Is(err, errLimit) {
+		err = nil
+	}
+
+	if errFlush := w.Flush(); err == nil {
+		err = errFlush
+	}
+	if err == nil {
+		fmt.Fprintf(out, "%d messages\n", printed)
+	}
+	return err
+}
+
+// replay publishes selected messages of DLQ to their original topics
+// Messages which are still invalid are skipped unless -force is set.
+func replay(ctx context.Context, args []string, out io.Writer) error {
+	opts := options{}
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	opts.register(fs)
+	dryRun := fs.Bool("dry-run", false, "only validate selected messages and report which would pass now")
+	force := fs.Bool("force", false, "replay messages which fail validation too")
+	to := fs.String("to", "", "target topic, by default original_topic header of message")
+	positions := fs.String("select", "", "comma separated partition:offset of messages to replay, by default all messages matching filter")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := opts.parse(); err != nil {
+		return err
+	}
+	selected, err := parsePositions(*positions)
+	if err != nil {
+		return err
+	}
+
+	var batch []kafkago.Message
+	total, valid := 0, 0
+	err = kafka.ReadDeadLetters(ctx, opts.brokerList(), opts.topic, func(msg *kafkago.Message) error {
+		if !opts.filter.Match(msg) {
+			return nil
+		}
+		if selected != nil && !selected[position{msg.Partition, msg.Offset}] {
+			return nil
+		}
+		total++
+
+		status := "PASS"
+		checkErr := kafka.CheckMessage(msg)
+		if checkErr == nil {
+			valid++
+		} else {
+			status = "FAIL: " + checkErr.Error()
+		}
+		fmt.Fprintf(out, "%d/%d %s: %s\n", msg.Partition, msg.Offset, msg.Key, status)
+
+		if *dryRun || (checkErr != nil && !*force) {
+			return nil
+		}
+		replayed, err := kafka.ReplayMessage(msg, *to)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, replayed)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Fprintf(out, "%d of %d messages would pass validation\n", valid, total)
+		return nil
+	}
+
+	if len(batch) > 0 {
+		w := &kafkago.Writer{
+			Addr:     kafkago.TCP(opts.brokerList()...),
+			Balancer: &kafkago.Hash{},
+		}
+		err = w.WriteMessages(ctx, batch...)
+		if errClose := w.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "%d of %d messages replayed\n", len(batch), total)
+	return nil
+}
+
+// position is partition and offset of message
+type position struct {
+	partition int
+	offset    int64
+}
+
+// parsePositions parses list of partition:offset, nil means no selection
+func parsePositions(s string) (map[position]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	positions := map[position]bool{}
+	for _, p := range strings.Split(s, ",") {
+		partition, offset, ok := strings.Cut(strings.TrimSpace(p), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid -select %q: must be partition:offset", p)
+		}
+		pn, err := strconv.Atoi(partition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -select %q: %w", p, err)
+		}
+		on, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -select %q: %w", p, err)
+		}
+		positions[position{pn, on}] = true
+	}
+	return positions, nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
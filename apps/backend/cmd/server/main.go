@@ -3,72 +3,235 @@
 // @description API for getting order information
 // @host localhost:8080
 // @BasePath /
+// @securityDefinitions.apikey AdminToken
+// @in header
+// @name Authorization
+// @description Bearer token of administrator, for example "Bearer secret"
 package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"expvar"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	_ "github.com/Kost0/L0/docs"
 	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/http"
 	"github.com/Kost0/L0/internal/kafka"
 	"github.com/Kost0/L0/internal/repository"
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+// run starts all components and waits until they stop
+// Deferred closes are done before the process exits, also on error.
+func run() error {
+	// load configuration
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
 	//connecting to database
-	db, err := repository.ConnectDB()
+	db, err := repository.ConnectDB(cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	log.Println("Starting server")
 	defer db.Close()
 
 	// start migrations
-	err = repository.RunMigrations(db, "orders_l0")
+	err = repository.RunMigrations(db, cfg.DB.Name)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	log.Println("Migrations complete")
 
 	//create object to work with database
-	repo := repository.NewOrderRepository(db)
+	repo := repository.NewOrderRepository(db, cfg.Repository)
 
 	// create object to work with cache
-	orderCache := cache.NewOrderCache(48 * time.Hour)
-
-	// fills the cache with data from database
-	err = orderCache.WarmUpCache(db, repo, context.Background())
+	orderCache, err := newCache(cfg.Cache)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer orderCache.Close()
+	expvar.Publish("order_cache", expvar.Func(func() any { return orderCache.Stats() }))
 
 	// define signals for graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	var wg sync.WaitGroup
+	// fills the cache from snapshot or with data from database
+	// complete cache is saved to snapshot on shutdown, partial one would make next start skip warm-up
+	var warming, complete atomic.Bool
+	if loadSnapshot(cfg.Cache, orderCache) {
+		log.Println("Cache is restored from snapshot, warm-up is skipped")
+		complete.Store(true)
+	} else if cfg.Cache.WarmUpBackground {
+		warming.Store(true)
+		go func() {
+			defer warming.Store(false)
+			if err := warmUp(ctx, cfg.Cache, orderCache, db, repo); err != nil {
+				log.Printf("Cache warm-up failed, orders are loaded on demand: %v", err)
+				return
+			}
+			complete.Store(true)
+		}()
+	} else {
+		err = warmUp(ctx, cfg.Cache, orderCache, db, repo)
+		switch {
+		case errors.Is(err, cache.ErrWarmUpIncomplete):
+			log.Printf("Cache is warmed up partially, other orders are loaded on demand: %v", err)
+		case err != nil:
+			return err
+		default:
+			complete.Store(true)
+		}
+	}
 
-	// goroutine for server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		http.StartHTTPServer(ctx, repo, orderCache)
-	}()
+	// failed messages are kept in quarantine table, admin endpoints resubmit them to kafka
+	quarantine := repository.NewQuarantineRepository(db)
+	resubmitter := kafka.NewResubmitter(cfg.Kafka, nil)
+	defer resubmitter.Close()
 
-	// goroutine for kafka
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		kafka.StartKafka(ctx, repo)
-	}()
+	server, err := http.NewServer(cfg.HTTP, http.Deps{
+		Repo:        repo,
+		Cache:       orderCache,
+		Warming:     warming.Load,
+		Quarantine:  quarantine,
+		Resubmitter: resubmitter,
+	})
+	if err != nil {
+		return err
+	}
 
-	wg.Wait()
+	deps := kafka.Deps{
+		Repo:  repo,
+		Cache: orderCache,
+		// orders which repository ignores are only invalidated
+		WriteThrough: true,
+	}
+	if cfg.Kafka.DeadLetter != config.DeadLetterTopic {
+		deps.Quarantine = quarantine
+	}
+	consumer, err := kafka.NewConsumer(cfg.Kafka, deps)
+	if err != nil {
+		return err
+	}
+	consumers := []*kafka.Consumer{consumer}
+	for tier := range cfg.Kafka.RetryTiers {
+		retryConsumer, err := kafka.NewRetryConsumer(cfg.Kafka, tier, deps)
+		if err != nil {
+			return err
+		}
+		consumers = append(consumers, retryConsumer)
+	}
+
+	// if one component fails, the others are stopped too
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return server.Run(gctx)
+	})
+
+	for _, c := range consumers {
+		g.Go(func() error {
+			return c.Run(gctx)
+		})
+	}
+
+	// snapshot is saved even if a component failed, the cache itself is consistent
+	err = g.Wait()
+	saveSnapshot(cfg.Cache, orderCache, complete.Load())
+	if err != nil {
+		return err
+	}
 	log.Println("All components stopped gracefully")
+	return nil
+}
+
+// statsCache is a cache which can be closed and reports its counters
+type statsCache interface {
+	cache.Cache
+	Stats() cache.Stats
+	Close()
+}
+
+// newCache creates cache of configured backend
+func newCache(cfg config.CacheConfig) (statsCache, error) {
+	if cfg.Backend == config.CacheRedis {
+		c, err := cache.NewRedisCache(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return cache.NewOrderCache(cfg), nil
+}
+
+// warmUp fills cache with recent orders, limited by configured timeout
+func warmUp(ctx context.Context, cfg config.CacheConfig, c cache.Cache, db *sql.DB, repo repository.OrderRepository) error {
+	if cfg.WarmUpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.WarmUpTimeout)
+		defer cancel()
+	}
+	return c.WarmUpCache(db, repo, ctx)
+}
+
+// snapshotter is a cache which can be saved to file and restored from it
+type snapshotter interface {
+	SaveSnapshot(path string) (int, error)
+	LoadSnapshot(path string, maxAge time.Duration) (int, error)
+}
+
+// loadSnapshot restores cache from snapshot file if it is enabled
+// Returns false if cache should be warmed up from database.
+func loadSnapshot(cfg config.CacheConfig, c cache.Cache) bool {
+	s, ok := c.(snapshotter)
+	if !ok || cfg.SnapshotPath == "" {
+		return false
+	}
+
+	n, err := s.LoadSnapshot(cfg.SnapshotPath, cfg.SnapshotMaxAge)
+	if err != nil {
+		log.Printf("Cache snapshot is not loaded: %v", err)
+		return false
+	}
+	log.Printf("Loaded %d orders from cache snapshot", n)
+	return true
+}
+
+// saveSnapshot writes cache to snapshot file if it is enabled and cache is warmed up
+func saveSnapshot(cfg config.CacheConfig, c cache.Cache, complete bool) {
+	s, ok := c.(snapshotter)
+	if !ok || cfg.SnapshotPath == "" {
+		return
+	}
+	if !complete {
+		log.Println("Cache is not warmed up, snapshot is not saved")
+		return
+	}
+
+	n, err := s.SaveSnapshot(cfg.SnapshotPath)
+	if err != nil {
+		log.Printf("Cache snapshot is not saved: %v", err)
+		return
+	}
+	log.Printf("Saved %d orders to cache snapshot", n)
 }
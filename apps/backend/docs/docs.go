@@ -15,6 +15,508 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/quarantine": {
+            "get": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Gets page of failed messages, newest first",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List quarantined messages",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "default": "quarantined",
+                        "description": "Status: quarantined, resubmitted, discarded or all",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "ID of the last message of previous page",
+                        "name": "before",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 50,
+                        "description": "Page size, max 100",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.QuarantinePage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid parameter",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/quarantine/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Gets failed message with its payload, headers and errors",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Inspect quarantined message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.QuarantinedMessage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid message ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such message",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/quarantine/{id}/discard": {
+            "post": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Marks message as discarded, it is kept for audit",
+                "summary": "Discard quarantined message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Discarded"
+                    },
+                    "400": {
+                        "description": "Invalid message ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such message",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Message is already resubmitted or discarded",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/quarantine/{id}/payload": {
+            "put": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Replaces payload of message which is not resubmitted or discarded yet. Body is new payload, it must be JSON",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Edit payload of quarantined message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New payload",
+                        "name": "payload",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.QuarantinedMessage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid message ID or payload",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such message",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Message is already resubmitted or discarded",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/quarantine/{id}/resubmit": {
+            "post": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "Validates payload and publishes message to its original topic. Order is saved by consumer",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Resubmit quarantined message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.QuarantinedMessage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid message ID",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Invalid admin token",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such message",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Message is already resubmitted or discarded",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Payload is still invalid",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/orders": {
+            "get": {
+                "description": "Gets page of orders matching filters. Next page is requested with cursor from previous page",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Search orders",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "customer_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Track number",
+                        "name": "track_number",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Delivery service",
+                        "name": "delivery_service",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Orders created at or after this time, RFC3339",
+                        "name": "date_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Orders created before this time, RFC3339",
+                        "name": "date_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Brand of any item of order",
+                        "name": "brand",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "nmID of any item of order",
+                        "name": "nm_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Email of delivery",
+                        "name": "email",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Phone of delivery",
+                        "name": "phone",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "default": "-date_created",
+                        "description": "Sort field: date_created or track_number, prefixed with - for descending order",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "default": 20,
+                        "description": "Page size, max 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Cursor of page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.OrderPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filter",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/orders/validate": {
+            "post": {
+                "description": "Checks order the same way as consumer does and lists every failed field, so producer can fix all of them at once. Order is not saved",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Validate order",
+                "parameters": [
+                    {
+                        "description": "Order",
+                        "name": "order",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/models.CombinedData"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Order is valid",
+                        "schema": {
+                            "$ref": "#/definitions/models.ValidationResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Body can not be read",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "422": {
+                        "description": "Order is invalid, fields lists every failed field",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/orders/{orderID}": {
             "get": {
                 "description": "Gets information about an order by its ID",
@@ -38,10 +540,125 @@ const docTemplate = `{
                             "$ref": "#/definitions/models.CombinedData"
                         }
                     },
+                    "400": {
+                        "description": "Order ID is not UUID",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such order",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/orders/{orderID}/history": {
+            "get": {
+                "description": "Gets all versions of an order with time and kafka offset they came from",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Receive history of an order",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Order ID",
+                        "name": "orderID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/models.OrderVersion"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Order ID is not UUID",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such order",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal server error",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/tracks/{trackNumber}": {
+            "get": {
+                "description": "Gets information about an order by its track number",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Receive an order by track number",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Track number",
+                        "name": "trackNumber",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/models.CombinedData"
+                        }
+                    },
+                    "404": {
+                        "description": "There is no such order",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/models.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Request timed out",
+                        "schema": {
+                            "$ref": "#/definitions/models.ErrorResponse"
                         }
                     }
                 }
@@ -126,16 +743,70 @@ const docTemplate = `{
                 }
             }
         },
+        "models.ErrorResponse": {
+            "description": "Error returned by all endpoints of API",
+            "type": "object",
+            "properties": {
+                "code": {
+                    "description": "Machine readable code of error: invalid_argument, unauthenticated, not_found, conflict, timeout or internal",
+                    "type": "string",
+                    "example": "not_found"
+                },
+                "details": {
+                    "description": "Additional information, e.g. invalid parameters",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "fields": {
+                    "description": "Failed fields of order, returned when order is invalid",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.FieldError"
+                    }
+                },
+                "message": {
+                    "description": "Human readable description of error",
+                    "type": "string",
+                    "example": "order not found"
+                },
+                "requestID": {
+                    "description": "ID of request, also returned in X-Request-Id header",
+                    "type": "string",
+                    "example": "host/abcdef-000001"
+                }
+            }
+        },
+        "models.FieldError": {
+            "description": "Failed field of order",
+            "type": "object",
+            "properties": {
+                "message": {
+                    "description": "Human readable description of error",
+                    "type": "string",
+                    "example": "must not be negative"
+                },
+                "path": {
+                    "description": "JSON path of field, empty if payload can not be parsed at all",
+                    "type": "string",
+                    "example": "items[2].price"
+                },
+                "rule": {
+                    "description": "Code of failed rule: required, email, not_future, non_negative, type, syntax, ...",
+                    "type": "string",
+                    "example": "non_negative"
+                }
+            }
+        },
         "models.Item": {
             "description": "Product information",
             "type": "object",
             "required": [
                 "brand",
                 "chrtID",
-                "id",
                 "name",
                 "nmID",
-                "orderUID",
                 "price",
                 "rid",
                 "sale",
@@ -151,18 +822,12 @@ const docTemplate = `{
                 "chrtID": {
                     "type": "integer"
                 },
-                "id": {
-                    "type": "string"
-                },
                 "name": {
                     "type": "string"
                 },
                 "nmID": {
                     "type": "integer"
                 },
-                "orderUID": {
-                    "type": "string"
-                },
                 "price": {
                     "type": "integer"
                 },
@@ -198,7 +863,6 @@ const docTemplate = `{
                 "locale",
                 "oofShard",
                 "orderUID",
-                "paymentID",
                 "shardKey",
                 "smID",
                 "trackNumber"
@@ -231,9 +895,6 @@ const docTemplate = `{
                 "orderUID": {
                     "type": "string"
                 },
-                "paymentID": {
-                    "type": "string"
-                },
                 "shardKey": {
                     "type": "string"
                 },
@@ -245,6 +906,57 @@ const docTemplate = `{
                 }
             }
         },
+        "models.OrderPage": {
+            "description": "Page of orders and cursor of the next page",
+            "type": "object",
+            "properties": {
+                "nextCursor": {
+                    "description": "Cursor of the next page, empty if this page is the last one",
+                    "type": "string"
+                },
+                "orders": {
+                    "description": "Found orders",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.CombinedData"
+                    }
+                }
+            }
+        },
+        "models.OrderVersion": {
+            "description": "Version of the order with the kafka message it came from",
+            "type": "object",
+            "properties": {
+                "createdAt": {
+                    "description": "Time when version was saved",
+                    "type": "string"
+                },
+                "data": {
+                    "description": "Data of the order in this version",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/models.CombinedData"
+                        }
+                    ]
+                },
+                "offset": {
+                    "description": "Kafka offset of message",
+                    "type": "integer"
+                },
+                "partition": {
+                    "description": "Kafka partition of message",
+                    "type": "integer"
+                },
+                "topic": {
+                    "description": "Kafka topic of message",
+                    "type": "string"
+                },
+                "version": {
+                    "description": "Number of version, starting from 1",
+                    "type": "integer"
+                }
+            }
+        },
         "models.Payment": {
             "description": "payment information",
             "type": "object",
@@ -255,7 +967,6 @@ const docTemplate = `{
                 "customFee",
                 "deliveryCost",
                 "goodsTotal",
-                "id",
                 "paymentDT",
                 "provider",
                 "transaction"
@@ -279,9 +990,6 @@ const docTemplate = `{
                 "goodsTotal": {
                     "type": "integer"
                 },
-                "id": {
-                    "type": "string"
-                },
                 "paymentDT": {
                     "type": "integer"
                 },
@@ -295,6 +1003,108 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "models.QuarantinePage": {
+            "description": "Page of quarantined messages, newest first",
+            "type": "object",
+            "properties": {
+                "messages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/models.QuarantinedMessage"
+                    }
+                },
+                "nextBefore": {
+                    "description": "ID to pass as before parameter to get the next page, 0 if this page is the last one",
+                    "type": "integer"
+                }
+            }
+        },
+        "models.QuarantinedMessage": {
+            "description": "Failed kafka message stored in database",
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "description": "Number of deliveries of message to consumer",
+                    "type": "integer",
+                    "example": 4
+                },
+                "createdAt": {
+                    "type": "string"
+                },
+                "error": {
+                    "description": "Error of the last attempt and errors it wraps",
+                    "type": "string",
+                    "example": "pq: deadlock detected"
+                },
+                "errorChain": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "headers": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "integer",
+                    "example": 42
+                },
+                "key": {
+                    "type": "string"
+                },
+                "offset": {
+                    "type": "integer",
+                    "example": 15
+                },
+                "originalTopic": {
+                    "description": "Topic message was originally published to, message is resubmitted to it",
+                    "type": "string",
+                    "example": "orders"
+                },
+                "partition": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "payload": {
+                    "description": "Raw payload of message, it may be edited before resubmit",
+                    "type": "string"
+                },
+                "status": {
+                    "description": "Status: quarantined, resubmitted or discarded",
+                    "type": "string",
+                    "example": "quarantined"
+                },
+                "topic": {
+                    "description": "Kafka topic, partition and offset of failed message",
+                    "type": "string",
+                    "example": "orders.retry.10m"
+                },
+                "updatedAt": {
+                    "type": "string"
+                }
+            }
+        },
+        "models.ValidationResult": {
+            "description": "Result of successful order validation",
+            "type": "object",
+            "properties": {
+                "valid": {
+                    "type": "boolean",
+                    "example": true
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "AdminToken": {
+            "description": "Bearer token of administrator, for example \"Bearer secret\"",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
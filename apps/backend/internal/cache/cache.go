@@ -7,37 +7,126 @@
 package cache
 
 import (
+	"container/list"
 	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
 	"github.com/Kost0/L0/internal/repository"
+	"golang.org/x/sync/singleflight"
 )
 
 // Cache defines interface for working with cache
 type Cache interface {
+	Loader
 	Set(orderID string, data *models.CombinedData)
 	Get(orderID string) (*models.CombinedData, bool)
+	Invalidate(orderID string)
 	WarmUpCache(db *sql.DB, repo repository.OrderRepository, ctx context.Context) error
 }
 
-// OrderCache contains the location and time of storage of the cache
+// LoaderFunc loads order which is not in cache, e.g. from database
+type LoaderFunc func(ctx context.Context, orderID string) (*models.CombinedData, error)
+
+// Loader defines cache which loads missing orders by itself
+type Loader interface {
+	GetOrLoad(ctx context.Context, orderID string, load LoaderFunc) (*models.CombinedData, error)
+	// GetOrLoadByTrack is like GetOrLoad, but finds order by track number,
+	// load is called with track number
+	GetOrLoadByTrack(ctx context.Context, trackNumber string, load LoaderFunc) (*models.CombinedData, error)
+}
+
+// OrderCache keeps recently used orders in memory
+// The cache is bounded by number of entries and approximate size in bytes,
+// least recently used entries are evicted first. Every entry expires after ttl,
+// expired entries are removed by a single janitor goroutine.
+// IDs of orders which are not in database are kept in a separate negative tier
+// with its own ttl and size, so repeated requests of them do not reach database.
 type OrderCache struct {
-	data sync.Map
-	ttl  time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// tracks is secondary index: track number -> order id
+	tracks map[string]string
+	lru    *list.List
+	bytes  int64
+	stats  Stats
+
+	// negative tier
+	missing    map[string]*list.Element
+	missingLRU *list.List
+	// changes count every Set and Invalidate, so result of loading which
+	// started before them is neither remembered as missing nor stored by warm-up
+	changes changeLog
+
+	ttl                time.Duration
+	warmUp             warmUpConfig
+	maxEntries         int
+	maxBytes           int64
+	negativeTTL        time.Duration
+	negativeMaxEntries int
+
+	loading singleflight.Group
+
+	now       func() time.Time
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// entry is a cached order with its expiry time
+type entry struct {
+	key       string
+	data      *models.CombinedData
+	size      int64
+	expiresAt time.Time
+}
+
+// Stats provides counters of cache usage
+type Stats struct {
+	Entries         int   `json:"entries"`
+	Bytes           int64 `json:"bytes"`
+	Hits            int64 `json:"hits"`
+	Misses          int64 `json:"misses"`
+	Evictions       int64 `json:"evictions"`
+	Expirations     int64 `json:"expirations"`
+	NegativeEntries int   `json:"negative_entries"`
+	NegativeHits    int64 `json:"negative_hits"`
 }
 
-// NewOrderCache create new OrderCache
+// NewOrderCache create new OrderCache and starts its janitor
 // Accepts:
-//   - ttl: time to live
+//   - cfg: settings of cache, zero limits mean no limit,
+//     janitor is not started if its interval is not positive,
+//     negative tier is disabled if its ttl is not positive
 //
 // Returns:
 //   - *OrderCache
-func NewOrderCache(ttl time.Duration) *OrderCache {
-	return &OrderCache{ttl: ttl}
+func NewOrderCache(cfg config.CacheConfig) *OrderCache {
+	c := &OrderCache{
+		entries:            map[string]*list.Element{},
+		tracks:             map[string]string{},
+		lru:                list.New(),
+		missing:            map[string]*list.Element{},
+		missingLRU:         list.New(),
+		ttl:                cfg.TTL,
+		warmUp:             newWarmUpConfig(cfg),
+		maxEntries:         cfg.MaxEntries,
+		maxBytes:           cfg.MaxBytes,
+		negativeTTL:        cfg.NegativeTTL,
+		negativeMaxEntries: cfg.NegativeMaxEntries,
+		now:                time.Now,
+		stop:               make(chan struct{}),
+	}
+
+	if cfg.JanitorInterval > 0 {
+		go c.janitor(cfg.JanitorInterval)
+	}
+
+	return c
 }
 
 // Set save data in cache
@@ -45,10 +134,39 @@ func NewOrderCache(ttl time.Duration) *OrderCache {
 //   - orderID: id of order
 //   - data: all data about order
 func (c *OrderCache) Set(orderID string, data *models.CombinedData) {
-	c.data.Store(orderID, data)
-	time.AfterFunc(c.ttl, func() {
-		c.data.Delete(orderID)
-	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setUntil(orderID, data, c.now().Add(c.ttl))
+}
+
+// setUntil saves data which expires at given time, must be called with mu held
+func (c *OrderCache) setUntil(orderID string, data *models.CombinedData, expiresAt time.Time) {
+	c.changes.touch(orderID)
+	if el, ok := c.missing[orderID]; ok {
+		c.removeMissing(el)
+	}
+
+	size := sizeOf(orderID, data)
+
+	if el, ok := c.entries[orderID]; ok {
+		e := el.Value.(*entry)
+		c.unindexTrack(e)
+		c.bytes += size - e.size
+		e.data, e.size, e.expiresAt = data, size, expiresAt
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[orderID] = c.lru.PushFront(&entry{key: orderID, data: data, size: size, expiresAt: expiresAt})
+		c.bytes += size
+	}
+	if data.Order.TrackNumber != nil {
+		c.tracks[*data.Order.TrackNumber] = orderID
+	}
+
+	for c.lru.Len() > 0 && c.overLimit() {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
 }
 
 // Get receive data from cache
@@ -59,72 +177,389 @@ func (c *OrderCache) Set(orderID string, data *models.CombinedData) {
 //   - all data about order
 //   - did it work
 func (c *OrderCache) Get(orderID string) (*models.CombinedData, bool) {
-	v, ok := c.data.Load(orderID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[orderID]
 	if !ok {
+		c.stats.Misses++
+		return &models.CombinedData{}, false
+	}
+
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expiresAt) {
+		c.remove(el)
+		c.stats.Expirations++
+		c.stats.Misses++
 		return &models.CombinedData{}, false
 	}
-	return v.(*models.CombinedData), true
+
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return e.data, true
 }
 
-// WarmUpCache
+// Invalidate removes order from cache, including the negative tier
 // Accepts:
-//   - db: database
-//   - repo: repository
-//   - cts: context
+//   - orderID: id of order
+func (c *OrderCache) Invalidate(orderID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changes.touch(orderID)
+	if el, ok := c.entries[orderID]; ok {
+		c.remove(el)
+	}
+	if el, ok := c.missing[orderID]; ok {
+		c.removeMissing(el)
+	}
+}
+
+// GetOrLoad receive data from cache or loads it if there is no such order
+// Concurrent misses of the same order are coalesced: load is called once
+// and all callers receive its result. Loading is not cancelled when the first
+// caller goes away, but it keeps deadline of the first caller.
+// If load returns sql.ErrNoRows, the order is remembered as missing and
+// next calls return sql.ErrNoRows without loading until negative ttl passes.
+// Accepts:
+//   - ctx: context
+//   - orderID: id of order
+//   - load: function which loads order
 //
 // Returns:
-//   - error if something wrong
-func (c *OrderCache) WarmUpCache(db *sql.DB, repo repository.OrderRepository, ctx context.Context) error {
-	data, err := getRecentOrders(db, repo, ctx)
-	if err != nil {
-		return err
+//   - all data about order
+//   - error of load or of ctx
+func (c *OrderCache) GetOrLoad(ctx context.Context, orderID string, load LoaderFunc) (*models.CombinedData, error) {
+	if data, ok := c.Get(orderID); ok {
+		return data, nil
 	}
+	if c.isMissing(orderID) {
+		return nil, sql.ErrNoRows
+	}
+
+	ch := c.loading.DoChan(orderID, func() (any, error) {
+		// order could be loaded by previous call while we were missing it
+		if data, ok := c.peek(orderID); ok {
+			return data, nil
+		}
+		epoch := c.changes.current()
+
+		loadCtx, cancel := detach(ctx)
+		defer cancel()
+
+		data, err := load(loadCtx, orderID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.setMissing(orderID, epoch)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.Set(orderID, data)
+		log.Printf("Order %s cached", orderID)
+		return data, nil
+	})
+
+	return awaitLoad(ctx, ch)
+}
 
-	for _, order := range data {
-		c.Set(order.Order.OrderUID, order)
+// GetOrLoadByTrack receive data from cache by track number or loads it if there is no such order
+// Concurrent misses of the same track number are coalesced like in GetOrLoad.
+// Unknown track numbers are not remembered in the negative tier, because
+// Invalidate of a new order can not find them by order id.
+// Accepts:
+//   - ctx: context
+//   - trackNumber: track number of order
+//   - load: function which loads order by track number
+//
+// Returns:
+//   - all data about order
+//   - error of load or of ctx
+func (c *OrderCache) GetOrLoadByTrack(ctx context.Context, trackNumber string, load LoaderFunc) (*models.CombinedData, error) {
+	if data, ok := c.getByTrack(trackNumber); ok {
+		return data, nil
 	}
 
-	log.Printf("Warmed up cache with %d orders", len(data))
+	ch := c.loading.DoChan(trackKeyPrefix+trackNumber, func() (any, error) {
+		if orderID, ok := c.trackOrderID(trackNumber); ok {
+			if data, ok := c.peek(orderID); ok {
+				return data, nil
+			}
+		}
 
-	return nil
+		loadCtx, cancel := detach(ctx)
+		defer cancel()
+
+		data, err := load(loadCtx, trackNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Set(data.Order.OrderUID, data)
+		log.Printf("Order %s cached by track number %s", data.Order.OrderUID, trackNumber)
+		return data, nil
+	})
+
+	return awaitLoad(ctx, ch)
 }
 
-func getRecentOrders(db *sql.DB, repo repository.OrderRepository, ctx context.Context) (allData []*models.CombinedData, err error) {
-	query := `
-SELECT order_uid FROM orders
-WHERE date_created >= NOW() - INTERVAL '7 days'
-`
+// trackKeyPrefix separates loading by track number from loading by order id
+const trackKeyPrefix = "track:"
 
-	rows, err := db.QueryContext(ctx, query)
-	if err != nil {
-		return nil, err
+// detach returns context which is not cancelled with ctx, but keeps its deadline
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	loadCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(loadCtx, deadline)
 	}
-	defer func() {
-		if errClose := rows.Close(); errClose != nil {
-			err = errClose
+	return loadCtx, func() {}
+}
+
+// awaitLoad returns result of loading unless ctx is done earlier
+func awaitLoad(ctx context.Context, ch <-chan singleflight.Result) (*models.CombinedData, error) {
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
 		}
-	}()
+		return res.Val.(*models.CombinedData), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	allData = []*models.CombinedData{}
+// getByTrack receive data from cache by track number
+func (c *OrderCache) getByTrack(trackNumber string) (*models.CombinedData, bool) {
+	orderID, ok := c.trackOrderID(trackNumber)
+	if !ok {
+		c.mu.Lock()
+		c.stats.Misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	return c.Get(orderID)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
-	defer cancel()
+// trackOrderID finds id of cached order by track number
+func (c *OrderCache) trackOrderID(trackNumber string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for rows.Next() {
-		id := ""
-		err = rows.Scan(&id)
-		if err != nil {
-			return nil, err
+	orderID, ok := c.tracks[trackNumber]
+	return orderID, ok
+}
+
+// unindexTrack removes entry from index of track numbers, must be called with mu held
+func (c *OrderCache) unindexTrack(e *entry) {
+	if e.data.Order.TrackNumber == nil {
+		return
+	}
+	if track := *e.data.Order.TrackNumber; c.tracks[track] == e.key {
+		delete(c.tracks, track)
+	}
+}
+
+// peek receive data without changing order of eviction and statistics
+func (c *OrderCache) peek(orderID string) (*models.CombinedData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[orderID]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expiresAt) {
+		return nil, false
+	}
+	return e.data, true
+}
+
+// setLoaded saves order loaded by warm-up, unless it changed since epoch
+func (c *OrderCache) setLoaded(data *models.CombinedData, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.changes.changedSince(data.Order.OrderUID, epoch) {
+		return
+	}
+	c.setUntil(data.Order.OrderUID, data, c.now().Add(c.ttl))
+}
+
+// isMissing checks negative tier
+func (c *OrderCache) isMissing(orderID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.missing[orderID]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(el.Value.(*entry).expiresAt) {
+		c.removeMissing(el)
+		c.stats.Expirations++
+		return false
+	}
+
+	c.missingLRU.MoveToFront(el)
+	c.stats.NegativeHits++
+	return true
+}
+
+// setMissing remembers that there is no such order, unless cache changed since epoch
+func (c *OrderCache) setMissing(orderID string, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.negativeTTL <= 0 || c.changes.current() != epoch {
+		return
+	}
+
+	expiresAt := c.now().Add(c.negativeTTL)
+	if el, ok := c.missing[orderID]; ok {
+		el.Value.(*entry).expiresAt = expiresAt
+		c.missingLRU.MoveToFront(el)
+		return
+	}
+
+	c.missing[orderID] = c.missingLRU.PushFront(&entry{key: orderID, expiresAt: expiresAt})
+	for c.negativeMaxEntries > 0 && c.missingLRU.Len() > c.negativeMaxEntries {
+		c.removeMissing(c.missingLRU.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Stats returns current counters of cache
+func (c *OrderCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	stats.NegativeEntries = c.missingLRU.Len()
+	return stats
+}
+
+// Close stops janitor of the cache
+func (c *OrderCache) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
+
+func (c *OrderCache) overLimit() bool {
+	return (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *OrderCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+	c.unindexTrack(e)
+	c.bytes -= e.size
+}
+
+func (c *OrderCache) removeMissing(el *list.Element) {
+	e := c.missingLRU.Remove(el).(*entry)
+	delete(c.missing, e.key)
+}
+
+// janitor periodically removes expired entries until cache is closed
+func (c *OrderCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.removeExpired()
+		case <-c.stop:
+			return
 		}
-		data, err := repo.SelectWithRetry(ctx, id)
-		if err != nil {
-			return nil, err
+	}
+}
+
+func (c *OrderCache) removeExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*entry).expiresAt) {
+			c.remove(el)
+			c.stats.Expirations++
 		}
-		allData = append(allData, data)
+		el = prev
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+
+	for el := c.missingLRU.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*entry).expiresAt) {
+			c.removeMissing(el)
+			c.stats.Expirations++
+		}
+		el = prev
 	}
+}
 
-	return allData, nil
+// WarmUpCache loads recent orders into cache
+// Accepts:
+//   - db: database
+//   - repo: repository
+//   - ctx: context, loading stops when it is done
+//
+// Returns:
+//   - error if something wrong, ErrWarmUpIncomplete if deadline of ctx stopped loading,
+//     orders loaded before it stay in cache
+func (c *OrderCache) WarmUpCache(db *sql.DB, repo repository.OrderRepository, ctx context.Context) error {
+	c.changes.start()
+	defer c.changes.stop()
+
+	n, err := warmUp(ctx, db, repo, c.warmUp, c.changes.current, c.setLoaded)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Warmed up cache with %d orders", n)
+
+	return nil
+}
+
+// sizeOf estimates memory used by cached order
+func sizeOf(orderID string, data *models.CombinedData) int64 {
+	// fixed part covers structs, pointers and numbers
+	const (
+		entryOverhead = 512
+		itemOverhead  = 160
+	)
+
+	size := int64(entryOverhead + len(orderID))
+	for _, s := range []*string{
+		data.Order.TrackNumber, data.Order.Entry, data.Order.DeliveryID, data.Order.Locale,
+		data.Order.InternalSignature, data.Order.CustomerID, data.Order.DeliveryService,
+		data.Order.Shardkey, data.Order.OofShard,
+		data.Delivery.ID, data.Delivery.Name, data.Delivery.Phone, data.Delivery.Zip,
+		data.Delivery.City, data.Delivery.Address, data.Delivery.Region, data.Delivery.Email,
+		data.Payment.Transaction, data.Payment.RequestID, data.Payment.Currency,
+		data.Payment.Provider, data.Payment.Bank,
+	} {
+		size += strLen(s)
+	}
+	size += int64(len(data.Order.OrderUID))
+
+	for i := range data.Items {
+		item := &data.Items[i]
+		size += itemOverhead + strLen(item.TrackNumber) + strLen(item.Rid) +
+			strLen(item.Name) + strLen(item.Size) + strLen(item.Brand)
+	}
+
+	return size
+}
+
+func strLen(s *string) int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(len(*s))
 }
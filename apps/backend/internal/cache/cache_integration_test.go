@@ -8,7 +8,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/Kost0/L0/internal/repository"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/docker/go-connections/nat"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
@@ -152,18 +152,18 @@ func TestGetRecentOrders_Integration(t *testing.T) {
 	_, _ = db.Exec("INSERT INTO items (order_id) VALUES ($1)", "order-new-2")
 	_, _ = db.Exec("INSERT INTO items (order_id) VALUES ($1)", "order-old-1")
 
-	repo := repository.NewOrderRepository(db)
+	window := config.Default().Cache.WarmUpWindow
 
-	data, err := getRecentOrders(db, repo, ctx)
+	// pages of one order, newest first
+	ids, last, err := recentOrderIDs(ctx, db, window, nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"order-new-1"}, ids)
 
+	ids, last, err = recentOrderIDs(ctx, db, window, last, 1)
 	assert.NoError(t, err)
-	assert.Len(t, data, 2)
+	assert.Equal(t, []string{"order-new-2"}, ids)
 
-	orders := make(map[string]bool)
-	for _, o := range data {
-		orders[o.Order.OrderUID] = true
-	}
-	assert.True(t, orders["order-new-1"])
-	assert.True(t, orders["order-new-2"])
-	assert.False(t, orders["order-old-1"])
+	ids, _, err = recentOrderIDs(ctx, db, window, last, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
 }
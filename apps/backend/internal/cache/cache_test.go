@@ -5,21 +5,26 @@ import (
 	"database/sql"
 	"io/ioutil"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
+const week = 7 * 24 * time.Hour
+
 type MockOrderRepository struct {
 	mock.Mock
 }
 
-func (m *MockOrderRepository) SelectOrder(orderID string) (*models.CombinedData, error) {
-	args := m.Called(orderID)
+func (m *MockOrderRepository) SelectOrder(ctx context.Context, orderID string) (*models.CombinedData, error) {
+	args := m.Called(ctx, orderID)
 	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
@@ -28,18 +33,44 @@ func (m *MockOrderRepository) SelectWithRetry(ctx context.Context, orderID strin
 	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func (m *MockOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) error {
+func (m *MockOrderRepository) ListOrders(ctx context.Context, filter models.OrderFilter) (*models.OrderPage, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(*models.OrderPage), args.Error(1)
+}
+
+func (m *MockOrderRepository) SelectByTrackNumber(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(ctx, trackNumber)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
+}
+
+func (m *MockOrderRepository) SelectByTrackWithRetry(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(trackNumber)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
+}
+
+func (m *MockOrderRepository) SelectHistory(ctx context.Context, orderID string) ([]models.OrderVersion, error) {
+	args := m.Called(ctx, orderID)
+	return args.Get(0).([]models.OrderVersion), args.Error(1)
+}
+
+func (m *MockOrderRepository) InsertOrders(ctx context.Context, orders []*models.CombinedData) ([]bool, error) {
+	args := m.Called(ctx, orders)
+	applied, _ := args.Get(0).([]bool)
+	return applied, args.Error(1)
+}
+
+func (m *MockOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) (bool, error) {
 	args := m.Called(ctx, order)
-	return args.Error(0)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockOrderRepository) InsertOrder(order *models.CombinedData) error {
-	args := m.Called(order)
-	return args.Error(0)
+func (m *MockOrderRepository) InsertOrder(ctx context.Context, order *models.CombinedData) (bool, error) {
+	args := m.Called(ctx, order)
+	return args.Bool(0), args.Error(1)
 }
 
 func TestOrderCache_SetAndGet(t *testing.T) {
-	cache := NewOrderCache(10 * time.Second)
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
 
 	id := "order-1"
 	data := &models.CombinedData{
@@ -55,39 +86,320 @@ func TestOrderCache_SetAndGet(t *testing.T) {
 }
 
 func TestOrderCache_GetNotFound(t *testing.T) {
-	cache := NewOrderCache(10 * time.Second)
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
 
 	result, found := cache.Get("not-found")
 	assert.False(t, found)
 	assert.NotNil(t, result)
 }
 
-func TestOrderCache_TTLExpiry(t *testing.T) {
-	cache := NewOrderCache(100 * time.Millisecond)
+// fakeClock allows tests to move time of cache
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
 
-	id := "order-1"
-	data := &models.CombinedData{
-		Order: models.Order{OrderUID: id},
-	}
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
 
-	cache.Set("order-1", data)
+func (f *fakeClock) Add(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func newTestCache(cfg config.CacheConfig) (*OrderCache, *fakeClock) {
+	clock := &fakeClock{now: time.Now()}
+	c := NewOrderCache(cfg)
+	c.mu.Lock()
+	c.now = clock.Now
+	c.mu.Unlock()
+	return c, clock
+}
+
+func order(id string) *models.CombinedData {
+	return &models.CombinedData{Order: models.Order{OrderUID: id}}
+}
+
+func TestOrderCache_TTLExpiry(t *testing.T) {
+	cache, clock := newTestCache(config.CacheConfig{TTL: 100 * time.Millisecond, WarmUpWindow: week})
+
+	cache.Set("order-1", order("order-1"))
 
 	_, found := cache.Get("order-1")
 	assert.True(t, found)
 
-	time.Sleep(110 * time.Millisecond)
+	clock.Add(110 * time.Millisecond)
+
+	_, found = cache.Get("order-1")
+	assert.False(t, found)
+	assert.Equal(t, int64(1), cache.Stats().Expirations)
+}
+
+func TestOrderCache_SetAgainRenewsExpiry(t *testing.T) {
+	cache, clock := newTestCache(config.CacheConfig{TTL: 100 * time.Millisecond, WarmUpWindow: week})
+
+	cache.Set("order-1", order("order-1"))
+	clock.Add(80 * time.Millisecond)
+
+	fresh := order("order-1")
+	cache.Set("order-1", fresh)
+	clock.Add(80 * time.Millisecond)
+
+	result, found := cache.Get("order-1")
+	assert.True(t, found)
+	assert.Same(t, fresh, result)
+	assert.Equal(t, 1, cache.Stats().Entries)
+}
+
+func TestOrderCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, MaxEntries: 2})
+
+	cache.Set("order-1", order("order-1"))
+	cache.Set("order-2", order("order-2"))
+	_, _ = cache.Get("order-1")
+	cache.Set("order-3", order("order-3"))
 
+	_, found := cache.Get("order-2")
+	assert.False(t, found)
 	_, found = cache.Get("order-1")
+	assert.True(t, found)
+	_, found = cache.Get("order-3")
+	assert.True(t, found)
+
+	stats := cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(3), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+}
+
+func TestOrderCache_EvictsBySize(t *testing.T) {
+	size := sizeOf("order-1", order("order-1"))
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, MaxBytes: 2 * size})
+
+	cache.Set("order-1", order("order-1"))
+	cache.Set("order-2", order("order-2"))
+	cache.Set("order-3", order("order-3"))
+
+	stats := cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 2*size, stats.Bytes)
+	assert.Equal(t, int64(1), stats.Evictions)
+
+	_, found := cache.Get("order-1")
 	assert.False(t, found)
 }
 
+func TestOrderCache_JanitorRemovesExpired(t *testing.T) {
+	cache, clock := newTestCache(config.CacheConfig{TTL: time.Minute, JanitorInterval: 5 * time.Millisecond})
+	defer cache.Close()
+
+	cache.Set("order-1", order("order-1"))
+	cache.Set("order-2", order("order-2"))
+	clock.Add(2 * time.Minute)
+	cache.Set("order-3", order("order-3"))
+
+	assert.Eventually(t, func() bool {
+		return cache.Stats().Entries == 1
+	}, time.Second, 5*time.Millisecond)
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(2), stats.Expirations)
+	assert.Equal(t, int64(0), stats.Misses)
+}
+
+func TestOrderCache_GetOrLoad_ConcurrentMissesLoadOnce(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour})
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		calls.Add(1)
+		<-release
+		return order(orderID), nil
+	}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make([]*models.CombinedData, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := cache.GetOrLoad(context.Background(), "order-1", load)
+			assert.NoError(t, err)
+			results[i] = data
+		}(i)
+	}
+
+	// let all callers miss the cache before loading finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, data := range results {
+		assert.Same(t, results[0], data)
+	}
+
+	data, found := cache.Get("order-1")
+	assert.True(t, found)
+	assert.Same(t, results[0], data)
+}
+
+func TestOrderCache_GetOrLoad_ErrorIsNotCached(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour})
+
+	calls := 0
+	load := func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		calls++
+		return nil, sql.ErrNoRows
+	}
+
+	for i := 0; i < 2; i++ {
+		data, err := cache.GetOrLoad(context.Background(), "order-1", load)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		assert.Nil(t, data)
+	}
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestOrderCache_GetOrLoad_CallerContextCancelled(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour})
+
+	release := make(chan struct{})
+	load := func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		<-release
+		return order(orderID), ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cache.GetOrLoad(ctx, "order-1", load)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// loading continues for other callers
+	close(release)
+	data, err := cache.GetOrLoad(context.Background(), "order-1", load)
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", data.Order.OrderUID)
+}
+
+func notFound(calls *int) LoaderFunc {
+	return func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		*calls++
+		return nil, sql.ErrNoRows
+	}
+}
+
+func TestOrderCache_GetOrLoad_RemembersMissing(t *testing.T) {
+	cache, clock := newTestCache(config.CacheConfig{TTL: time.Hour, NegativeTTL: time.Second})
+
+	calls := 0
+	for i := 0; i < 3; i++ {
+		_, err := cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	}
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int64(2), cache.Stats().NegativeHits)
+
+	clock.Add(2 * time.Second)
+
+	_, err := cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, 2, calls)
+}
+
+func TestOrderCache_Invalidate_ForgetsMissing(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, NegativeTTL: time.Minute})
+
+	calls := 0
+	_, err := cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, 1, cache.Stats().NegativeEntries)
+
+	cache.Invalidate("order-1")
+	assert.Equal(t, 0, cache.Stats().NegativeEntries)
+
+	data, err := cache.GetOrLoad(context.Background(), "order-1", func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		return order(orderID), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", data.Order.OrderUID)
+}
+
+func TestOrderCache_Set_ForgetsMissing(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, NegativeTTL: time.Minute})
+
+	calls := 0
+	_, _ = cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	cache.Set("order-1", order("order-1"))
+
+	data, err := cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", data.Order.OrderUID)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 0, cache.Stats().NegativeEntries)
+}
+
+func TestOrderCache_GetOrLoad_MissingNotRememberedAfterInvalidate(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, NegativeTTL: time.Minute})
+
+	// order is ingested while it is being loaded
+	_, err := cache.GetOrLoad(context.Background(), "order-1", func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		cache.Invalidate(orderID)
+		return nil, sql.ErrNoRows
+	})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, 0, cache.Stats().NegativeEntries)
+}
+
+func TestOrderCache_NegativeTierIsBounded(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour, NegativeTTL: time.Minute, NegativeMaxEntries: 2})
+
+	calls := 0
+	for _, id := range []string{"order-1", "order-2", "order-3"} {
+		_, _ = cache.GetOrLoad(context.Background(), id, notFound(&calls))
+	}
+	assert.Equal(t, 2, cache.Stats().NegativeEntries)
+
+	_, _ = cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	assert.Equal(t, 4, calls)
+}
+
+func TestOrderCache_NegativeTierDisabled(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Hour})
+
+	calls := 0
+	for i := 0; i < 2; i++ {
+		_, _ = cache.GetOrLoad(context.Background(), "order-1", notFound(&calls))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+// orderRows returns rows of recent order IDs, created a minute apart, newest first
+func orderRows(created time.Time, ids ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"order_uid", "date_created"})
+	for i, id := range ids {
+		rows.AddRow(id, created.Add(-time.Duration(i)*time.Minute))
+	}
+	return rows
+}
+
 func TestOrderCache_WarmUpCache_Success(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	rows := sqlmock.NewRows([]string{"order_uid"}).AddRow("order-1").AddRow("order-2")
-	mock.ExpectQuery(`SELECT order_uid FROM orders.*7 days`).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WithArgs(week.Seconds(), defaultWarmUpPageSize).
+		WillReturnRows(orderRows(time.Now(), "order-1", "order-2"))
 
 	mockRepo := new(MockOrderRepository)
 
@@ -102,7 +414,7 @@ func TestOrderCache_WarmUpCache_Success(t *testing.T) {
 
 	log.SetOutput(ioutil.Discard)
 
-	cache := NewOrderCache(10 * time.Second)
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
 
 	err = cache.WarmUpCache(db, mockRepo, context.Background())
 	assert.NoError(t, err)
@@ -118,60 +430,262 @@ func TestOrderCache_WarmUpCache_Success(t *testing.T) {
 	mockRepo.AssertExpectations(t)
 }
 
+func TestOrderCache_WarmUpCache_KeepsNewerData(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	dbMock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WillReturnRows(orderRows(time.Now(), "order-1", "order-2"))
+
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
+
+	stale, newer := order("order-1"), order("order-1")
+	track := "NEWER"
+	newer.Order.TrackNumber = &track
+
+	// consumer saves newer data while warm-up loads the order
+	mockRepo := new(MockOrderRepository)
+	mockRepo.On("SelectWithRetry", "order-1").
+		Run(func(mock.Arguments) { cache.Set("order-1", newer) }).
+		Return(stale, nil)
+	mockRepo.On("SelectWithRetry", "order-2").Return(order("order-2"), nil)
+
+	err = cache.WarmUpCache(db, mockRepo, context.Background())
+	assert.NoError(t, err)
+
+	res, found := cache.Get("order-1")
+	assert.True(t, found)
+	assert.Same(t, newer, res)
+	_, found = cache.Get("order-2")
+	assert.True(t, found)
+}
+
+// noEpoch is mark of warm-up for tests which do not check changes of cache
+func noEpoch() uint64 {
+	return 0
+}
+
 func TestOrderCache_WarmUpCache_SelectOrderError(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	rows := sqlmock.NewRows([]string{"order_uid"}).AddRow("order-1")
-	mock.ExpectQuery(`SELECT order_uid FROM orders`).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).WillReturnRows(orderRows(time.Now(), "order-1"))
 
 	mockRepo := new(MockOrderRepository)
-	mockRepo.On("SelectWithRetry", "order-1").Return((*models.CombinedData)(nil), sql.ErrNoRows)
+	mockRepo.On("SelectWithRetry", "order-1").Return((*models.CombinedData)(nil), sql.ErrConnDone)
 
-	cache := NewOrderCache(10 * time.Second)
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
 	err = cache.WarmUpCache(db, mockRepo, context.Background())
 
-	assert.Error(t, err)
-	assert.Equal(t, sql.ErrNoRows, err)
+	assert.Equal(t, sql.ErrConnDone, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
 	mockRepo.AssertExpectations(t)
 }
 
-func TestGetRecentOrders_Success(t *testing.T) {
+func TestOrderCache_WarmUpCache_SkipsDeletedOrder(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	rows := sqlmock.NewRows([]string{"order_uid"}).AddRow("order-1")
-	mock.ExpectQuery(`SELECT order_uid FROM orders.*7 days`).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).WillReturnRows(orderRows(time.Now(), "order-1", "order-2"))
 
+	// order-1 is deleted after its id is read
 	mockRepo := new(MockOrderRepository)
+	mockRepo.On("SelectWithRetry", "order-1").Return((*models.CombinedData)(nil), sql.ErrNoRows)
+	mockRepo.On("SelectWithRetry", "order-2").Return(order("order-2"), nil)
 
-	id := "order-1"
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
+	err = cache.WarmUpCache(db, mockRepo, context.Background())
+
+	assert.NoError(t, err)
+	_, found := cache.Get("order-2")
+	assert.True(t, found)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	mockRepo.AssertExpectations(t)
+}
+
+func TestOrderCache_WarmUpCache_TimeoutKeepsLoadedOrders(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	dbMock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).WillReturnRows(orderRows(time.Now(), "order-1", "order-2"))
 
-	expected := &models.CombinedData{Order: models.Order{OrderUID: id}}
-	mockRepo.On("SelectWithRetry", "order-1").Return(expected, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
 
-	data, err := getRecentOrders(db, mockRepo, context.Background())
+	// loading of order-2 lasts longer than warm-up timeout
+	mockRepo := new(MockOrderRepository)
+	mockRepo.On("SelectWithRetry", "order-1").Return(order("order-1"), nil)
+	mockRepo.On("SelectWithRetry", "order-2").
+		Run(func(mock.Arguments) { <-ctx.Done() }).
+		Return((*models.CombinedData)(nil), context.DeadlineExceeded)
+
+	cache := NewOrderCache(config.CacheConfig{TTL: 10 * time.Second, WarmUpWindow: week})
+	err = cache.WarmUpCache(db, mockRepo, ctx)
+
+	assert.ErrorIs(t, err, ErrWarmUpIncomplete)
+	assert.Contains(t, err.Error(), "1 orders loaded")
+	_, found := cache.Get("order-1")
+	assert.True(t, found)
+}
 
+func TestWarmUp_PagesInParallel(t *testing.T) {
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
-	assert.Len(t, data, 1)
-	assert.Equal(t, id, data[0].Order.OrderUID)
+	defer db.Close()
+
+	created := time.Now()
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WithArgs(week.Seconds(), 2).
+		WillReturnRows(orderRows(created, "order-3", "order-2"))
+	mock.ExpectQuery(`AND \(date_created, order_uid\) < \(\$3, \$4\)`).
+		WithArgs(week.Seconds(), 2, created.Add(-time.Minute), "order-2").
+		WillReturnRows(orderRows(created.Add(-2*time.Minute), "order-1"))
+
+	mockRepo := new(MockOrderRepository)
+	for _, id := range []string{"order-1", "order-2", "order-3"} {
+		mockRepo.On("SelectWithRetry", id).Return(order(id), nil)
+	}
+
+	cfg := newWarmUpConfig(config.CacheConfig{WarmUpWindow: week, WarmUpPageSize: 2, WarmUpWorkers: 3})
+	var mu sync.Mutex
+	loaded := map[string]bool{}
+	n, err := warmUp(context.Background(), db, mockRepo, cfg, noEpoch, func(data *models.CombinedData, _ uint64) {
+		mu.Lock()
+		loaded[data.Order.OrderUID] = true
+		mu.Unlock()
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Len(t, loaded, 3)
 	assert.NoError(t, mock.ExpectationsWereMet())
 	mockRepo.AssertExpectations(t)
 }
 
-func TestGetRecentOrders_QueryError(t *testing.T) {
+func TestWarmUp_StopsAtLimit(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	mock.ExpectQuery(`SELECT order_uid FROM orders`).WillReturnError(sql.ErrTxDone)
+	created := time.Now()
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WithArgs(week.Seconds(), 2).
+		WillReturnRows(orderRows(created, "order-5", "order-4"))
+	mock.ExpectQuery(`AND \(date_created, order_uid\) < \(\$3, \$4\)`).
+		WithArgs(week.Seconds(), 1, created.Add(-time.Minute), "order-4").
+		WillReturnRows(orderRows(created.Add(-2*time.Minute), "order-3"))
 
 	mockRepo := new(MockOrderRepository)
+	for _, id := range []string{"order-3", "order-4", "order-5"} {
+		mockRepo.On("SelectWithRetry", id).Return(order(id), nil)
+	}
+
+	cfg := newWarmUpConfig(config.CacheConfig{WarmUpWindow: week, WarmUpPageSize: 2, WarmUpWorkers: 2, WarmUpLimit: 3})
+	n, err := warmUp(context.Background(), db, mockRepo, cfg, noEpoch, func(*models.CombinedData, uint64) {})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	mockRepo.AssertExpectations(t)
+}
+
+func TestWarmUp_RespectsCallerContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WillDelayFor(time.Second).
+		WillReturnRows(orderRows(time.Now(), "order-1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = warmUp(ctx, db, new(MockOrderRepository), newWarmUpConfig(config.CacheConfig{WarmUpWindow: week}), noEpoch, func(*models.CombinedData, uint64) {})
+
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
 
-	_, err = getRecentOrders(db, mockRepo, context.Background())
+func TestRecentOrderIDs_QueryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).WillReturnError(sql.ErrTxDone)
+
+	_, _, err = recentOrderIDs(context.Background(), db, week, nil, 10)
 	assert.Equal(t, sql.ErrTxDone, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+// trackedOrder returns order with track number
+func trackedOrder(id, track string) *models.CombinedData {
+	data := order(id)
+	data.Order.TrackNumber = &track
+	return data
+}
+
+func TestOrderCache_GetOrLoadByTrack(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+
+	var calls int32
+	load := func(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return trackedOrder("order-1", trackNumber), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := cache.GetOrLoadByTrack(context.Background(), "WB-1", load)
+			assert.NoError(t, err)
+			assert.Equal(t, "order-1", data.Order.OrderUID)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// order is cached by its id too
+	_, ok := cache.Get("order-1")
+	assert.True(t, ok)
+
+	_, err := cache.GetOrLoadByTrack(context.Background(), "WB-1", load)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestOrderCache_TrackIndexFollowsEntries(t *testing.T) {
+	cache, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+	ctx := context.Background()
+	var calls int
+	load := func(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+		calls++
+		return nil, sql.ErrNoRows
+	}
+
+	cache.Set("order-1", trackedOrder("order-1", "WB-1"))
+	data, err := cache.GetOrLoadByTrack(ctx, "WB-1", load)
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", data.Order.OrderUID)
+
+	// track number of order is changed
+	cache.Set("order-1", trackedOrder("order-1", "WB-2"))
+	_, err = cache.GetOrLoadByTrack(ctx, "WB-1", load)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = cache.GetOrLoadByTrack(ctx, "WB-2", load)
+	assert.NoError(t, err)
+
+	cache.Invalidate("order-1")
+	_, err = cache.GetOrLoadByTrack(ctx, "WB-2", load)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Equal(t, 2, calls)
+}
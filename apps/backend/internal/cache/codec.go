@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+)
+
+// Codec defines serialization of orders stored in shared cache
+type Codec interface {
+	Marshal(data *models.CombinedData) ([]byte, error)
+	Unmarshal(b []byte, data *models.CombinedData) error
+}
+
+// JSONCodec stores orders as json, readable by other services
+type JSONCodec struct{}
+
+// Marshal encodes order to json
+func (JSONCodec) Marshal(data *models.CombinedData) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// Unmarshal decodes order from json
+func (JSONCodec) Unmarshal(b []byte, data *models.CombinedData) error {
+	return json.Unmarshal(b, data)
+}
+
+// GobCodec stores orders as gob, which is more compact and faster for Go services
+type GobCodec struct{}
+
+// Marshal encodes order to gob
+func (GobCodec) Marshal(data *models.CombinedData) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes order from gob
+func (GobCodec) Unmarshal(b []byte, data *models.CombinedData) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(data)
+}
+
+// NewCodec returns codec by name of serialization
+// Accepts:
+//   - serialization: json or gob
+//
+// Returns:
+//   - Codec
+//   - error if serialization is unknown
+func NewCodec(serialization string) (Codec, error) {
+	switch serialization {
+	case config.SerializationJSON:
+		return JSONCodec{}, nil
+	case config.SerializationGob:
+		return GobCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown serialization %q", serialization)
+	}
+}
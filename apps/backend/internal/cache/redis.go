@@ -0,0 +1,380 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/repository"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// RedisCache keeps orders in redis shared by all replicas of the service
+// With local tier enabled, orders are also kept in OrderCache of the replica.
+// Every change of an order is published to invalidation channel, so other
+// replicas evict it from their local tiers.
+// Errors of redis are logged and treated as misses, so the service keeps
+// working with database when redis is unavailable.
+type RedisCache struct {
+	client *redis.Client
+	codec  Codec
+	cfg    config.RedisConfig
+	ttl    time.Duration
+	// id distinguishes own invalidation messages from messages of other replicas
+	id string
+
+	local   *OrderCache
+	sub     *redis.PubSub
+	done    chan struct{}
+	loading singleflight.Group
+
+	warmUp  warmUpConfig
+	changes changeLog
+}
+
+// invalidation is a message published when order is changed
+type invalidation struct {
+	Source   string `json:"source"`
+	OrderUID string `json:"orderUID"`
+}
+
+// NewRedisCache connects to redis and subscribes to invalidation channel
+// Accepts:
+//   - cfg: settings of cache
+//
+// Returns:
+//   - *RedisCache
+//   - error if redis is unavailable
+func NewRedisCache(cfg config.CacheConfig) (*RedisCache, error) {
+	codec, err := NewCodec(cfg.Redis.Serialization)
+	if err != nil {
+		return nil, fmt.Errorf("redis cache: %w", err)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:         cfg.Redis.Addr,
+		Password:     cfg.Redis.Password,
+		DB:           cfg.Redis.DB,
+		DialTimeout:  cfg.Redis.Timeout,
+		ReadTimeout:  cfg.Redis.Timeout,
+		WriteTimeout: cfg.Redis.Timeout,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Redis.Timeout)
+	defer cancel()
+	if err = client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("redis cache: %w", err)
+	}
+
+	c := &RedisCache{
+		client: client,
+		codec:  codec,
+		cfg:    cfg.Redis,
+		ttl:    cfg.TTL,
+		id:     uuid.NewString(),
+		warmUp: newWarmUpConfig(cfg),
+	}
+
+	if cfg.Redis.LocalTier {
+		localCfg := cfg
+		localCfg.TTL = cfg.Redis.LocalTTL
+		c.local = NewOrderCache(localCfg)
+
+		c.sub = client.Subscribe(ctx, cfg.Redis.Channel)
+		// wait for confirmation, so no invalidation is missed after return
+		if _, err = c.sub.Receive(ctx); err != nil {
+			c.local.Close()
+			_ = c.sub.Close()
+			_ = client.Close()
+			return nil, fmt.Errorf("redis cache: subscribe to %s: %w", cfg.Redis.Channel, err)
+		}
+		c.done = make(chan struct{})
+		go c.listen()
+	}
+
+	return c, nil
+}
+
+// Set save data in redis and local tier, other replicas evict the order
+// Accepts:
+//   - orderID: id of order
+//   - data: all data about order
+func (c *RedisCache) Set(orderID string, data *models.CombinedData) {
+	c.changes.touch(orderID)
+	if c.local != nil {
+		c.local.Set(orderID, data)
+	}
+	c.store(context.Background(), orderID, data)
+	c.publish(orderID)
+}
+
+// Get receive data from local tier or from redis
+// Accepts:
+//   - orderID: id of order
+//
+// Returns:
+//   - all data about order
+//   - did it work
+func (c *RedisCache) Get(orderID string) (*models.CombinedData, bool) {
+	if c.local != nil {
+		if data, ok := c.local.Get(orderID); ok {
+			return data, true
+		}
+	}
+
+	data, ok := c.fetch(context.Background(), orderID)
+	if !ok {
+		return &models.CombinedData{}, false
+	}
+
+	if c.local != nil {
+		c.local.Set(orderID, data)
+	}
+	return data, true
+}
+
+// Invalidate removes order from redis and from local tiers of all replicas
+// Accepts:
+//   - orderID: id of order
+func (c *RedisCache) Invalidate(orderID string) {
+	c.changes.touch(orderID)
+	if c.local != nil {
+		c.local.Invalidate(orderID)
+	}
+	if err := c.client.Del(context.Background(), c.key(orderID)).Err(); err != nil {
+		log.Printf("Redis cache: delete order %s: %v", orderID, err)
+	}
+	c.publish(orderID)
+}
+
+// GetOrLoad receive data from cache or loads it if there is no such order
+// Order missing in local tier is looked up in redis first, loaded orders are
+// saved to redis. Concurrent misses of the same order are coalesced.
+// Accepts:
+//   - ctx: context
+//   - orderID: id of order
+//   - load: function which loads order
+//
+// Returns:
+//   - all data about order
+//   - error of load or of ctx
+func (c *RedisCache) GetOrLoad(ctx context.Context, orderID string, load LoaderFunc) (*models.CombinedData, error) {
+	shared := func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		if data, ok := c.fetch(ctx, orderID); ok {
+			return data, nil
+		}
+
+		data, err := load(ctx, orderID)
+		if err != nil {
+			return nil, err
+		}
+		c.store(ctx, orderID, data)
+		return data, nil
+	}
+
+	// local tier coalesces loading and remembers missing orders itself
+	if c.local != nil {
+		return c.local.GetOrLoad(ctx, orderID, shared)
+	}
+
+	ch := c.loading.DoChan(orderID, func() (any, error) {
+		return shared(context.WithoutCancel(ctx), orderID)
+	})
+	return awaitLoad(ctx, ch)
+}
+
+// GetOrLoadByTrack receive data by track number from cache or loads it if there is no such order
+// Redis keeps order id of every stored track number.
+// Accepts:
+//   - ctx: context
+//   - trackNumber: track number of order
+//   - load: function which loads order by track number
+//
+// Returns:
+//   - all data about order
+//   - error of load or of ctx
+func (c *RedisCache) GetOrLoadByTrack(ctx context.Context, trackNumber string, load LoaderFunc) (*models.CombinedData, error) {
+	shared := func(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+		if data, ok := c.fetchByTrack(ctx, trackNumber); ok {
+			return data, nil
+		}
+
+		data, err := load(ctx, trackNumber)
+		if err != nil {
+			return nil, err
+		}
+		c.store(ctx, data.Order.OrderUID, data)
+		return data, nil
+	}
+
+	if c.local != nil {
+		return c.local.GetOrLoadByTrack(ctx, trackNumber, shared)
+	}
+
+	ch := c.loading.DoChan(trackKeyPrefix+trackNumber, func() (any, error) {
+		return shared(context.WithoutCancel(ctx), trackNumber)
+	})
+	return awaitLoad(ctx, ch)
+}
+
+// WarmUpCache fills cache with recent orders from database
+// Accepts:
+//   - db: database
+//   - repo: repository
+//   - ctx: context, loading stops when it is done
+//
+// Returns:
+//   - error if something wrong, ErrWarmUpIncomplete if deadline of ctx stopped loading,
+//     orders loaded before it stay in cache
+func (c *RedisCache) WarmUpCache(db *sql.DB, repo repository.OrderRepository, ctx context.Context) error {
+	c.changes.start()
+	defer c.changes.stop()
+
+	// order changed by this replica during loading is not overwritten, changes of
+	// other replicas and the one between check and store are cleared by ttl
+	n, err := warmUp(ctx, db, repo, c.warmUp, c.changes.current, func(data *models.CombinedData, epoch uint64) {
+		if c.changes.changedSince(data.Order.OrderUID, epoch) {
+			return
+		}
+		if c.local != nil {
+			c.local.Set(data.Order.OrderUID, data)
+		}
+		c.store(ctx, data.Order.OrderUID, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Warmed up redis cache with %d orders", n)
+
+	return nil
+}
+
+// Stats returns counters of local tier
+func (c *RedisCache) Stats() Stats {
+	if c.local == nil {
+		return Stats{}
+	}
+	return c.local.Stats()
+}
+
+// Close stops listening of invalidations and closes connection to redis
+func (c *RedisCache) Close() {
+	if c.sub != nil {
+		if err := c.sub.Close(); err != nil {
+			log.Println(err)
+		}
+		<-c.done
+	}
+	if c.local != nil {
+		c.local.Close()
+	}
+	if err := c.client.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *RedisCache) key(orderID string) string {
+	return c.cfg.KeyPrefix + orderID
+}
+
+func (c *RedisCache) trackKey(trackNumber string) string {
+	return c.cfg.KeyPrefix + trackKeyPrefix + trackNumber
+}
+
+// fetchByTrack reads order from redis by track number
+// Index of track number may be stale, so track number of found order is checked.
+func (c *RedisCache) fetchByTrack(ctx context.Context, trackNumber string) (*models.CombinedData, bool) {
+	orderID, err := c.client.Get(ctx, c.trackKey(trackNumber)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Redis cache: get track number %s: %v", trackNumber, err)
+		}
+		return nil, false
+	}
+
+	data, ok := c.fetch(ctx, orderID)
+	if !ok || data.Order.TrackNumber == nil || *data.Order.TrackNumber != trackNumber {
+		return nil, false
+	}
+	return data, true
+}
+
+// fetch reads order from redis
+func (c *RedisCache) fetch(ctx context.Context, orderID string) (*models.CombinedData, bool) {
+	b, err := c.client.Get(ctx, c.key(orderID)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Redis cache: get order %s: %v", orderID, err)
+		}
+		return nil, false
+	}
+
+	data := &models.CombinedData{}
+	if err = c.codec.Unmarshal(b, data); err != nil {
+		log.Printf("Redis cache: decode order %s: %v", orderID, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// store writes order to redis
+func (c *RedisCache) store(ctx context.Context, orderID string, data *models.CombinedData) {
+	b, err := c.codec.Marshal(data)
+	if err != nil {
+		log.Printf("Redis cache: encode order %s: %v", orderID, err)
+		return
+	}
+	_, err = c.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, c.key(orderID), b, c.ttl)
+		if data.Order.TrackNumber != nil {
+			p.Set(ctx, c.trackKey(*data.Order.TrackNumber), orderID, c.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Redis cache: set order %s: %v", orderID, err)
+	}
+}
+
+// publish tells other replicas to evict order from their local tiers
+func (c *RedisCache) publish(orderID string) {
+	if c.local == nil {
+		return
+	}
+
+	msg, err := json.Marshal(invalidation{Source: c.id, OrderUID: orderID})
+	if err != nil {
+		log.Printf("Redis cache: encode invalidation of %s: %v", orderID, err)
+		return
+	}
+	if err = c.client.Publish(context.Background(), c.cfg.Channel, msg).Err(); err != nil {
+		log.Printf("Redis cache: publish invalidation of %s: %v", orderID, err)
+	}
+}
+
+// listen evicts orders changed by other replicas until subscription is closed
+func (c *RedisCache) listen() {
+	defer close(c.done)
+
+	for msg := range c.sub.Channel() {
+		inv := invalidation{}
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+			log.Printf("Redis cache: decode invalidation: %v", err)
+			continue
+		}
+		if inv.Source == c.id {
+			continue
+		}
+		c.local.Invalidate(inv.OrderUID)
+	}
+}
@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// redisConfig returns settings of cache connected to miniredis
+func redisConfig(s *miniredis.Miniredis) config.CacheConfig {
+	cfg := config.Default().Cache
+	cfg.Backend = config.CacheRedis
+	cfg.TTL = time.Minute
+	cfg.Redis.Addr = s.Addr()
+	cfg.Redis.Timeout = time.Second
+	return cfg
+}
+
+func newTestRedisCache(t *testing.T, cfg config.CacheConfig) *RedisCache {
+	c, err := NewRedisCache(cfg)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func countingLoader(calls *int32) LoaderFunc {
+	return func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		atomic.AddInt32(calls, 1)
+		return order(orderID), nil
+	}
+}
+
+func TestRedisCache_SetAndGet(t *testing.T) {
+	for _, serialization := range []string{config.SerializationJSON, config.SerializationGob} {
+		t.Run(serialization, func(t *testing.T) {
+			s := miniredis.RunT(t)
+			cfg := redisConfig(s)
+			cfg.Redis.Serialization = serialization
+			cfg.Redis.LocalTier = false
+			c := newTestRedisCache(t, cfg)
+
+			chrtID, name, track := 9934930, "Mascaras", "WBILMTESTTRACK"
+			data := order("order-1")
+			data.Order.TrackNumber = &track
+			data.Items = []models.Item{{ChrtID: &chrtID, Name: &name}}
+			c.Set("order-1", data)
+			assert.True(t, s.Exists(cfg.Redis.KeyPrefix+"order-1"))
+
+			result, ok := c.Get("order-1")
+			assert.True(t, ok)
+			assert.Equal(t, data.Order, result.Order)
+			assert.Equal(t, data.Items, result.Items)
+
+			_, ok = c.Get("not-found")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestRedisCache_SharedBetweenInstances(t *testing.T) {
+	s := miniredis.RunT(t)
+	first := newTestRedisCache(t, redisConfig(s))
+	second := newTestRedisCache(t, redisConfig(s))
+
+	var calls int32
+	_, err := first.GetOrLoad(context.Background(), "order-1", countingLoader(&calls))
+	assert.NoError(t, err)
+
+	result, err := second.GetOrLoad(context.Background(), "order-1", countingLoader(&calls))
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", result.Order.OrderUID)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRedisCache_InvalidatePropagatesToLocalTiers(t *testing.T) {
+	s := miniredis.RunT(t)
+	first := newTestRedisCache(t, redisConfig(s))
+	second := newTestRedisCache(t, redisConfig(s))
+
+	second.Set("order-1", order("order-1"))
+	_, ok := first.Get("order-1")
+	assert.True(t, ok)
+
+	second.Invalidate("order-1")
+
+	assert.Eventually(t, func() bool {
+		_, ok := first.local.Get("order-1")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok = first.Get("order-1")
+	assert.False(t, ok)
+}
+
+func TestRedisCache_SetEvictsStaleLocalCopies(t *testing.T) {
+	s := miniredis.RunT(t)
+	first := newTestRedisCache(t, redisConfig(s))
+	second := newTestRedisCache(t, redisConfig(s))
+
+	first.Set("order-1", order("order-1"))
+
+	updated := order("order-1")
+	track := "NEW"
+	updated.Order.TrackNumber = &track
+	second.Set("order-1", updated)
+
+	assert.Eventually(t, func() bool {
+		data, ok := first.Get("order-1")
+		return ok && data.Order.TrackNumber != nil && *data.Order.TrackNumber == "NEW"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisCache_TTL(t *testing.T) {
+	s := miniredis.RunT(t)
+	cfg := redisConfig(s)
+	cfg.Redis.LocalTier = false
+	c := newTestRedisCache(t, cfg)
+
+	c.Set("order-1", order("order-1"))
+	s.FastForward(cfg.TTL + time.Second)
+
+	_, ok := c.Get("order-1")
+	assert.False(t, ok)
+}
+
+func TestRedisCache_GetOrLoad_RedisUnavailable(t *testing.T) {
+	s := miniredis.RunT(t)
+	cfg := redisConfig(s)
+	cfg.Redis.LocalTier = false
+	c := newTestRedisCache(t, cfg)
+
+	s.Close()
+
+	var calls int32
+	result, err := c.GetOrLoad(context.Background(), "order-1", countingLoader(&calls))
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", result.Order.OrderUID)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestNewRedisCache_Unavailable(t *testing.T) {
+	s := miniredis.RunT(t)
+	cfg := redisConfig(s)
+	s.Close()
+
+	_, err := NewRedisCache(cfg)
+	assert.Error(t, err)
+}
+
+func TestRedisCache_GetOrLoadByTrack_SharedBetweenInstances(t *testing.T) {
+	s := miniredis.RunT(t)
+	first := newTestRedisCache(t, redisConfig(s))
+	second := newTestRedisCache(t, redisConfig(s))
+
+	var calls int32
+	load := func(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+		atomic.AddInt32(&calls, 1)
+		data := order("order-1")
+		data.Order.TrackNumber = &trackNumber
+		return data, nil
+	}
+
+	_, err := first.GetOrLoadByTrack(context.Background(), "WB-1", load)
+	assert.NoError(t, err)
+
+	result, err := second.GetOrLoadByTrack(context.Background(), "WB-1", load)
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", result.Order.OrderUID)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// order is found by its id too
+	_, ok := second.Get("order-1")
+	assert.True(t, ok)
+}
+
+func TestRedisCache_WarmUpCache_KeepsInvalidatedOrder(t *testing.T) {
+	s := miniredis.RunT(t)
+	cfg := redisConfig(s)
+	cfg.WarmUpWindow = week
+	c := newTestRedisCache(t, cfg)
+
+	db, dbMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	dbMock.ExpectQuery(`SELECT order_uid, date_created FROM orders`).
+		WillReturnRows(orderRows(time.Now(), "order-1", "order-2"))
+
+	// consumer invalidates the order while warm-up loads it
+	repo := new(MockOrderRepository)
+	repo.On("SelectWithRetry", "order-1").
+		Run(func(mock.Arguments) { c.Invalidate("order-1") }).
+		Return(order("order-1"), nil)
+	repo.On("SelectWithRetry", "order-2").Return(order("order-2"), nil)
+
+	require.NoError(t, c.WarmUpCache(db, repo, context.Background()))
+
+	assert.False(t, s.Exists(cfg.Redis.KeyPrefix+"order-1"))
+	assert.True(t, s.Exists(cfg.Redis.KeyPrefix+"order-2"))
+	_, ok := c.local.Get("order-1")
+	assert.False(t, ok)
+}
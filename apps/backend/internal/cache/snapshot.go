@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+)
+
+// snapshotVersion must be changed when models or format of snapshot are changed
+const snapshotVersion = 1
+
+// Errors of loading snapshot, in all cases cache should be warmed up from database
+var (
+	ErrSnapshotCorrupted = errors.New("cache snapshot is corrupted")
+	ErrSnapshotVersion   = errors.New("cache snapshot has unsupported version")
+	ErrSnapshotStale     = errors.New("cache snapshot is stale")
+)
+
+// snapshotFile is content of snapshot file
+type snapshotFile struct {
+	Version  int
+	Created  time.Time
+	Checksum uint32
+	// Payload is gob encoded []snapshotEntry
+	Payload []byte
+}
+
+// snapshotEntry is cached order with its expiry time
+type snapshotEntry struct {
+	OrderUID  string
+	Data      *models.CombinedData
+	ExpiresAt time.Time
+}
+
+// SaveSnapshot writes not expired orders to file
+// File is replaced atomically, so a crash during saving keeps the previous snapshot.
+// Accepts:
+//   - path: path of snapshot file
+//
+// Returns:
+//   - number of saved orders
+//   - error if something wrong
+func (c *OrderCache) SaveSnapshot(path string) (int, error) {
+	c.mu.Lock()
+	now := c.now()
+	entries := make([]snapshotEntry, 0, c.lru.Len())
+	// from least to most recently used, so loading restores order of LRU
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if now.Before(e.expiresAt) {
+			entries = append(entries, snapshotEntry{OrderUID: e.key, Data: e.data, ExpiresAt: e.expiresAt})
+		}
+	}
+	c.mu.Unlock()
+
+	payload := bytes.Buffer{}
+	if err := gob.NewEncoder(&payload).Encode(entries); err != nil {
+		return 0, fmt.Errorf("cache snapshot: %w", err)
+	}
+
+	file := bytes.Buffer{}
+	err := gob.NewEncoder(&file).Encode(snapshotFile{
+		Version:  snapshotVersion,
+		Created:  now,
+		Checksum: crc32.ChecksumIEEE(payload.Bytes()),
+		Payload:  payload.Bytes(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cache snapshot: %w", err)
+	}
+
+	if err = writeFileAtomic(path, file.Bytes()); err != nil {
+		return 0, fmt.Errorf("cache snapshot: %w", err)
+	}
+
+	return len(entries), nil
+}
+
+// LoadSnapshot fills cache with orders from snapshot file
+// Accepts:
+//   - path: path of snapshot file
+//   - maxAge: max age of snapshot, 0 means no limit
+//
+// Returns:
+//   - number of loaded orders
+//   - error if file is missing, stale or corrupted
+func (c *OrderCache) LoadSnapshot(path string, maxAge time.Duration) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("cache snapshot: %w", err)
+	}
+
+	file := snapshotFile{}
+	if err = gob.NewDecoder(bytes.NewReader(content)).Decode(&file); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupted, err)
+	}
+	if file.Version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrSnapshotVersion, file.Version)
+	}
+	if crc32.ChecksumIEEE(file.Payload) != file.Checksum {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+
+	c.mu.Lock()
+	now := c.now()
+	c.mu.Unlock()
+	if maxAge > 0 && now.Sub(file.Created) > maxAge {
+		return 0, fmt.Errorf("%w: created at %s", ErrSnapshotStale, file.Created.Format(time.RFC3339))
+	}
+
+	var entries []snapshotEntry
+	if err = gob.NewDecoder(bytes.NewReader(file.Payload)).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupted, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, e := range entries {
+		if e.Data == nil || !now.Before(e.ExpiresAt) {
+			continue
+		}
+		c.setUntil(e.OrderUID, e.Data, e.ExpiresAt)
+		n++
+	}
+
+	return n, nil
+}
+
+// writeFileAtomic writes data to temporary file and renames it to path
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderCache_Snapshot_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	cfg := config.CacheConfig{TTL: time.Minute, MaxEntries: 2}
+
+	src, clock := newTestCache(cfg)
+	chrtID := 9934930
+	data := order("order-1")
+	data.Items = []models.Item{{ChrtID: &chrtID}}
+	src.Set("order-1", data)
+	clock.Add(30 * time.Second)
+	src.Set("order-2", order("order-2"))
+	// order-1 becomes most recently used
+	src.Get("order-1")
+
+	n, err := src.SaveSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dst, dstClock := newTestCache(cfg)
+	dstClock.Add(30 * time.Second)
+	n, err = dst.LoadSnapshot(path, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	got, ok := dst.Get("order-1")
+	assert.True(t, ok)
+	assert.Equal(t, data, got)
+
+	// order-2 is least recently used and is evicted first
+	dst.Set("order-3", order("order-3"))
+	_, ok = dst.Get("order-2")
+	assert.False(t, ok)
+
+	// order-1 keeps its expiry time from snapshot
+	dstClock.Add(30 * time.Second)
+	_, ok = dst.Get("order-1")
+	assert.False(t, ok)
+}
+
+func TestOrderCache_Snapshot_SkipsExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	src, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+	src.Set("order-1", order("order-1"))
+	_, err := src.SaveSnapshot(path)
+	require.NoError(t, err)
+
+	dst, clock := newTestCache(config.CacheConfig{TTL: time.Minute})
+	clock.Add(2 * time.Minute)
+	n, err := dst.LoadSnapshot(path, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestOrderCache_Snapshot_Missing(t *testing.T) {
+	c, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+
+	_, err := c.LoadSnapshot(filepath.Join(t.TempDir(), "missing"), time.Hour)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOrderCache_Snapshot_Stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	src, _ := newTestCache(config.CacheConfig{TTL: 48 * time.Hour})
+	src.Set("order-1", order("order-1"))
+	_, err := src.SaveSnapshot(path)
+	require.NoError(t, err)
+
+	dst, clock := newTestCache(config.CacheConfig{TTL: 48 * time.Hour})
+	clock.Add(2 * time.Hour)
+	_, err = dst.LoadSnapshot(path, time.Hour)
+	assert.ErrorIs(t, err, ErrSnapshotStale)
+	assert.Equal(t, 0, dst.Stats().Entries)
+}
+
+func TestOrderCache_Snapshot_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	src, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+	src.Set("order-1", order("order-1"))
+	_, err := src.SaveSnapshot(path)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content[len(content)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+
+	dst, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+	_, err = dst.LoadSnapshot(path, time.Hour)
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	_, err = dst.LoadSnapshot(path, time.Hour)
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+}
+
+func TestOrderCache_Snapshot_UnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	file := bytes.Buffer{}
+	require.NoError(t, gob.NewEncoder(&file).Encode(snapshotFile{Version: snapshotVersion + 1, Created: time.Now()}))
+	require.NoError(t, os.WriteFile(path, file.Bytes(), 0o600))
+
+	c, _ := newTestCache(config.CacheConfig{TTL: time.Minute})
+	_, err := c.LoadSnapshot(path, 0)
+	assert.ErrorIs(t, err, ErrSnapshotVersion)
+}
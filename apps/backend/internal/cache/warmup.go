@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/repository"
+	"golang.org/x/sync/errgroup"
+)
+
+const defaultWarmUpPageSize = 1000
+
+// ErrWarmUpIncomplete means that warm-up stopped by its timeout, loaded orders are kept in cache
+var ErrWarmUpIncomplete = errors.New("cache warm-up is not complete")
+
+// warmUpConfig contains settings of loading recent orders into cache
+type warmUpConfig struct {
+	window   time.Duration
+	pageSize int
+	workers  int
+	// limit is max number of loaded orders, 0 means no limit
+	limit int
+}
+
+func newWarmUpConfig(cfg config.CacheConfig) warmUpConfig {
+	w := warmUpConfig{
+		window:   cfg.WarmUpWindow,
+		pageSize: cfg.WarmUpPageSize,
+		workers:  cfg.WarmUpWorkers,
+		limit:    cfg.WarmUpLimit,
+	}
+	if w.pageSize <= 0 {
+		w.pageSize = defaultWarmUpPageSize
+	}
+	if w.workers <= 0 {
+		w.workers = 1
+	}
+	return w
+}
+
+// orderCursor is position of the last read order, orders are read newest first
+type orderCursor struct {
+	created  time.Time
+	orderUID string
+}
+
+// warmUp pages through recent orders, newest first, and loads them in parallel
+// Orders deleted after their ids are read are skipped. Loading stops at the first
+// other error or when ctx is done, deadline of ctx gives ErrWarmUpIncomplete.
+// Accepts:
+//   - ctx: context
+//   - db: database
+//   - repo: repository
+//   - cfg: settings of warm-up
+//   - mark: returns epoch of cache, it is taken before every order is loaded
+//   - set: saves loaded order to cache unless it changed after epoch, called from several goroutines
+//
+// Returns:
+//   - number of loaded orders
+//   - error if something wrong, ErrWarmUpIncomplete if deadline of ctx is exceeded
+func warmUp(ctx context.Context, db *sql.DB, repo repository.OrderRepository, cfg warmUpConfig, mark func() uint64, set func(data *models.CombinedData, epoch uint64)) (int, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	ids := make(chan string, cfg.pageSize)
+	var loaded atomic.Int64
+
+	g.Go(func() error {
+		defer close(ids)
+
+		var after *orderCursor
+		sent := 0
+		for {
+			size := cfg.pageSize
+			if cfg.limit > 0 && cfg.limit-sent < size {
+				size = cfg.limit - sent
+			}
+			if size == 0 {
+				return nil
+			}
+
+			page, last, err := recentOrderIDs(gctx, db, cfg.window, after, size)
+			if err != nil {
+				return err
+			}
+			for _, id := range page {
+				select {
+				case ids <- id:
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+			}
+			sent += len(page)
+			if len(page) < size {
+				return nil
+			}
+			after = last
+		}
+	})
+
+	for i := 0; i < cfg.workers; i++ {
+		g.Go(func() error {
+			for id := range ids {
+				// consumer may save newer data while order is loaded
+				epoch := mark()
+				data, err := repo.SelectWithRetry(gctx, id)
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				set(data, epoch)
+				loaded.Add(1)
+			}
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	n := int(loaded.Load())
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return n, fmt.Errorf("%w: %d orders loaded before timeout", ErrWarmUpIncomplete, n)
+	}
+	return n, err
+}
+
+// recentOrderIDs returns page of ids of orders created within window, using keyset pagination
+// Accepts:
+//   - ctx: context
+//   - db: database
+//   - window: max age of orders
+//   - after: cursor of previous page, nil for the first page
+//   - limit: size of page
+//
+// Returns:
+//   - ids of orders
+//   - cursor of the last order of page
+//   - error if something wrong
+func recentOrderIDs(ctx context.Context, db *sql.DB, window time.Duration, after *orderCursor, limit int) (ids []string, last *orderCursor, err error) {
+	query := `
+SELECT order_uid, date_created FROM orders
+WHERE date_created >= NOW() - $1 * INTERVAL '1 second'
+ORDER BY date_created DESC, order_uid DESC
+LIMIT $2
+`
+	args := []any{window.Seconds(), limit}
+	if after != nil {
+		query = `
+SELECT order_uid, date_created FROM orders
+WHERE date_created >= NOW() - $1 * INTERVAL '1 second'
+  AND (date_created, order_uid) < ($3, $4)
+ORDER BY date_created DESC, order_uid DESC
+LIMIT $2
+`
+		args = append(args, after.created, after.orderUID)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
+
+	ids = make([]string, 0, limit)
+	cur := orderCursor{}
+	for rows.Next() {
+		if err = rows.Scan(&cur.orderUID, &cur.created); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, cur.orderUID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return ids, &cur, nil
+}
+
+// changeLog counts changes of orders by epoch, so data loaded before a change
+// is not stored over it. While warm-up is running it also remembers epoch of
+// every changed order. It is safe to call while mutex of cache is held.
+type changeLog struct {
+	mu    sync.Mutex
+	epoch uint64
+	// changed is nil when warm-up is not running
+	changed map[string]uint64
+}
+
+// start begins to remember changed orders
+func (l *changeLog) start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changed = map[string]uint64{}
+}
+
+// stop forgets changed orders
+func (l *changeLog) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changed = nil
+}
+
+// current returns epoch to compare with later changes
+func (l *changeLog) current() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch
+}
+
+// touch records change of order
+func (l *changeLog) touch(orderID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.epoch++
+	if l.changed != nil {
+		l.changed[orderID] = l.epoch
+	}
+}
+
+// changedSince reports whether order was changed after epoch
+func (l *changeLog) changedSince(orderID string, epoch uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed[orderID] > epoch
+}
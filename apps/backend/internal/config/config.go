@@ -0,0 +1,559 @@
+// Package config provides configuration of the service
+//
+// Includes:
+//   - default values
+//   - loading from YAML file, environment variables and command line flags
+//   - validation
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config contains all settings of the service
+type Config struct {
+	DB         DBConfig         `yaml:"db"`
+	Repository RepositoryConfig `yaml:"repository"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	HTTP       HTTPConfig       `yaml:"http"`
+	Cache      CacheConfig      `yaml:"cache"`
+}
+
+// DBConfig contains settings of connection to database
+type DBConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// Policies of handling an order which already exists with other data
+const (
+	DuplicateReject    = "reject"
+	DuplicateIgnore    = "ignore"
+	DuplicateOverwrite = "overwrite"
+)
+
+// RepositoryConfig contains settings of retries in repository
+type RepositoryConfig struct {
+	MaxRetries      int           `yaml:"max_retries"`
+	RetryDelay      time.Duration `yaml:"retry_delay"`
+	MaxRetryDelay   time.Duration `yaml:"max_retry_delay"`
+	DuplicatePolicy string        `yaml:"duplicate_policy"`
+}
+
+// Stores of messages which could not be processed
+const (
+	DeadLetterTopic = "topic"
+	DeadLetterTable = "table"
+	DeadLetterBoth  = "both"
+)
+
+// KafkaConfig contains settings of kafka consumer
+type KafkaConfig struct {
+	Brokers     []string `yaml:"brokers"`
+	Topic       string   `yaml:"topic"`
+	GroupID     string   `yaml:"group_id"`
+	StartOffset string   `yaml:"start_offset"`
+	DLQTopic    string   `yaml:"dlq_topic"`
+	// DeadLetter is where failed messages are stored: DLQ topic, quarantine table or both
+	DeadLetter    string        `yaml:"dead_letter"`
+	MaxRetries    int           `yaml:"max_retries"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+	MaxRetryDelay time.Duration `yaml:"max_retry_delay"`
+	// RetryTiers are delays of retry topics which failed messages go through before DLQ
+	RetryTiers   []time.Duration `yaml:"retry_tiers"`
+	Workers      int             `yaml:"workers"`
+	MaxInFlight  int             `yaml:"max_in_flight"`
+	BatchSize    int             `yaml:"batch_size"`
+	BatchTimeout time.Duration   `yaml:"batch_timeout"`
+}
+
+// HTTPConfig contains settings of http server
+type HTTPConfig struct {
+	Addr            string        `yaml:"addr"`
+	RequestTimeout  time.Duration `yaml:"request_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// AdminToken enables admin endpoints, they require it as bearer token
+	AdminToken string `yaml:"admin_token"`
+}
+
+// Backends of cache
+const (
+	CacheMemory = "memory"
+	CacheRedis  = "redis"
+)
+
+// Serialization formats of orders in shared cache
+const (
+	SerializationJSON = "json"
+	SerializationGob  = "gob"
+)
+
+// CacheConfig contains settings of cache
+// Limits, janitor and negative tier apply to in-memory cache, with redis
+// backend they apply to the local tier.
+type CacheConfig struct {
+	Backend        string        `yaml:"backend"`
+	TTL            time.Duration `yaml:"ttl"`
+	WarmUpWindow   time.Duration `yaml:"warm_up_window"`
+	WarmUpPageSize int           `yaml:"warm_up_page_size"`
+	WarmUpWorkers  int           `yaml:"warm_up_workers"`
+	// WarmUpLimit is max number of orders loaded at start, 0 means no limit
+	WarmUpLimit   int           `yaml:"warm_up_limit"`
+	WarmUpTimeout time.Duration `yaml:"warm_up_timeout"`
+	// WarmUpBackground starts serving before warm-up is finished
+	WarmUpBackground bool          `yaml:"warm_up_background"`
+	MaxEntries       int           `yaml:"max_entries"`
+	MaxBytes         int64         `yaml:"max_bytes"`
+	JanitorInterval  time.Duration `yaml:"janitor_interval"`
+	// NegativeTTL is how long unknown order IDs are remembered, 0 disables it
+	NegativeTTL        time.Duration `yaml:"negative_ttl"`
+	NegativeMaxEntries int           `yaml:"negative_max_entries"`
+	// SnapshotPath is file where in-memory cache is saved on shutdown, empty disables snapshots
+	SnapshotPath   string        `yaml:"snapshot_path"`
+	SnapshotMaxAge time.Duration `yaml:"snapshot_max_age"`
+	Redis          RedisConfig   `yaml:"redis"`
+}
+
+// RedisConfig contains settings of shared cache in redis
+type RedisConfig struct {
+	Addr          string        `yaml:"addr"`
+	Password      string        `yaml:"password"`
+	DB            int           `yaml:"db"`
+	Timeout       time.Duration `yaml:"timeout"`
+	KeyPrefix     string        `yaml:"key_prefix"`
+	Serialization string        `yaml:"serialization"`
+	// LocalTier enables in-memory cache in front of redis
+	LocalTier bool `yaml:"local_tier"`
+	// LocalTTL is short, because invalidation messages may be lost
+	LocalTTL time.Duration `yaml:"local_ttl"`
+	Channel  string        `yaml:"channel"`
+}
+
+// Default returns config with default values
+// Returns:
+//   - *Config
+func Default() *Config {
+	return &Config{
+		DB: DBConfig{
+			Host:    "localhost",
+			Port:    "5432",
+			Name:    "orders_l0",
+			SSLMode: "disable",
+		},
+		Repository: RepositoryConfig{
+			MaxRetries:      5,
+			RetryDelay:      50 * time.Millisecond,
+			MaxRetryDelay:   time.Second,
+			DuplicatePolicy: DuplicateOverwrite,
+		},
+		Kafka: KafkaConfig{
+			Brokers:       []string{"kafka:9092"},
+			Topic:         "test1234",
+			GroupID:       "myOrdersGroup-123456",
+			StartOffset:   "first",
+			DLQTopic:      "dlq",
+			DeadLetter:    DeadLetterTopic,
+			MaxRetries:    3,
+			RetryDelay:    time.Second,
+			MaxRetryDelay: 30 * time.Second,
+			Workers:       1,
+			MaxInFlight:   100,
+			BatchSize:     1,
+			BatchTimeout:  100 * time.Millisecond,
+		},
+		HTTP: HTTPConfig{
+			Addr:            ":8080",
+			RequestTimeout:  4 * time.Second,
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Cache: CacheConfig{
+			Backend:            CacheMemory,
+			TTL:                48 * time.Hour,
+			WarmUpWindow:       7 * 24 * time.Hour,
+			WarmUpPageSize:     1000,
+			WarmUpWorkers:      8,
+			WarmUpLimit:        50000,
+			WarmUpTimeout:      time.Minute,
+			MaxEntries:         100000,
+			MaxBytes:           256 << 20,
+			JanitorInterval:    time.Minute,
+			NegativeTTL:        30 * time.Second,
+			NegativeMaxEntries: 10000,
+			SnapshotMaxAge:     time.Hour,
+			Redis: RedisConfig{
+				Addr:          "localhost:6379",
+				Timeout:       200 * time.Millisecond,
+				KeyPrefix:     "orders:",
+				Serialization: SerializationJSON,
+				LocalTier:     true,
+				LocalTTL:      time.Minute,
+				Channel:       "orders:invalidate",
+			},
+		},
+	}
+}
+
+// Load builds config from defaults, YAML file, environment variables and flags
+// Later sources override earlier ones: flags > environment > file > defaults.
+// Environment variable name is the flag name in upper case with dots replaced
+// by underscores, e.g. kafka.topic -> KAFKA_TOPIC.
+// Accepts:
+//   - args: command line arguments without program name
+//
+// Returns:
+//   - *Config
+//   - error if something wrong
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	cmdline := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := cmdline.String("config", os.Getenv("CONFIG_FILE"), "path to YAML config file")
+	registerFlags(cmdline, Default())
+	if err := cmdline.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := loadFile(*path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	target := flag.NewFlagSet("config", flag.ContinueOnError)
+	registerFlags(target, cfg)
+
+	var errs []error
+	target.VisitAll(func(f *flag.Flag) {
+		env := envName(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := target.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", v, env, err))
+			}
+		}
+	})
+
+	cmdline.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if err := target.Set(f.Name, f.Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for -%s: %w", f.Name, err))
+		}
+	})
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that config can be used
+// Returns:
+//   - error with all problems found
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.DB.Host == "" {
+		errs = append(errs, errors.New("db.host is required"))
+	}
+	if c.DB.Port == "" {
+		errs = append(errs, errors.New("db.port is required"))
+	}
+	if c.DB.User == "" {
+		errs = append(errs, errors.New("db.user is required"))
+	}
+	if c.DB.Name == "" {
+		errs = append(errs, errors.New("db.name is required"))
+	}
+	if c.Repository.MaxRetries < 1 {
+		errs = append(errs, errors.New("repository.max_retries must be positive"))
+	}
+	if c.Repository.RetryDelay <= 0 {
+		errs = append(errs, errors.New("repository.retry_delay must be positive"))
+	}
+	if c.Repository.MaxRetryDelay < c.Repository.RetryDelay {
+		errs = append(errs, errors.New("repository.max_retry_delay must not be less than repository.retry_delay"))
+	}
+	switch c.Repository.DuplicatePolicy {
+	case DuplicateReject, DuplicateIgnore, DuplicateOverwrite:
+	default:
+		errs = append(errs, errors.New("repository.duplicate_policy must be reject, ignore or overwrite"))
+	}
+	if len(c.Kafka.Brokers) == 0 {
+		errs = append(errs, errors.New("kafka.brokers is required"))
+	}
+	if c.Kafka.Topic == "" {
+		errs = append(errs, errors.New("kafka.topic is required"))
+	}
+	if c.Kafka.GroupID == "" {
+		errs = append(errs, errors.New("kafka.group_id is required"))
+	}
+	if c.Kafka.StartOffset != "first" && c.Kafka.StartOffset != "last" {
+		errs = append(errs, errors.New("kafka.start_offset must be first or last"))
+	}
+	if c.Kafka.DLQTopic == "" {
+		errs = append(errs, errors.New("kafka.dlq_topic is required"))
+	}
+	if c.Kafka.DLQTopic == c.Kafka.Topic {
+		errs = append(errs, errors.New("kafka.dlq_topic must differ from kafka.topic"))
+	}
+	switch c.Kafka.DeadLetter {
+	case DeadLetterTopic, DeadLetterTable, DeadLetterBoth:
+	default:
+		errs = append(errs, errors.New("kafka.dead_letter must be topic, table or both"))
+	}
+	if c.Kafka.MaxRetries < 1 {
+		errs = append(errs, errors.New("kafka.max_retries must be positive"))
+	}
+	if c.Kafka.RetryDelay < 0 {
+		errs = append(errs, errors.New("kafka.retry_delay must not be negative"))
+	}
+	if c.Kafka.MaxRetryDelay < c.Kafka.RetryDelay {
+		errs = append(errs, errors.New("kafka.max_retry_delay must not be less than kafka.retry_delay"))
+	}
+	for i, delay := range c.Kafka.RetryTiers {
+		if delay <= 0 {
+			errs = append(errs, errors.New("kafka.retry_tiers must be positive"))
+			break
+		}
+		if i > 0 && delay <= c.Kafka.RetryTiers[i-1] {
+			errs = append(errs, errors.New("kafka.retry_tiers must be ascending"))
+			break
+		}
+	}
+	if c.Kafka.Workers < 1 {
+		errs = append(errs, errors.New("kafka.workers must be positive"))
+	}
+	if c.Kafka.MaxInFlight < c.Kafka.Workers {
+		errs = append(errs, errors.New("kafka.max_in_flight must not be less than kafka.workers"))
+	}
+	if c.Kafka.BatchSize < 1 {
+		errs = append(errs, errors.New("kafka.batch_size must be positive"))
+	}
+	if c.Kafka.BatchTimeout <= 0 {
+		errs = append(errs, errors.New("kafka.batch_timeout must be positive"))
+	}
+	if c.Kafka.Workers > 1 && c.Kafka.BatchSize > 1 {
+		errs = append(errs, errors.New("kafka.workers and kafka.batch_size can not be used together"))
+	}
+	if c.HTTP.Addr == "" {
+		errs = append(errs, errors.New("http.addr is required"))
+	}
+	if c.HTTP.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("http.request_timeout must be positive"))
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("http.shutdown_timeout must be positive"))
+	}
+	if c.Cache.Backend != CacheMemory && c.Cache.Backend != CacheRedis {
+		errs = append(errs, errors.New("cache.backend must be memory or redis"))
+	}
+	if c.Cache.TTL <= 0 {
+		errs = append(errs, errors.New("cache.ttl must be positive"))
+	}
+	if c.Cache.WarmUpWindow < 0 {
+		errs = append(errs, errors.New("cache.warm_up_window must not be negative"))
+	}
+	if c.Cache.WarmUpPageSize <= 0 {
+		errs = append(errs, errors.New("cache.warm_up_page_size must be positive"))
+	}
+	if c.Cache.WarmUpWorkers <= 0 {
+		errs = append(errs, errors.New("cache.warm_up_workers must be positive"))
+	}
+	if c.Cache.WarmUpLimit < 0 {
+		errs = append(errs, errors.New("cache.warm_up_limit must not be negative"))
+	}
+	if c.Cache.WarmUpTimeout < 0 {
+		errs = append(errs, errors.New("cache.warm_up_timeout must not be negative"))
+	}
+	if c.Cache.MaxEntries < 0 {
+		errs = append(errs, errors.New("cache.max_entries must not be negative"))
+	}
+	if c.Cache.MaxBytes < 0 {
+		errs = append(errs, errors.New("cache.max_bytes must not be negative"))
+	}
+	if c.Cache.JanitorInterval <= 0 {
+		errs = append(errs, errors.New("cache.janitor_interval must be positive"))
+	}
+	if c.Cache.NegativeTTL < 0 {
+		errs = append(errs, errors.New("cache.negative_ttl must not be negative"))
+	}
+	if c.Cache.NegativeMaxEntries < 0 {
+		errs = append(errs, errors.New("cache.negative_max_entries must not be negative"))
+	}
+	if c.Cache.SnapshotMaxAge < 0 {
+		errs = append(errs, errors.New("cache.snapshot_max_age must not be negative"))
+	}
+	if c.Cache.Backend == CacheRedis {
+		errs = append(errs, c.Cache.Redis.validate()...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func (c RedisConfig) validate() []error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("cache.redis.addr is required"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("cache.redis.timeout must be positive"))
+	}
+	if c.Serialization != SerializationJSON && c.Serialization != SerializationGob {
+		errs = append(errs, errors.New("cache.redis.serialization must be json or gob"))
+	}
+	if c.LocalTier && c.LocalTTL <= 0 {
+		errs = append(errs, errors.New("cache.redis.local_ttl must be positive"))
+	}
+	if c.LocalTier && c.Channel == "" {
+		errs = append(errs, errors.New("cache.redis.channel is required for local tier"))
+	}
+	return errs
+}
+
+func loadFile(path string, cfg *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	if err = yaml.Unmarshal(content, cfg); err != nil {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func registerFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.DB.Host, "db.host", cfg.DB.Host, "database host")
+	fs.StringVar(&cfg.DB.Port, "db.port", cfg.DB.Port, "database port")
+	fs.StringVar(&cfg.DB.User, "db.user", cfg.DB.User, "database user")
+	fs.StringVar(&cfg.DB.Password, "db.password", cfg.DB.Password, "database password")
+	fs.StringVar(&cfg.DB.Name, "db.name", cfg.DB.Name, "database name")
+	fs.StringVar(&cfg.DB.SSLMode, "db.sslmode", cfg.DB.SSLMode, "database ssl mode")
+
+	fs.IntVar(&cfg.Repository.MaxRetries, "repository.max_retries", cfg.Repository.MaxRetries, "attempts of database operations")
+	fs.DurationVar(&cfg.Repository.RetryDelay, "repository.retry_delay", cfg.Repository.RetryDelay, "initial delay between database attempts, doubled after every attempt")
+	fs.DurationVar(&cfg.Repository.MaxRetryDelay, "repository.max_retry_delay", cfg.Repository.MaxRetryDelay, "max delay between database attempts")
+	fs.StringVar(&cfg.Repository.DuplicatePolicy, "repository.duplicate_policy", cfg.Repository.DuplicatePolicy, "what to do with new data of existing order: reject, ignore or overwrite")
+
+	fs.Var((*stringList)(&cfg.Kafka.Brokers), "kafka.brokers", "comma separated kafka brokers")
+	fs.StringVar(&cfg.Kafka.Topic, "kafka.topic", cfg.Kafka.Topic, "kafka topic with orders")
+	fs.StringVar(&cfg.Kafka.GroupID, "kafka.group_id", cfg.Kafka.GroupID, "kafka consumer group")
+	fs.StringVar(&cfg.Kafka.StartOffset, "kafka.start_offset", cfg.Kafka.StartOffset, "offset for new consumer group: first or last")
+	fs.StringVar(&cfg.Kafka.DLQTopic, "kafka.dlq_topic", cfg.Kafka.DLQTopic, "kafka dead letter topic")
+	fs.StringVar(&cfg.Kafka.DeadLetter, "kafka.dead_letter", cfg.Kafka.DeadLetter, "where failed messages are stored: topic, table or both")
+	fs.IntVar(&cfg.Kafka.MaxRetries, "kafka.max_retries", cfg.Kafka.MaxRetries, "attempts of message processing before DLQ")
+	fs.DurationVar(&cfg.Kafka.RetryDelay, "kafka.retry_delay", cfg.Kafka.RetryDelay, "initial delay between attempts, doubled after every attempt")
+	fs.DurationVar(&cfg.Kafka.MaxRetryDelay, "kafka.max_retry_delay", cfg.Kafka.MaxRetryDelay, "max delay between attempts of message processing")
+	fs.Var((*durationList)(&cfg.Kafka.RetryTiers), "kafka.retry_tiers", "comma separated delays of retry topics before DLQ, empty means failed messages go to DLQ at once")
+	fs.IntVar(&cfg.Kafka.Workers, "kafka.workers", cfg.Kafka.Workers, "number of workers processing messages, 1 means sequential processing")
+	fs.IntVar(&cfg.Kafka.MaxInFlight, "kafka.max_in_flight", cfg.Kafka.MaxInFlight, "max number of fetched but not committed messages")
+	fs.IntVar(&cfg.Kafka.BatchSize, "kafka.batch_size", cfg.Kafka.BatchSize, "max number of messages inserted in one transaction, 1 means no batching")
+	fs.DurationVar(&cfg.Kafka.BatchTimeout, "kafka.batch_timeout", cfg.Kafka.BatchTimeout, "max time of collecting a batch")
+
+	fs.StringVar(&cfg.HTTP.Addr, "http.addr", cfg.HTTP.Addr, "http listen address")
+	fs.DurationVar(&cfg.HTTP.RequestTimeout, "http.request_timeout", cfg.HTTP.RequestTimeout, "timeout of database requests in handlers")
+	fs.DurationVar(&cfg.HTTP.ShutdownTimeout, "http.shutdown_timeout", cfg.HTTP.ShutdownTimeout, "graceful shutdown timeout")
+	fs.StringVar(&cfg.HTTP.AdminToken, "http.admin_token", cfg.HTTP.AdminToken, "bearer token of admin endpoints, empty disables them")
+
+	fs.DurationVar(&cfg.Cache.TTL, "cache.ttl", cfg.Cache.TTL, "time to live of cache entries")
+	fs.DurationVar(&cfg.Cache.WarmUpWindow, "cache.warm_up_window", cfg.Cache.WarmUpWindow, "age of orders loaded into cache at start")
+	fs.IntVar(&cfg.Cache.WarmUpPageSize, "cache.warm_up_page_size", cfg.Cache.WarmUpPageSize, "number of order IDs read from database in one query during warm-up")
+	fs.IntVar(&cfg.Cache.WarmUpWorkers, "cache.warm_up_workers", cfg.Cache.WarmUpWorkers, "number of orders loaded in parallel during warm-up")
+	fs.IntVar(&cfg.Cache.WarmUpLimit, "cache.warm_up_limit", cfg.Cache.WarmUpLimit, "max number of orders loaded at start, newest first, 0 means no limit")
+	fs.DurationVar(&cfg.Cache.WarmUpTimeout, "cache.warm_up_timeout", cfg.Cache.WarmUpTimeout, "timeout of warm-up, 0 means no timeout")
+	fs.BoolVar(&cfg.Cache.WarmUpBackground, "cache.warm_up_background", cfg.Cache.WarmUpBackground, "warm up cache in background while already serving requests")
+	fs.IntVar(&cfg.Cache.MaxEntries, "cache.max_entries", cfg.Cache.MaxEntries, "max number of orders in cache, 0 means no limit")
+	fs.Int64Var(&cfg.Cache.MaxBytes, "cache.max_bytes", cfg.Cache.MaxBytes, "approximate max size of cached orders in bytes, 0 means no limit")
+	fs.DurationVar(&cfg.Cache.JanitorInterval, "cache.janitor_interval", cfg.Cache.JanitorInterval, "interval of removing expired cache entries")
+	fs.DurationVar(&cfg.Cache.NegativeTTL, "cache.negative_ttl", cfg.Cache.NegativeTTL, "time to remember unknown order IDs, 0 disables negative cache")
+	fs.StringVar(&cfg.Cache.SnapshotPath, "cache.snapshot_path", cfg.Cache.SnapshotPath, "file of in-memory cache snapshot, empty disables snapshots")
+	fs.DurationVar(&cfg.Cache.SnapshotMaxAge, "cache.snapshot_max_age", cfg.Cache.SnapshotMaxAge, "max age of snapshot loaded at start, 0 means no limit")
+	fs.StringVar(&cfg.Cache.Backend, "cache.backend", cfg.Cache.Backend, "cache backend: memory or redis")
+	fs.StringVar(&cfg.Cache.Redis.Addr, "cache.redis.addr", cfg.Cache.Redis.Addr, "redis address")
+	fs.StringVar(&cfg.Cache.Redis.Password, "cache.redis.password", cfg.Cache.Redis.Password, "redis password")
+	fs.IntVar(&cfg.Cache.Redis.DB, "cache.redis.db", cfg.Cache.Redis.DB, "redis database number")
+	fs.DurationVar(&cfg.Cache.Redis.Timeout, "cache.redis.timeout", cfg.Cache.Redis.Timeout, "timeout of redis operations")
+	fs.StringVar(&cfg.Cache.Redis.KeyPrefix, "cache.redis.key_prefix", cfg.Cache.Redis.KeyPrefix, "prefix of order keys in redis")
+	fs.StringVar(&cfg.Cache.Redis.Serialization, "cache.redis.serialization", cfg.Cache.Redis.Serialization, "format of orders in redis: json or gob")
+	fs.BoolVar(&cfg.Cache.Redis.LocalTier, "cache.redis.local_tier", cfg.Cache.Redis.LocalTier, "keep in-memory cache in front of redis")
+	fs.DurationVar(&cfg.Cache.Redis.LocalTTL, "cache.redis.local_ttl", cfg.Cache.Redis.LocalTTL, "time to live of entries in local tier")
+	fs.StringVar(&cfg.Cache.Redis.Channel, "cache.redis.channel", cfg.Cache.Redis.Channel, "redis pub/sub channel of cache invalidation")
+	fs.IntVar(&cfg.Cache.NegativeMaxEntries, "cache.negative_max_entries", cfg.Cache.NegativeMaxEntries, "max number of remembered unknown order IDs, 0 means no limit")
+}
+
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, ".", "_"))
+}
+
+// stringList is a flag value for comma separated lists
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	*s = list
+	return nil
+}
+
+// durationList is a flag value for comma separated durations
+type durationList []time.Duration
+
+func (d *durationList) String() string {
+	if d == nil {
+		return ""
+	}
+	list := make([]string, len(*d))
+	for i, v := range *d {
+		list[i] = v.String()
+	}
+	return strings.Join(list, ",")
+}
+
+func (d *durationList) Set(value string) error {
+	list := []time.Duration{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		list = append(list, duration)
+	}
+	*d = list
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	t.Setenv("DB_USER", "user")
+
+	cfg, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kafka:9092"}, cfg.Kafka.Brokers)
+	assert.Equal(t, "test1234", cfg.Kafka.Topic)
+	assert.Equal(t, ":8080", cfg.HTTP.Addr)
+	assert.Equal(t, 48*time.Hour, cfg.Cache.TTL)
+	assert.Equal(t, "user", cfg.DB.User)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+db:
+  user: file-user
+  host: file-host
+kafka:
+  topic: file-topic
+  brokers: [a:9092, b:9092]
+cache:
+  ttl: 1h
+`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	t.Setenv("KAFKA_TOPIC", "env-topic")
+	t.Setenv("DB_HOST", "env-host")
+
+	cfg, err := Load([]string{"-config", path, "-db.host", "flag-host"})
+	assert.NoError(t, err)
+	assert.Equal(t, "file-user", cfg.DB.User)
+	assert.Equal(t, "flag-host", cfg.DB.Host)
+	assert.Equal(t, "env-topic", cfg.Kafka.Topic)
+	assert.Equal(t, []string{"a:9092", "b:9092"}, cfg.Kafka.Brokers)
+	assert.Equal(t, time.Hour, cfg.Cache.TTL)
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	t.Setenv("DB_USER", "user")
+	t.Setenv("CACHE_TTL", "forever")
+
+	_, err := Load(nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CACHE_TTL")
+}
+
+func TestLoad_ValidationError(t *testing.T) {
+	t.Setenv("DB_USER", "user")
+
+	_, err := Load([]string{"-kafka.brokers", "", "-http.addr", ""})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "kafka.brokers is required")
+	assert.Contains(t, err.Error(), "http.addr is required")
+}
+
+func TestLoad_MissingFile(t *testing.T) {
+	_, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	assert.Error(t, err)
+}
+
+func TestLoad_RedisValidation(t *testing.T) {
+	t.Setenv("DB_USER", "user")
+
+	_, err := Load([]string{"-cache.backend", "redis", "-cache.redis.serialization", "xml"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cache.redis.serialization must be json or gob")
+
+	cfg, err := Load([]string{"-cache.backend", "redis", "-cache.redis.addr", "redis:6379"})
+	assert.NoError(t, err)
+	assert.Equal(t, "redis:6379", cfg.Cache.Redis.Addr)
+}
+
+func TestLoad_RetryTiers(t *testing.T) {
+	t.Setenv("DB_USER", "user")
+
+	// retry topics must be created before they are enabled
+	cfg, err := Load(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Kafka.RetryTiers)
+
+	t.Setenv("KAFKA_RETRY_TIERS", "5s, 30s")
+	cfg, err = Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Second, 30 * time.Second}, cfg.Kafka.RetryTiers)
+
+	cfg, err = Load([]string{"-kafka.retry_tiers", "10s,1m,10m"})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}, cfg.Kafka.RetryTiers)
+
+	cfg, err = Load([]string{"-kafka.retry_tiers", ""})
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Kafka.RetryTiers)
+
+	_, err = Load([]string{"-kafka.retry_tiers", "1m,10s"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "kafka.retry_tiers must be ascending")
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+// Codes of ErrorResponse
+const (
+	CodeInvalidArgument = "invalid_argument"
+	CodeUnauthenticated = "unauthenticated"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeTimeout         = "timeout"
+	CodeInternal        = "internal"
+)
+
+// WriteError writes error response with request ID
+// Accepts:
+//   - w: response writer
+//   - r: request
+//   - status: http status code
+//   - code: machine readable code of error
+//   - message: description of error
+//   - details: additional information, may be nil
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(models.ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: middleware.GetReqID(r.Context()),
+		Details:   details,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// writeLoadError writes response for error of loading data
+// Internal errors are only logged, so details of database are not exposed.
+func writeLoadError(w http.ResponseWriter, r *http.Request, err error, notFound string) {
+	log.Printf("Request %s: %v", middleware.GetReqID(r.Context()), err)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		WriteError(w, r, http.StatusNotFound, CodeNotFound, notFound, nil)
+	case errors.Is(err, context.DeadlineExceeded):
+		WriteError(w, r, http.StatusGatewayTimeout, CodeTimeout, "request timed out", nil)
+	default:
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error", nil)
+	}
+}
+
+// parseUUID checks that parameter is UUID, otherwise writes 400 response
+// UUID is accepted in any form which uuid.Parse knows, e.g. in upper case or in braces,
+// and is returned in canonical form, because orders are stored with it.
+func parseUUID(w http.ResponseWriter, r *http.Request, name, value string) (string, bool) {
+	parsed, err := uuid.Parse(value)
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, name+" must be UUID",
+			map[string]string{name: value})
+		return "", false
+	}
+	return parsed.String(), true
+}
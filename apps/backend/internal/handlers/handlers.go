@@ -3,22 +3,26 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/models"
 	"github.com/Kost0/L0/internal/repository"
 	"github.com/go-chi/chi/v5"
 )
 
 // Handler contains tools for working with data
 type Handler struct {
-	Repo  repository.OrderRepository
-	Cache cache.Cache
+	Repo    repository.OrderRepository
+	Cache   cache.Cache
+	Timeout time.Duration
 }
 
 // GetOrderByID godoc
@@ -27,8 +31,10 @@ type Handler struct {
 // @Produce json
 // @Param orderID path string true "Order ID"
 // @Success 200 {object} models.CombinedData "OK"
-// @Failure 404 {string} string "There is no such order"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} models.ErrorResponse "Order ID is not UUID"
+// @Failure 404 {object} models.ErrorResponse "There is no such order"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
 // @Router /orders/{orderID} [get]
 func (h *Handler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5000")
@@ -40,43 +46,222 @@ func (h *Handler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orderID := chi.URLParam(r, "orderID")
+	// malformed id would be rejected by database anyway
+	orderID, ok := parseUUID(w, r, "orderID", chi.URLParam(r, "orderID"))
+	if !ok {
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	// concurrent requests of missing order make only one query to database
+	h.writeOrder(w, r, func(ctx context.Context) (*models.CombinedData, error) {
+		return h.Cache.GetOrLoad(ctx, orderID, h.Repo.SelectWithRetry)
+	})
+}
+
+// GetOrderByTrackNumber godoc
+// @Summary Receive an order by track number
+// @Description Gets information about an order by its track number
+// @Produce json
+// @Param trackNumber path string true "Track number"
+// @Success 200 {object} models.CombinedData "OK"
+// @Failure 404 {object} models.ErrorResponse "There is no such order"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /tracks/{trackNumber} [get]
+func (h *Handler) GetOrderByTrackNumber(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5000")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	trackNumber := chi.URLParam(r, "trackNumber")
+
+	if trackNumber == "" {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "trackNumber is required", nil)
+		return
+	}
+
+	h.writeOrder(w, r, func(ctx context.Context) (*models.CombinedData, error) {
+		return h.Cache.GetOrLoadByTrack(ctx, trackNumber, h.Repo.SelectByTrackWithRetry)
+	})
+}
+
+// writeOrder writes order received by get, or 404 if there is no such order
+func (h *Handler) writeOrder(w http.ResponseWriter, r *http.Request, get func(ctx context.Context) (*models.CombinedData, error)) {
 	start := time.Now()
 
-	data, ok := h.Cache.Get(orderID)
-	if ok {
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("The data was retrieved from the cache in %d milliseconds", time.Since(start))
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	data, err := get(ctx)
+	log.Printf("The data was retrieved in %d milliseconds", time.Since(start).Milliseconds())
+	if err != nil {
+		writeLoadError(w, r, err, "order not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(data); err != nil {
+		log.Println(err)
+	}
+}
+
+// GetOrderHistory godoc
+// @Summary Receive history of an order
+// @Description Gets all versions of an order with time and kafka offset they came from
+// @Produce json
+// @Param orderID path string true "Order ID"
+// @Success 200 {array} models.OrderVersion "OK"
+// @Failure 400 {object} models.ErrorResponse "Order ID is not UUID"
+// @Failure 404 {object} models.ErrorResponse "There is no such order"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /orders/{orderID}/history [get]
+func (h *Handler) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5000")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	orderID, ok := parseUUID(w, r, "orderID", chi.URLParam(r, "orderID"))
+	if !ok {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*4)
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
 	defer cancel()
 
-	data, err := h.Repo.SelectWithRetry(ctx, orderID)
-	log.Printf("Selected order %+v", data)
-	log.Printf("The data was retrieved from the database in %d milliseconds", time.Since(start))
+	versions, err := h.Repo.SelectHistory(ctx, orderID)
 	if err != nil {
+		writeLoadError(w, r, err, "order not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(versions); err != nil {
 		log.Println(err)
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	}
+}
+
+// ListOrders godoc
+// @Summary Search orders
+// @Description Gets page of orders matching filters. Next page is requested with cursor from previous page
+// @Produce json
+// @Param customer_id query string false "Customer ID"
+// @Param track_number query string false "Track number"
+// @Param delivery_service query string false "Delivery service"
+// @Param date_from query string false "Orders created at or after this time, RFC3339"
+// @Param date_to query string false "Orders created before this time, RFC3339"
+// @Param brand query string false "Brand of any item of order"
+// @Param nm_id query int false "nmID of any item of order"
+// @Param email query string false "Email of delivery"
+// @Param phone query string false "Phone of delivery"
+// @Param sort query string false "Sort field: date_created or track_number, prefixed with - for descending order" default(-date_created)
+// @Param limit query int false "Page size, max 100" default(20)
+// @Param cursor query string false "Cursor of page"
+// @Success 200 {object} models.OrderPage "OK"
+// @Failure 400 {object} models.ErrorResponse "Invalid filter"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /orders [get]
+func (h *Handler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5000")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	h.Cache.Set(orderID, data)
-	log.Printf("Order %s cached", orderID)
+	filter, invalid := parseOrderFilter(r.URL.Query())
+	if invalid != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, invalid.Error(),
+			map[string]string{invalid.name: invalid.reason})
+		return
+	}
 
-	if err = json.NewEncoder(w).Encode(data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	page, err := h.Repo.ListOrders(ctx, filter)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidFilter) {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, err.Error(), nil)
+			return
+		}
+		writeLoadError(w, r, err, "no orders found")
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(page); err != nil {
+		log.Println(err)
+	}
+}
+
+// invalidParamError describes invalid query parameter
+type invalidParamError struct {
+	name   string
+	reason string
+}
+
+func (e *invalidParamError) Error() string {
+	return "invalid " + e.name + ": " + e.reason
+}
+
+// parseOrderFilter reads filter of ListOrders from query parameters
+func parseOrderFilter(q url.Values) (models.OrderFilter, *invalidParamError) {
+	filter := models.OrderFilter{
+		CustomerID:      q.Get("customer_id"),
+		TrackNumber:     q.Get("track_number"),
+		DeliveryService: q.Get("delivery_service"),
+		Brand:           q.Get("brand"),
+		Email:           q.Get("email"),
+		Phone:           q.Get("phone"),
+		Sort:            q.Get("sort"),
+		Cursor:          q.Get("cursor"),
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"date_from", &filter.CreatedFrom},
+		{"date_to", &filter.CreatedTo},
+	} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, &invalidParamError{name: p.name, reason: "must be RFC3339 time"}
+			}
+			*p.dst = &t
+		}
+	}
+
+	if v := q.Get("nm_id"); v != "" {
+		nmID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, &invalidParamError{name: "nm_id", reason: "must be integer"}
+		}
+		filter.NmID = &nmID
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > repository.MaxListLimit {
+			return filter, &invalidParamError{name: "limit", reason: fmt.Sprintf("must be from 1 to %d", repository.MaxListLimit)}
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
 }
@@ -7,11 +7,17 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
 	"github.com/Kost0/L0/internal/repository"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -29,6 +35,31 @@ func (m *MockOrderCache) Set(orderID string, data *models.CombinedData) {
 	m.Called(orderID, data)
 }
 
+func (m *MockOrderCache) Invalidate(orderID string) {
+	m.Called(orderID)
+}
+
+// GetOrLoad behaves like real cache on top of mocked Get and Set
+func (m *MockOrderCache) GetOrLoad(ctx context.Context, orderID string, load cache.LoaderFunc) (*models.CombinedData, error) {
+	if data, ok := m.Get(orderID); ok {
+		return data, nil
+	}
+
+	data, err := load(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	m.Set(orderID, data)
+	return data, nil
+}
+
+// GetOrLoadByTrack keeps orders by track number in mocked Get and Set
+func (m *MockOrderCache) GetOrLoadByTrack(ctx context.Context, trackNumber string, load cache.LoaderFunc) (*models.CombinedData, error) {
+	return m.GetOrLoad(ctx, "track:"+trackNumber, func(ctx context.Context, _ string) (*models.CombinedData, error) {
+		return load(ctx, trackNumber)
+	})
+}
+
 func (m *MockOrderCache) WarmUpCache(db *sql.DB, repo repository.OrderRepository, ctx context.Context) error {
 	args := m.Called(ctx, db, repo, ctx)
 	return args.Error(0)
@@ -43,19 +74,60 @@ func (m *MockSQLOrderRepository) SelectWithRetry(ctx context.Context, orderID st
 	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func (m *MockSQLOrderRepository) SelectOrder(orderID string) (*models.CombinedData, error) {
-	args := m.Called(orderID)
+func (m *MockSQLOrderRepository) SelectOrder(ctx context.Context, orderID string) (*models.CombinedData, error) {
+	args := m.Called(ctx, orderID)
 	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func (m *MockSQLOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) error {
+func (m *MockSQLOrderRepository) ListOrders(ctx context.Context, filter models.OrderFilter) (*models.OrderPage, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(*models.OrderPage), args.Error(1)
+}
+
+func (m *MockSQLOrderRepository) SelectByTrackNumber(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(ctx, trackNumber)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
+}
+
+func (m *MockSQLOrderRepository) SelectByTrackWithRetry(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(ctx, trackNumber)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
+}
+
+func (m *MockSQLOrderRepository) SelectHistory(ctx context.Context, orderID string) ([]models.OrderVersion, error) {
+	args := m.Called(ctx, orderID)
+	return args.Get(0).([]models.OrderVersion), args.Error(1)
+}
+
+func (m *MockSQLOrderRepository) InsertOrders(ctx context.Context, orders []*models.CombinedData) ([]bool, error) {
+	args := m.Called(ctx, orders)
+	applied, _ := args.Get(0).([]bool)
+	return applied, args.Error(1)
+}
+
+func (m *MockSQLOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) (bool, error) {
 	args := m.Called(ctx, order)
-	return args.Error(0)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockSQLOrderRepository) InsertOrder(order *models.CombinedData) error {
-	args := m.Called(order)
-	return args.Error(0)
+func (m *MockSQLOrderRepository) InsertOrder(ctx context.Context, order *models.CombinedData) (bool, error) {
+	args := m.Called(ctx, order)
+	return args.Bool(0), args.Error(1)
+}
+
+// IDs of orders in tests, handlers accept only UUID
+const (
+	testOrderID    = "b563feb7-b2b8-4b6c-9f2d-7d2a9c8e1a01"
+	unknownOrderID = "00000000-0000-0000-0000-000000000000"
+)
+
+// decodeError reads error envelope from response
+func decodeError(t *testing.T, rr *httptest.ResponseRecorder) models.ErrorResponse {
+	t.Helper()
+	assert.Contains(t, rr.Header().Get("Content-Type"), "application/json")
+	resp := models.ErrorResponse{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	return resp
 }
 
 func setupRouter(handler *Handler, orderID string) *httptest.ResponseRecorder {
@@ -74,7 +146,7 @@ func TestHandler_GetOrderByID_CacheHit(t *testing.T) {
 	mockRepo := new(MockSQLOrderRepository)
 	handler := &Handler{Repo: mockRepo, Cache: mockCache}
 
-	orderID := "order-1"
+	orderID := testOrderID
 	expectedData := &models.CombinedData{Order: models.Order{OrderUID: orderID}}
 
 	mockCache.On("Get", orderID).Return(expectedData, true)
@@ -95,7 +167,7 @@ func TestHandler_GetOrderByID_CacheMiss_DBSuccess(t *testing.T) {
 	mockRepoMock := new(MockSQLOrderRepository)
 	handler := &Handler{Repo: mockRepoMock, Cache: mockCache}
 
-	orderID := "order-1"
+	orderID := testOrderID
 	expectedData := &models.CombinedData{Order: models.Order{OrderUID: orderID}}
 
 	mockCache.On("Get", orderID).Return(&models.CombinedData{}, false)
@@ -123,7 +195,7 @@ func TestHandler_GetOrderByID_CacheMiss_DBNotFoud(t *testing.T) {
 	mockRepo := new(MockSQLOrderRepository)
 	handler := &Handler{Repo: mockRepo, Cache: mockCache}
 
-	orderID := "order-unknown"
+	orderID := unknownOrderID
 
 	mockCache.On("Get", orderID).Return(&models.CombinedData{}, false)
 	mockRepo.On("SelectWithRetry", mock.Anything, orderID).Return(&models.CombinedData{}, sql.ErrNoRows)
@@ -131,7 +203,7 @@ func TestHandler_GetOrderByID_CacheMiss_DBNotFoud(t *testing.T) {
 	rr := setupRouter(handler, orderID)
 
 	assert.Equal(t, http.StatusNotFound, rr.Code)
-	assert.Empty(t, rr.Body.String())
+	assert.Equal(t, CodeNotFound, decodeError(t, rr).Code)
 
 	mockCache.AssertExpectations(t)
 	mockRepo.AssertExpectations(t)
@@ -142,7 +214,7 @@ func TestHandler_GetOrderByID_CacheMiss_DBError(t *testing.T) {
 	mockRepo := new(MockSQLOrderRepository)
 	handler := &Handler{Repo: mockRepo, Cache: mockCache}
 
-	orderID := "order-1"
+	orderID := testOrderID
 
 	mockCache.On("Get", orderID).Return(&models.CombinedData{}, false)
 	mockRepo.On("SelectWithRetry", mock.Anything, orderID).Return(&models.CombinedData{}, errors.New("db error"))
@@ -150,8 +222,253 @@ func TestHandler_GetOrderByID_CacheMiss_DBError(t *testing.T) {
 	rr := setupRouter(handler, orderID)
 
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
-	assert.Empty(t, rr.Body.String())
+	assert.Equal(t, CodeInternal, decodeError(t, rr).Code)
 
 	mockCache.AssertExpectations(t)
 	mockRepo.AssertExpectations(t)
 }
+
+func TestHandler_GetOrderHistory_Success(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: new(MockOrderCache), Timeout: time.Second}
+
+	orderID := testOrderID
+	offset := int64(7)
+	versions := []models.OrderVersion{
+		{Version: 1, Data: models.CombinedData{Order: models.Order{OrderUID: orderID}}},
+		{Version: 2, Offset: &offset, Data: models.CombinedData{Order: models.Order{OrderUID: orderID}}},
+	}
+	mockRepo.On("SelectHistory", mock.Anything, orderID).Return(versions, nil)
+
+	r := chi.NewRouter()
+	r.Get("/orders/{orderID}/history", handler.GetOrderHistory)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/orders/"+orderID+"/history", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response []models.OrderVersion
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Len(t, response, 2)
+	assert.Equal(t, offset, *response[1].Offset)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderHistory_NotFound(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: new(MockOrderCache), Timeout: time.Second}
+
+	mockRepo.On("SelectHistory", mock.Anything, unknownOrderID).Return([]models.OrderVersion(nil), sql.ErrNoRows)
+
+	r := chi.NewRouter()
+	r.Get("/orders/{orderID}/history", handler.GetOrderHistory)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/orders/"+unknownOrderID+"/history", nil))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderByID_ConcurrentMissesLoadOnce(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+	handler := &Handler{Repo: mockRepo, Cache: orderCache, Timeout: time.Second}
+
+	orderID := testOrderID
+	expectedData := &models.CombinedData{Order: models.Order{OrderUID: orderID}}
+
+	mockRepo.On("SelectWithRetry", mock.Anything, orderID).
+		After(50*time.Millisecond).
+		Return(expectedData, nil).
+		Once()
+
+	const requests = 20
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			codes <- setupRouter(handler, orderID).Code
+		}()
+	}
+
+	for i := 0; i < requests; i++ {
+		assert.Equal(t, http.StatusOK, <-codes)
+	}
+	mockRepo.AssertNumberOfCalls(t, "SelectWithRetry", 1)
+}
+
+func TestHandler_ListOrders_Success(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: new(MockOrderCache), Timeout: time.Second}
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	nmID := 2389212
+	expected := models.OrderFilter{
+		CustomerID:  "test",
+		CreatedFrom: &from,
+		NmID:        &nmID,
+		Sort:        "track_number",
+		Limit:       10,
+		Cursor:      "abc",
+	}
+	page := &models.OrderPage{
+		Orders:     []*models.CombinedData{{Order: models.Order{OrderUID: "order-1"}}},
+		NextCursor: "next",
+	}
+	mockRepo.On("ListOrders", mock.Anything, expected).Return(page, nil)
+
+	rr := httptest.NewRecorder()
+	handler.ListOrders(rr, httptest.NewRequest(http.MethodGet,
+		"/orders?customer_id=test&date_from=2026-01-01T00:00:00Z&nm_id=2389212&sort=track_number&limit=10&cursor=abc", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response models.OrderPage
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	assert.Len(t, response.Orders, 1)
+	assert.Equal(t, "next", response.NextCursor)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_ListOrders_InvalidQuery(t *testing.T) {
+	handler := &Handler{Repo: new(MockSQLOrderRepository), Cache: new(MockOrderCache), Timeout: time.Second}
+
+	for _, query := range []string{"date_from=yesterday", "date_to=1", "nm_id=abc", "limit=0", "limit=1000"} {
+		rr := httptest.NewRecorder()
+		handler.ListOrders(rr, httptest.NewRequest(http.MethodGet, "/orders?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Len(t, decodeError(t, rr).Details, 1, query)
+	}
+}
+
+func TestHandler_ListOrders_InvalidFilter(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: new(MockOrderCache), Timeout: time.Second}
+
+	mockRepo.On("ListOrders", mock.Anything, models.OrderFilter{Sort: "price"}).
+		Return((*models.OrderPage)(nil), repository.ErrInvalidFilter)
+
+	rr := httptest.NewRecorder()
+	handler.ListOrders(rr, httptest.NewRequest(http.MethodGet, "/orders?sort=price", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderByTrackNumber_Success(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+	handler := &Handler{Repo: mockRepo, Cache: orderCache, Timeout: time.Second}
+
+	track := "WBILMTESTTRACK"
+	expected := &models.CombinedData{Order: models.Order{OrderUID: "order-1", TrackNumber: &track}}
+	mockRepo.On("SelectByTrackWithRetry", mock.Anything, track).Return(expected, nil).Once()
+
+	r := chi.NewRouter()
+	r.Get("/tracks/{trackNumber}", handler.GetOrderByTrackNumber)
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tracks/"+track, nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response models.CombinedData
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, "order-1", response.Order.OrderUID)
+	}
+
+	// second request is served from cache
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderByTrackNumber_NotFound(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: cache.NewOrderCache(config.Default().Cache), Timeout: time.Second}
+
+	mockRepo.On("SelectByTrackWithRetry", mock.Anything, "unknown").Return((*models.CombinedData)(nil), sql.ErrNoRows)
+
+	r := chi.NewRouter()
+	r.Get("/tracks/{trackNumber}", handler.GetOrderByTrackNumber)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tracks/unknown", nil))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, CodeNotFound, decodeError(t, rr).Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderByID_InvalidUUID(t *testing.T) {
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: new(MockOrderCache), Timeout: time.Second}
+
+	r := chi.NewRouter()
+	r.With(middleware.RequestID).Get("/orders/{orderID}", handler.GetOrderByID)
+	r.With(middleware.RequestID).Get("/orders/{orderID}/history", handler.GetOrderHistory)
+
+	for _, path := range []string{"/orders/order-1", "/orders/order-1/history"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		resp := decodeError(t, rr)
+		assert.Equal(t, CodeInvalidArgument, resp.Code)
+		assert.Equal(t, "order-1", resp.Details["orderID"])
+		assert.NotEmpty(t, resp.RequestID)
+	}
+
+	// database is not queried
+	mockRepo.AssertExpectations(t)
+}
+
+func TestHandler_GetOrderByID_CanonicalUUID(t *testing.T) {
+	tests := []struct {
+		name    string
+		orderID string
+	}{
+		{name: "canonical", orderID: testOrderID},
+		{name: "upper case", orderID: strings.ToUpper(testOrderID)},
+		{name: "urn", orderID: "urn:uuid:" + testOrderID},
+		{name: "braces", orderID: "{" + testOrderID + "}"},
+		{name: "without hyphens", orderID: strings.ReplaceAll(testOrderID, "-", "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCache := new(MockOrderCache)
+			mockRepo := new(MockSQLOrderRepository)
+			handler := &Handler{Repo: mockRepo, Cache: mockCache, Timeout: time.Second}
+
+			// cache and database are queried by canonical id only
+			mockCache.On("Get", testOrderID).Return(&models.CombinedData{}, true)
+			mockRepo.On("SelectHistory", mock.Anything, testOrderID).Return([]models.OrderVersion{}, nil)
+
+			r := chi.NewRouter()
+			r.Get("/orders/{orderID}", handler.GetOrderByID)
+			r.Get("/orders/{orderID}/history", handler.GetOrderHistory)
+
+			for _, path := range []string{"/orders/" + url.PathEscape(tt.orderID), "/orders/" + url.PathEscape(tt.orderID) + "/history"} {
+				rr := httptest.NewRecorder()
+				r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+				assert.Equal(t, http.StatusOK, rr.Code, path)
+			}
+
+			mockCache.AssertExpectations(t)
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestHandler_GetOrderByID_Timeout(t *testing.T) {
+	mockCache := new(MockOrderCache)
+	mockRepo := new(MockSQLOrderRepository)
+	handler := &Handler{Repo: mockRepo, Cache: mockCache, Timeout: time.Second}
+
+	mockCache.On("Get", testOrderID).Return(&models.CombinedData{}, false)
+	mockRepo.On("SelectWithRetry", mock.Anything, testOrderID).Return((*models.CombinedData)(nil), context.DeadlineExceeded)
+
+	rr := setupRouter(handler, testOrderID)
+
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Equal(t, CodeTimeout, decodeError(t, rr).Code)
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/repository"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/go-chi/chi/v5"
+)
+
+// maxPayloadSize limits size of edited payload of quarantined message
+const maxPayloadSize = 1 << 20
+
+// Resubmitter publishes quarantined message to its original topic
+type Resubmitter interface {
+	// Resubmit returns permanent error if payload of message is still invalid
+	Resubmit(ctx context.Context, msg *models.QuarantinedMessage) error
+}
+
+// AdminHandler contains tools for support of failed messages
+type AdminHandler struct {
+	Quarantine  repository.QuarantineRepository
+	Resubmitter Resubmitter
+	Timeout     time.Duration
+}
+
+// ListQuarantined godoc
+// @Summary List quarantined messages
+// @Description Gets page of failed messages, newest first
+// @Produce json
+// @Security AdminToken
+// @Param status query string false "Status: quarantined, resubmitted, discarded or all" default(quarantined)
+// @Param before query int false "ID of the last message of previous page"
+// @Param limit query int false "Page size, max 100" default(50)
+// @Success 200 {object} models.QuarantinePage "OK"
+// @Failure 400 {object} models.ErrorResponse "Invalid parameter"
+// @Failure 401 {object} models.ErrorResponse "Invalid admin token"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /admin/quarantine [get]
+func (h *AdminHandler) ListQuarantined(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := models.QuarantineFilter{Status: q.Get("status")}
+
+	switch filter.Status {
+	case "":
+		filter.Status = models.QuarantineStatusQuarantined
+	case "all":
+		filter.Status = ""
+	case models.QuarantineStatusQuarantined, models.QuarantineStatusResubmitted, models.QuarantineStatusDiscarded:
+	default:
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid status",
+			map[string]string{"status": "must be quarantined, resubmitted, discarded or all"})
+		return
+	}
+
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid before",
+				map[string]string{"before": "must be positive integer"})
+			return
+		}
+		filter.BeforeID = before
+	}
+
+	filter.Limit = repository.DefaultQuarantineLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > repository.MaxQuarantineLimit {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid limit",
+				map[string]string{"limit": fmt.Sprintf("must be from 1 to %d", repository.MaxQuarantineLimit)})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	msgs, err := h.Quarantine.ListQuarantined(ctx, filter)
+	if err != nil {
+		writeLoadError(w, r, err, "no messages found")
+		return
+	}
+
+	page := models.QuarantinePage{Messages: msgs}
+	if len(msgs) == filter.Limit {
+		page.NextBefore = msgs[len(msgs)-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// GetQuarantined godoc
+// @Summary Inspect quarantined message
+// @Description Gets failed message with its payload, headers and errors
+// @Produce json
+// @Security AdminToken
+// @Param id path int true "Message ID"
+// @Success 200 {object} models.QuarantinedMessage "OK"
+// @Failure 400 {object} models.ErrorResponse "Invalid message ID"
+// @Failure 401 {object} models.ErrorResponse "Invalid admin token"
+// @Failure 404 {object} models.ErrorResponse "There is no such message"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /admin/quarantine/{id} [get]
+func (h *AdminHandler) GetQuarantined(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	msg, err := h.Quarantine.GetQuarantined(ctx, id)
+	if err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// UpdateQuarantinedPayload godoc
+// @Summary Edit payload of quarantined message
+// @Description Replaces payload of message which is not resubmitted or discarded yet. Body is new payload, it must be JSON
+// @Accept json
+// @Produce json
+// @Security AdminToken
+// @Param id path int true "Message ID"
+// @Param payload body object true "New payload"
+// @Success 200 {object} models.QuarantinedMessage "OK"
+// @Failure 400 {object} models.ErrorResponse "Invalid message ID or payload"
+// @Failure 401 {object} models.ErrorResponse "Invalid admin token"
+// @Failure 404 {object} models.ErrorResponse "There is no such message"
+// @Failure 409 {object} models.ErrorResponse "Message is already resubmitted or discarded"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /admin/quarantine/{id}/payload [put]
+func (h *AdminHandler) UpdateQuarantinedPayload(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "payload can not be read", nil)
+		return
+	}
+	if !json.Valid(payload) {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "payload must be JSON", nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	if err = h.Quarantine.UpdateQuarantinedPayload(ctx, id, payload); err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+
+	msg, err := h.Quarantine.GetQuarantined(ctx, id)
+	if err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// ResubmitQuarantined godoc
+// @Summary Resubmit quarantined message
+// @Description Validates payload and publishes message to its original topic. Order is saved by consumer
+// @Produce json
+// @Security AdminToken
+// @Param id path int true "Message ID"
+// @Success 200 {object} models.QuarantinedMessage "OK"
+// @Failure 400 {object} models.ErrorResponse "Invalid message ID"
+// @Failure 401 {object} models.ErrorResponse "Invalid admin token"
+// @Failure 404 {object} models.ErrorResponse "There is no such message"
+// @Failure 409 {object} models.ErrorResponse "Message is already resubmitted or discarded"
+// @Failure 422 {object} models.ErrorResponse "Payload is still invalid"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /admin/quarantine/{id}/resubmit [post]
+func (h *AdminHandler) ResubmitQuarantined(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	msg, err := h.Quarantine.GetQuarantined(ctx, id)
+	if err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	if msg.Status != models.QuarantineStatusQuarantined {
+		writeQuarantineError(w, r, repository.ErrQuarantineResolved)
+		return
+	}
+
+	// message published twice by concurrent requests is saved once, because saving of order is idempotent
+	if err = h.Resubmitter.Resubmit(ctx, msg); err != nil {
+		if retry.IsPermanent(err) {
+			writeInvalidOrder(w, r, err)
+			return
+		}
+		writeLoadError(w, r, err, "message not found")
+		return
+	}
+
+	if err = h.Quarantine.ResolveQuarantined(ctx, id, models.QuarantineStatusResubmitted); err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	msg.Status = models.QuarantineStatusResubmitted
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// DiscardQuarantined godoc
+// @Summary Discard quarantined message
+// @Description Marks message as discarded, it is kept for audit
+// @Security AdminToken
+// @Param id path int true "Message ID"
+// @Success 204 "Discarded"
+// @Failure 400 {object} models.ErrorResponse "Invalid message ID"
+// @Failure 401 {object} models.ErrorResponse "Invalid admin token"
+// @Failure 404 {object} models.ErrorResponse "There is no such message"
+// @Failure 409 {object} models.ErrorResponse "Message is already resubmitted or discarded"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Failure 504 {object} models.ErrorResponse "Request timed out"
+// @Router /admin/quarantine/{id}/discard [post]
+func (h *AdminHandler) DiscardQuarantined(w http.ResponseWriter, r *http.Request) {
+	id, ok := quarantineID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.Timeout)
+	defer cancel()
+
+	if err := h.Quarantine.ResolveQuarantined(ctx, id, models.QuarantineStatusDiscarded); err != nil {
+		writeQuarantineError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// quarantineID reads ID of quarantined message from path, otherwise writes 400 response
+func quarantineID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	value := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id <= 0 {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "id must be positive integer",
+			map[string]string{"id": value})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeQuarantineError writes response for error of quarantine repository
+func writeQuarantineError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, repository.ErrQuarantineResolved) {
+		WriteError(w, r, http.StatusConflict, CodeConflict, "message is already resubmitted or discarded", nil)
+		return
+	}
+	writeLoadError(w, r, err, "message not found")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/repository"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockQuarantineRepository struct {
+	mock.Mock
+}
+
+func (m *MockQuarantineRepository) Quarantine(ctx context.Context, msg *models.QuarantinedMessage) error {
+	return m.Called(ctx, msg).Error(0)
+}
+
+func (m *MockQuarantineRepository) ListQuarantined(ctx context.Context, filter models.QuarantineFilter) ([]models.QuarantinedMessage, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]models.QuarantinedMessage), args.Error(1)
+}
+
+func (m *MockQuarantineRepository) GetQuarantined(ctx context.Context, id int64) (*models.QuarantinedMessage, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*models.QuarantinedMessage), args.Error(1)
+}
+
+func (m *MockQuarantineRepository) UpdateQuarantinedPayload(ctx context.Context, id int64, payload []byte) error {
+	return m.Called(ctx, id, payload).Error(0)
+}
+
+func (m *MockQuarantineRepository) ResolveQuarantined(ctx context.Context, id int64, status string) error {
+	return m.Called(ctx, id, status).Error(0)
+}
+
+type MockResubmitter struct {
+	mock.Mock
+}
+
+func (m *MockResubmitter) Resubmit(ctx context.Context, msg *models.QuarantinedMessage) error {
+	return m.Called(ctx, msg).Error(0)
+}
+
+func serveAdmin(h *AdminHandler, method, target, body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Get("/admin/quarantine", h.ListQuarantined)
+	r.Get("/admin/quarantine/{id}", h.GetQuarantined)
+	r.Put("/admin/quarantine/{id}/payload", h.UpdateQuarantinedPayload)
+	r.Post("/admin/quarantine/{id}/resubmit", h.ResubmitQuarantined)
+	r.Post("/admin/quarantine/{id}/discard", h.DiscardQuarantined)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr
+}
+
+func quarantined(id int64) *models.QuarantinedMessage {
+	return &models.QuarantinedMessage{
+		ID:            id,
+		Topic:         "orders",
+		OriginalTopic: "orders",
+		Payload:       `{"orderUID": ""}`,
+		Error:         "validation failed",
+		Status:        models.QuarantineStatusQuarantined,
+	}
+}
+
+func TestAdminHandler_ListQuarantined(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	h := &AdminHandler{Quarantine: repo, Timeout: time.Second}
+
+	repo.On("ListQuarantined", mock.Anything, models.QuarantineFilter{Status: models.QuarantineStatusQuarantined, BeforeID: 10, Limit: 2}).
+		Return([]models.QuarantinedMessage{*quarantined(9), *quarantined(8)}, nil)
+
+	rr := serveAdmin(h, http.MethodGet, "/admin/quarantine?before=10&limit=2", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	page := models.QuarantinePage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	assert.Len(t, page.Messages, 2)
+	assert.Equal(t, int64(8), page.NextBefore)
+
+	repo.On("ListQuarantined", mock.Anything, models.QuarantineFilter{Limit: repository.DefaultQuarantineLimit}).
+		Return([]models.QuarantinedMessage{}, nil)
+	rr = serveAdmin(h, http.MethodGet, "/admin/quarantine?status=all", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	for _, query := range []string{"status=broken", "before=x", "limit=1000"} {
+		rr = serveAdmin(h, http.MethodGet, "/admin/quarantine?"+query, "")
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		assert.Equal(t, CodeInvalidArgument, decodeError(t, rr).Code, query)
+	}
+	repo.AssertExpectations(t)
+}
+
+func TestAdminHandler_GetQuarantined(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	h := &AdminHandler{Quarantine: repo, Timeout: time.Second}
+
+	repo.On("GetQuarantined", mock.Anything, int64(7)).Return(quarantined(7), nil)
+	repo.On("GetQuarantined", mock.Anything, int64(8)).Return((*models.QuarantinedMessage)(nil), sql.ErrNoRows)
+
+	rr := serveAdmin(h, http.MethodGet, "/admin/quarantine/7", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	msg := models.QuarantinedMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, int64(7), msg.ID)
+
+	rr = serveAdmin(h, http.MethodGet, "/admin/quarantine/8", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = serveAdmin(h, http.MethodGet, "/admin/quarantine/abc", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAdminHandler_UpdateQuarantinedPayload(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	h := &AdminHandler{Quarantine: repo, Timeout: time.Second}
+
+	fixed := `{"orderUID": "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a5b"}`
+	updated := quarantined(7)
+	updated.Payload = fixed
+	repo.On("UpdateQuarantinedPayload", mock.Anything, int64(7), []byte(fixed)).Return(nil)
+	repo.On("GetQuarantined", mock.Anything, int64(7)).Return(updated, nil)
+	repo.On("UpdateQuarantinedPayload", mock.Anything, int64(8), mock.Anything).Return(repository.ErrQuarantineResolved)
+
+	rr := serveAdmin(h, http.MethodPut, "/admin/quarantine/7/payload", fixed)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	msg := models.QuarantinedMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, fixed, msg.Payload)
+
+	rr = serveAdmin(h, http.MethodPut, "/admin/quarantine/7/payload", `{broken`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = serveAdmin(h, http.MethodPut, "/admin/quarantine/8/payload", fixed)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, CodeConflict, decodeError(t, rr).Code)
+	repo.AssertExpectations(t)
+}
+
+func TestAdminHandler_ResubmitQuarantined(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	resubmitter := new(MockResubmitter)
+	h := &AdminHandler{Quarantine: repo, Resubmitter: resubmitter, Timeout: time.Second}
+
+	repo.On("GetQuarantined", mock.Anything, int64(7)).Return(quarantined(7), nil)
+	resubmitter.On("Resubmit", mock.Anything, mock.MatchedBy(func(msg *models.QuarantinedMessage) bool { return msg.ID == 7 })).Return(nil)
+	repo.On("ResolveQuarantined", mock.Anything, int64(7), models.QuarantineStatusResubmitted).Return(nil)
+
+	rr := serveAdmin(h, http.MethodPost, "/admin/quarantine/7/resubmit", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	msg := models.QuarantinedMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &msg))
+	assert.Equal(t, models.QuarantineStatusResubmitted, msg.Status)
+
+	// payload is still invalid
+	repo.On("GetQuarantined", mock.Anything, int64(8)).Return(quarantined(8), nil)
+	resubmitter.On("Resubmit", mock.Anything, mock.MatchedBy(func(msg *models.QuarantinedMessage) bool { return msg.ID == 8 })).
+		Return(retry.Permanent(errors.New("Key: 'CombinedData.Order.OrderUID' Error:Field validation for 'OrderUID' failed on the 'required' tag")))
+
+	rr = serveAdmin(h, http.MethodPost, "/admin/quarantine/8/resubmit", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, decodeError(t, rr).Details["payload"], "OrderUID")
+
+	// already discarded
+	discarded := quarantined(9)
+	discarded.Status = models.QuarantineStatusDiscarded
+	repo.On("GetQuarantined", mock.Anything, int64(9)).Return(discarded, nil)
+
+	rr = serveAdmin(h, http.MethodPost, "/admin/quarantine/9/resubmit", "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	repo.AssertExpectations(t)
+	resubmitter.AssertExpectations(t)
+	repo.AssertNotCalled(t, "ResolveQuarantined", mock.Anything, int64(8), mock.Anything)
+}
+
+func TestAdminHandler_DiscardQuarantined(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	h := &AdminHandler{Quarantine: repo, Timeout: time.Second}
+
+	repo.On("ResolveQuarantined", mock.Anything, int64(7), models.QuarantineStatusDiscarded).Return(nil)
+	repo.On("ResolveQuarantined", mock.Anything, int64(8), models.QuarantineStatusDiscarded).Return(sql.ErrNoRows)
+
+	rr := serveAdmin(h, http.MethodPost, "/admin/quarantine/7/discard", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = serveAdmin(h, http.MethodPost, "/admin/quarantine/8/discard", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	repo.AssertExpectations(t)
+}
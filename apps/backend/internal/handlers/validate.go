@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/validation"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ValidateOrder godoc
+// @Summary Validate order
+// @Description Checks order the same way as consumer does and lists every failed field, so producer can fix all of them at once. Order is not saved
+// @Accept json
+// @Produce json
+// @Param order body models.CombinedData true "Order"
+// @Success 200 {object} models.ValidationResult "Order is valid"
+// @Failure 400 {object} models.ErrorResponse "Body can not be read"
+// @Failure 422 {object} models.ErrorResponse "Order is invalid, fields lists every failed field"
+// @Failure 500 {object} models.ErrorResponse "Internal server error"
+// @Router /orders/validate [post]
+func (h *Handler) ValidateOrder(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadSize))
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "body can not be read", nil)
+		return
+	}
+
+	if _, err = validation.Decode(payload); err != nil {
+		if validation.Fields(err) == nil {
+			// not a fault of order, e.g. validator is misconfigured
+			log.Printf("Request %s: %v", middleware.GetReqID(r.Context()), err)
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error", nil)
+			return
+		}
+		writeInvalidOrder(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, models.ValidationResult{Valid: true})
+}
+
+// writeInvalidOrder writes 422 response with failed fields of order
+func writeInvalidOrder(w http.ResponseWriter, r *http.Request, err error) {
+	writeJSON(w, http.StatusUnprocessableEntity, models.ErrorResponse{
+		Code:      CodeInvalidArgument,
+		Message:   "order is invalid",
+		RequestID: middleware.GetReqID(r.Context()),
+		Details:   map[string]string{"payload": err.Error()},
+		Fields:    validation.Fields(err),
+	})
+}
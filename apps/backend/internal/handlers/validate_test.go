@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/Kost0/L0/internal/validation"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// readValidOrder reads order which passes validation, it is shared with validation tests
+func readValidOrder(t *testing.T) string {
+	payload, err := os.ReadFile("../validation/testdata/order.json")
+	require.NoError(t, err)
+	return string(payload)
+}
+
+func serveValidate(body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Post("/orders/validate", (&Handler{}).ValidateOrder)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/orders/validate", strings.NewReader(body)))
+	return rr
+}
+
+func TestValidateOrder_Valid(t *testing.T) {
+	rr := serveValidate(readValidOrder(t))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	result := models.ValidationResult{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.True(t, result.Valid)
+}
+
+func TestValidateOrder_ListsEveryField(t *testing.T) {
+	body := strings.Replace(readValidOrder(t), `"test@gmail.com"`, `"not an email"`, 1)
+	body = strings.Replace(body, `"price": 453`, `"price": -1`, 1)
+	body = strings.Replace(body, `"currency": "USD", `, ``, 1)
+
+	rr := serveValidate(body)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// the same envelope as of other errors and of resubmitted quarantined message
+	resp := decodeError(t, rr)
+	assert.Equal(t, CodeInvalidArgument, resp.Code)
+	require.Len(t, resp.Fields, 3)
+	assert.Equal(t, models.FieldError{Path: "payment.currency", Rule: "required", Message: "is required"}, resp.Fields[0])
+	assert.Equal(t, "delivery.email", resp.Fields[1].Path)
+	assert.Equal(t, validation.RuleEmail, resp.Fields[1].Rule)
+	assert.Equal(t, "items[0].price", resp.Fields[2].Path)
+	assert.Equal(t, validation.RuleNonNegative, resp.Fields[2].Rule)
+}
+
+func TestValidateOrder_InvalidJSON(t *testing.T) {
+	rr := serveValidate(`{"order": {"smID": "99"}}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	assert.Equal(t, []models.FieldError{{Path: "order.smID", Rule: validation.RuleType, Message: "must be int, got string"}}, decodeError(t, rr).Fields)
+
+	rr = serveValidate(`{broken`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	resp := decodeError(t, rr)
+	require.Len(t, resp.Fields, 1)
+	assert.Equal(t, validation.RuleSyntax, resp.Fields[0].Rule)
+}
+
+func TestAdminHandler_ResubmitQuarantined_InvalidFields(t *testing.T) {
+	repo := new(MockQuarantineRepository)
+	resubmitter := new(MockResubmitter)
+	h := &AdminHandler{Quarantine: repo, Resubmitter: resubmitter, Timeout: time.Second}
+
+	fields := []models.FieldError{{Path: "items[2].price", Rule: validation.RuleNonNegative, Message: "must not be negative"}}
+	repo.On("GetQuarantined", mock.Anything, int64(7)).Return(quarantined(7), nil)
+	resubmitter.On("Resubmit", mock.Anything, mock.Anything).
+		Return(retry.Permanent(&validation.Error{Fields: fields}))
+
+	rr := serveAdmin(h, http.MethodPost, "/admin/quarantine/7/resubmit", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	resp := decodeError(t, rr)
+	assert.Equal(t, CodeInvalidArgument, resp.Code)
+	assert.Equal(t, fields, resp.Fields)
+}
@@ -3,26 +3,161 @@ package http
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"time"
+	"strings"
 
 	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/handlers"
 	"github.com/Kost0/L0/internal/repository"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/swaggo/http-swagger"
 )
 
-// StartHTTPServer starts the server and handlers
+// Deps contains dependencies of Server
+type Deps struct {
+	Repo  repository.OrderRepository
+	Cache cache.Cache
+	// Warming reports whether cache is still warming up, may be nil
+	Warming func() bool
+	// Quarantine and Resubmitter are required for admin endpoints, which are enabled by admin token
+	Quarantine  repository.QuarantineRepository
+	Resubmitter handlers.Resubmitter
+}
+
+// Server serves http API
+type Server struct {
+	cfg config.HTTPConfig
+	srv *http.Server
+}
+
+// NewServer create new Server
+// Accepts:
+//   - cfg: settings of server
+//   - deps: dependencies
+//
+// Returns:
+//   - *Server
+//   - error if something wrong
+func NewServer(cfg config.HTTPConfig, deps Deps) (*Server, error) {
+	if deps.Repo == nil {
+		return nil, errors.New("http server: repository is required")
+	}
+	if deps.Cache == nil {
+		return nil, errors.New("http server: cache is required")
+	}
+
+	h := &handlers.Handler{
+		Repo:    deps.Repo,
+		Cache:   deps.Cache,
+		Timeout: cfg.RequestTimeout,
+	}
+
+	var admin *handlers.AdminHandler
+	if cfg.AdminToken != "" {
+		if deps.Quarantine == nil || deps.Resubmitter == nil {
+			return nil, errors.New("http server: quarantine and resubmitter are required for admin endpoints")
+		}
+		admin = &handlers.AdminHandler{
+			Quarantine:  deps.Quarantine,
+			Resubmitter: deps.Resubmitter,
+			Timeout:     cfg.RequestTimeout,
+		}
+	}
+
+	r := newRouter(h, deps.Warming)
+	if admin != nil {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(requireToken(cfg.AdminToken))
+			r.Get("/quarantine", admin.ListQuarantined)
+			r.Get("/quarantine/{id}", admin.GetQuarantined)
+			r.Put("/quarantine/{id}/payload", admin.UpdateQuarantinedPayload)
+			r.Post("/quarantine/{id}/resubmit", admin.ResubmitQuarantined)
+			r.Post("/quarantine/{id}/discard", admin.DiscardQuarantined)
+		})
+	}
+
+	return &Server{
+		cfg: cfg,
+		srv: &http.Server{
+			Addr:    cfg.Addr,
+			Handler: r,
+		},
+	}, nil
+}
+
+// Handler returns router of server
+// Returns:
+//   - http.Handler
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Run listens on configured address and serves until context is cancelled
+// Accepts:
+//   - ctx: context
+//
+// Returns:
+//   - error if something wrong
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("http server: %w", err)
+	}
+
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves on listener until context is cancelled
 // Accepts:
 //   - ctx: context
-//   - repo: repository
-//   - cache: struct for work with cache
-func StartHTTPServer(ctx context.Context, repo *repository.SQLOrderRepository, cache *cache.OrderCache) {
+//   - ln: listener
+//
+// Returns:
+//   - error if something wrong
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Starting HTTP server on %s...", ln.Addr())
+		errCh <- s.srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return fmt.Errorf("http server: %w", err)
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("http server: shutdown: %w", err)
+	}
+
+	return nil
+}
+
+func newRouter(h *handlers.Handler, warming func() bool) chi.Router {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID, exposeRequestID)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		handlers.WriteError(w, r, http.StatusNotFound, handlers.CodeNotFound, "route not found", nil)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		handlers.WriteError(w, r, http.StatusMethodNotAllowed, handlers.CodeInvalidArgument, "method not allowed", nil)
+	})
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		_, err := fmt.Fprintf(w, "Hello World")
@@ -32,39 +167,76 @@ func StartHTTPServer(ctx context.Context, repo *repository.SQLOrderRepository, c
 	})
 
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := "OK"
+		// orders are served from database until cache is warmed up
+		if warming != nil && warming() {
+			status = "warming"
+		}
 		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("OK"))
+		_, err := w.Write([]byte(status))
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
 	})
 
 	r.Get("/swagger/*", httpSwagger.WrapHandler)
 
-	h := handlers.Handler{
-		Repo:  repo,
-		Cache: cache,
-	}
+	r.Get("/debug/vars", publicVars)
 
+	r.Get("/orders", h.ListOrders)
+	r.Post("/orders/validate", h.ValidateOrder)
 	r.Get("/orders/{orderID}", h.GetOrderByID)
+	r.Get("/orders/{orderID}/history", h.GetOrderHistory)
+	r.Get("/tracks/{trackNumber}", h.GetOrderByTrackNumber)
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: r,
-	}
+	return r
+}
 
-	go func() {
-		<-ctx.Done()
-		log.Println("Shutting down server...")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			log.Fatalf("Error shutting down server: %v\n", err)
+// publicVarNames are expvar variables served on public listener
+// Default variables are not served, cmdline contains passwords and tokens given as flags.
+var publicVarNames = []string{"order_ingestion", "order_cache"}
+
+// publicVars writes counters of service in format of expvar.Handler
+func publicVars(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	b.WriteString("{")
+	for _, name := range publicVarNames {
+		v := expvar.Get(name)
+		if v == nil {
+			continue
 		}
-	}()
+		if b.Len() > 1 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "\n%q: %s", name, v.String())
+	}
+	b.WriteString("\n}\n")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Println(err)
+	}
+}
+
+// exposeRequestID returns ID of request in response header, so clients can report it
+func exposeRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
 
-	log.Println("Starting HTTP server...")
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("Error starting HTTP server: %v\n", err)
+// requireToken allows only requests with bearer token
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				handlers.WriteError(w, r, http.StatusUnauthorized, handlers.CodeUnauthenticated, "invalid admin token", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
 }
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) *Server {
+	cfg := config.Default()
+	cfg.HTTP.Addr = "127.0.0.1:0"
+
+	srv, err := NewServer(cfg.HTTP, Deps{
+		Repo:  repository.NewOrderRepository(nil, cfg.Repository),
+		Cache: cache.NewOrderCache(cfg.Cache),
+	})
+	assert.NoError(t, err)
+	return srv
+}
+
+func TestNewServer_MissingDeps(t *testing.T) {
+	_, err := NewServer(config.Default().HTTP, Deps{})
+	assert.Error(t, err)
+}
+
+func TestServer_Health(t *testing.T) {
+	srv := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "OK", rr.Body.String())
+}
+
+func TestServer_HealthWarming(t *testing.T) {
+	cfg := config.Default()
+	warming := true
+	srv, err := NewServer(cfg.HTTP, Deps{
+		Repo:    repository.NewOrderRepository(nil, cfg.Repository),
+		Cache:   cache.NewOrderCache(cfg.Cache),
+		Warming: func() bool { return warming },
+	})
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "warming", rr.Body.String())
+
+	warming = false
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, "OK", rr.Body.String())
+}
+
+func TestServer_DebugVarsHidesCmdline(t *testing.T) {
+	srv := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	vars := map[string]json.RawMessage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &vars))
+	assert.Contains(t, vars, "order_ingestion")
+	assert.NotContains(t, vars, "cmdline")
+	assert.NotContains(t, vars, "memstats")
+}
+
+func TestServer_ErrorEnvelope(t *testing.T) {
+	srv := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/orders/not-uuid", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	resp := models.ErrorResponse{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_argument", resp.Code)
+	assert.NotEmpty(t, resp.RequestID)
+	assert.Equal(t, resp.RequestID, rr.Header().Get("X-Request-Id"))
+
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, "not_found", resp.Code)
+}
+
+func TestServer_ServeStopsOnCancel(t *testing.T) {
+	srv := newTestServer(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ctx, ln)
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/health")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, "OK", string(body))
+
+	cancel()
+
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestServer_RunInvalidAddr(t *testing.T) {
+	srv := newTestServer(t)
+	srv.cfg.Addr = "invalid:address:1"
+
+	err := srv.Run(context.Background())
+	assert.Error(t, err)
+}
+
+type stubResubmitter struct{}
+
+func (stubResubmitter) Resubmit(context.Context, *models.QuarantinedMessage) error {
+	return nil
+}
+
+func TestServer_AdminEndpoints(t *testing.T) {
+	cfg := config.Default()
+
+	// without token admin endpoints are not served
+	srv := newTestServer(t)
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/quarantine/abc", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	cfg.HTTP.AdminToken = "secret"
+	_, err := NewServer(cfg.HTTP, Deps{
+		Repo:  repository.NewOrderRepository(nil, cfg.Repository),
+		Cache: cache.NewOrderCache(cfg.Cache),
+	})
+	assert.Error(t, err)
+
+	srv, err = NewServer(cfg.HTTP, Deps{
+		Repo:        repository.NewOrderRepository(nil, cfg.Repository),
+		Cache:       cache.NewOrderCache(cfg.Cache),
+		Quarantine:  repository.NewQuarantineRepository(nil),
+		Resubmitter: stubResubmitter{},
+	})
+	assert.NoError(t, err)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/quarantine/abc", nil)
+		req.Header.Set("Authorization", auth)
+		rr = httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		resp := models.ErrorResponse{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+		assert.Equal(t, "unauthenticated", resp.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/quarantine/abc", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,122 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/segmentio/kafka-go"
+)
+
+// runBatch collects messages into batches and inserts every batch in one transaction
+// Offsets of a batch are committed only after the transaction is committed.
+func (c *Consumer) runBatch(ctx context.Context) error {
+	for {
+		batch, err := c.collect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Shutting down Kafka consumer...")
+				return nil
+			}
+			return err
+		}
+
+		if err = c.flush(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				log.Printf("Shutting down Kafka consumer, batch of %d messages is not committed", len(batch))
+				return nil
+			}
+			return fmt.Errorf("kafka consumer: batch is not processed: %w", err)
+		}
+	}
+}
+
+// collect fetches messages until batch is full or batch timeout passes after the first message
+func (c *Consumer) collect(ctx context.Context) ([]kafka.Message, error) {
+	first, err := c.fetch(ctx, ctx)
+	if err != nil {
+		return nil, err
+	}
+	batch := append(make([]kafka.Message, 0, c.cfg.BatchSize), first)
+
+	fetchCtx, cancel := context.WithTimeout(ctx, c.cfg.BatchTimeout)
+	defer cancel()
+
+	for len(batch) < c.cfg.BatchSize {
+		msg, err := c.fetch(ctx, fetchCtx)
+		if err != nil {
+			if ctx.Err() == nil && fetchCtx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		batch = append(batch, msg)
+	}
+
+	return batch, nil
+}
+
+// fetch reads next message, skipping errors which are not fatal for the consumer
+func (c *Consumer) fetch(ctx, fetchCtx context.Context) (kafka.Message, error) {
+	for {
+		msg, err := c.reader.FetchMessage(fetchCtx)
+		if err == nil {
+			return msg, nil
+		}
+		if ctx.Err() != nil {
+			return kafka.Message{}, ctx.Err()
+		}
+		if fetchCtx.Err() != nil {
+			return kafka.Message{}, fetchCtx.Err()
+		}
+		if errors.Is(err, io.EOF) {
+			return kafka.Message{}, fmt.Errorf("kafka consumer: %w", err)
+		}
+		log.Printf("Error reading message: %s\n", err)
+	}
+}
+
+// flush saves batch and commits its offsets
+// Invalid messages are sent to DLQ at once. If batch insert fails,
+// messages are processed one by one, so one bad order does not block others.
+func (c *Consumer) flush(ctx context.Context, batch []kafka.Message) error {
+	orders := make([]*models.CombinedData, 0, len(batch))
+	valid := make([]kafka.Message, 0, len(batch))
+	for i := range batch {
+		data, err := decodeMessage(&batch[i])
+		if err != nil {
+			if err = c.dlq.sendToDLQ(ctx, &batch[i], err); err != nil {
+				return err
+			}
+			continue
+		}
+		orders = append(orders, data)
+		valid = append(valid, batch[i])
+	}
+
+	if len(orders) > 0 {
+		applied, err := c.repo.InsertOrders(ctx, orders)
+		switch {
+		case err == nil:
+			for i, data := range orders {
+				c.ingested(data, i < len(applied) && applied[i])
+			}
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			log.Printf("Batch insert failed, processing %d messages one by one: %v", len(valid), err)
+			for i := range valid {
+				data, applied, err := c.dlq.ProcessWithRetry(ctx, c.repo, &valid[i])
+				if err != nil {
+					return err
+				}
+				c.ingested(data, applied)
+			}
+		}
+	}
+
+	return c.reader.CommitMessages(ctx, batch...)
+}
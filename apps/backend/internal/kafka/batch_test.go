@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newBatchConsumer(t *testing.T, repo *MockOrderRepository, reader Reader, dlq Writer) *Consumer {
+	cfg := config.Default().Kafka
+	cfg.RetryDelay = time.Millisecond
+	cfg.BatchSize = 3
+	cfg.BatchTimeout = 20 * time.Millisecond
+
+	c, err := NewConsumer(cfg, Deps{Repo: repo, Reader: reader, DLQWriter: dlq})
+	assert.NoError(t, err)
+	return c
+}
+
+func batchOfLen(n int) interface{} {
+	return mock.MatchedBy(func(orders []*models.CombinedData) bool { return len(orders) == n })
+}
+
+func TestConsumer_RunBatch_FlushesBySizeAndTimeout(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), validMessageValue(t), validMessageValue(t), validMessageValue(t), validMessageValue(t))
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertOrders", mock.Anything, batchOfLen(3)).Return(nil, nil).Once()
+	repo.On("InsertOrders", mock.Anything, batchOfLen(2)).Return(nil, nil).Once()
+
+	c := newBatchConsumer(t, repo, broker.reader(), &fakeWriter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 5 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	repo.AssertExpectations(t)
+}
+
+func TestConsumer_RunBatch_InvalidMessageToDLQ(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), []byte(`{invalid json}`), validMessageValue(t))
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertOrders", mock.Anything, batchOfLen(2)).Return(nil, nil).Once()
+
+	dlq := &fakeWriter{}
+	c := newBatchConsumer(t, repo, broker.reader(), dlq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 3 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	assert.Len(t, dlq.written(), 1)
+	repo.AssertExpectations(t)
+}
+
+func TestConsumer_RunBatch_FallbackToSingleInserts(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), validMessageValue(t), validMessageValue(t))
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertOrders", mock.Anything, batchOfLen(3)).Return(nil, errors.New("duplicate key")).Once()
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil).Times(3)
+
+	c := newBatchConsumer(t, repo, broker.reader(), &fakeWriter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 3 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	repo.AssertExpectations(t)
+}
+
+func TestConsumer_RunBatch_NotCommittedBeforeInsert(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), validMessageValue(t), validMessageValue(t))
+
+	inserting := make(chan struct{})
+	repo := new(MockOrderRepository)
+	repo.On("InsertOrders", mock.Anything, batchOfLen(3)).
+		Run(func(args mock.Arguments) {
+			close(inserting)
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return(nil, context.Canceled)
+
+	dlq := &fakeWriter{}
+	c := newBatchConsumer(t, repo, broker.reader(), dlq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	<-inserting
+	cancel()
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(0), broker.committedOffset())
+	assert.Empty(t, dlq.written())
+}
@@ -1,107 +1,353 @@
-// Package cmd provides work with cmd
+// Package kafka provides consuming of orders from kafka
 package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
-	"net/mail"
+	"strings"
 	"time"
 
+	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
 	"github.com/Kost0/L0/internal/repository"
-	"github.com/go-playground/validator"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/Kost0/L0/internal/validation"
 	"github.com/segmentio/kafka-go"
 )
 
-// StartKafka launches cmd consumer to process messages
+// Reader is the part of kafka.Reader used by Consumer
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Writer is the part of kafka.Writer used to publish messages
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Deps contains dependencies of Consumer
+// Reader, DLQWriter and RetryWriter are optional, by default they are created from config.
+// RetryWriter writes to retry topics, so it must not have its own topic.
+// Quarantine is required when failed messages are stored in table.
+// Cache is optional. If WriteThrough is set, saved orders are put to Cache,
+// otherwise they are only invalidated in it. Orders which repository did not
+// apply, e.g. ignored or stale ones, are always only invalidated.
+type Deps struct {
+	Repo         repository.OrderRepository
+	Reader       Reader
+	DLQWriter    Writer
+	RetryWriter  Writer
+	Quarantine   repository.QuarantineRepository
+	Cache        cache.Cache
+	WriteThrough bool
+}
+
+// Consumer reads orders from kafka and saves them to database
+// Offset of a message is committed only after the order is saved or sent to DLQ,
+// so a message is processed at least once.
+type Consumer struct {
+	cfg          config.KafkaConfig
+	topic        string
+	groupID      string
+	delay        time.Duration
+	reader       Reader
+	dlq          *DLQHandler
+	repo         repository.OrderRepository
+	cache        cache.Cache
+	writeThrough bool
+	checkTopic   bool
+}
+
+// NewConsumer create new Consumer
 // Accepts:
-//   - ctx: context
-//   - db: database
-func StartKafka(ctx context.Context, repo repository.OrderRepository) {
-	brokerAddress := "kafka:9092"
-	topic := "test1234"
-	groupID := "myOrdersGroup-123456"
-
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:          []string{brokerAddress},
-		Topic:            topic,
-		GroupID:          groupID,
-		MinBytes:         10e3,
-		MaxBytes:         10e6,
-		MaxWait:          1 * time.Second,
-		RebalanceTimeout: 20 * time.Second,
-		StartOffset:      kafka.FirstOffset,
-		CommitInterval:   0,
-	})
-	defer func() {
-		if err := reader.Close(); err != nil {
-			log.Println(err)
+//   - cfg: settings of kafka
+//   - deps: dependencies
+//
+// Returns:
+//   - *Consumer
+//   - error if something wrong
+func NewConsumer(cfg config.KafkaConfig, deps Deps) (*Consumer, error) {
+	return newConsumer(cfg, cfg.Topic, cfg.GroupID, 0, deps)
+}
+
+// newConsumer create Consumer of topic in consumer group, delay is set for consumers of retry topics
+func newConsumer(cfg config.KafkaConfig, topic, groupID string, delay time.Duration, deps Deps) (*Consumer, error) {
+	if deps.Repo == nil {
+		return nil, errors.New("kafka consumer: repository is required")
+	}
+
+	c := &Consumer{
+		cfg:          cfg,
+		topic:        topic,
+		groupID:      groupID,
+		delay:        delay,
+		reader:       deps.Reader,
+		repo:         deps.Repo,
+		cache:        deps.Cache,
+		writeThrough: deps.WriteThrough,
+	}
+
+	if c.reader == nil {
+		startOffset, err := parseStartOffset(cfg.StartOffset)
+		if err != nil {
+			return nil, fmt.Errorf("kafka consumer: %w", err)
 		}
-	}()
 
-	dlqTopic := "dlq"
+		c.reader = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:          cfg.Brokers,
+			Topic:            topic,
+			GroupID:          groupID,
+			MinBytes:         10e3,
+			MaxBytes:         10e6,
+			MaxWait:          1 * time.Second,
+			RebalanceTimeout: 20 * time.Second,
+			StartOffset:      startOffset,
+			CommitInterval:   0,
+			Logger:           assignmentLogger{groupID: groupID},
+			ErrorLogger:      kafka.LoggerFunc(log.Printf),
+		})
+		c.checkTopic = true
+	}
+
+	if cfg.DeadLetter != config.DeadLetterTopic && deps.Quarantine == nil {
+		return nil, errors.New("kafka consumer: quarantine is required to store failed messages in table")
+	}
 
-	dlqHandler := NewDLQHandler([]string{brokerAddress}, topic, dlqTopic)
+	dlqWriter := deps.DLQWriter
+	if cfg.DeadLetter == config.DeadLetterTable {
+		dlqWriter = nil
+	} else if dlqWriter == nil {
+		dlqWriter = &kafka.Writer{
+			Addr:     kafka.TCP(cfg.Brokers...),
+			Topic:    cfg.DLQTopic,
+			Balancer: &kafka.Hash{},
+		}
+	}
+
+	retryWriter := deps.RetryWriter
+	if retryWriter == nil && len(cfg.RetryTiers) > 0 {
+		retryWriter = &kafka.Writer{
+			Addr:     kafka.TCP(cfg.Brokers...),
+			Balancer: &kafka.Hash{},
+		}
+	}
+	var quarantine repository.QuarantineRepository
+	if cfg.DeadLetter != config.DeadLetterTopic {
+		quarantine = deps.Quarantine
+	}
+	c.dlq = NewDLQHandler(cfg, dlqWriter, retryWriter, quarantine)
+
+	return c, nil
+}
+
+// Run processes messages until context is cancelled
+// If a message can be neither saved nor sent to DLQ, Run returns error without
+// committing it, so the message is delivered again after restart.
+// Accepts:
+//   - ctx: context
+//
+// Returns:
+//   - error if consumer stopped not because of ctx
+func (c *Consumer) Run(ctx context.Context) error {
+	defer c.close()
+
+	if c.checkTopic {
+		if err := waitForTopic(ctx, c.cfg.Brokers, c.topic); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("kafka consumer: %w", err)
+		}
+	}
+
+	if c.delay > 0 {
+		// messages of retry topic are processed one by one, because each of them waits for its delay
+		log.Printf("Starting Kafka retry consumer: topic %s, group %s, delay %s", c.topic, c.groupID, c.delay)
+	} else {
+		log.Printf("Starting Kafka consumer: topic %s, group %s, start offset %s, workers %d", c.topic, c.groupID, c.cfg.StartOffset, c.cfg.Workers)
+		if c.cfg.Workers > 1 {
+			return c.runPool(ctx)
+		}
+		if c.cfg.BatchSize > 1 {
+			return c.runBatch(ctx)
+		}
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Shutting down Kafka server...")
-			return
-		default:
-			err := dlqHandler.ProcessWithRetry(ctx, repo)
-			if err != nil {
-				log.Println(err)
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Println("Shutting down Kafka consumer...")
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("kafka consumer: %w", err)
 			}
+			log.Printf("Error reading message: %s\n", err)
+			continue
+		}
+
+		if c.delay > 0 {
+			if err = c.waitRetry(ctx, &msg); err != nil {
+				log.Printf("Shutting down Kafka retry consumer, message %d/%d is not committed", msg.Partition, msg.Offset)
+				return nil
+			}
+		}
+
+		data, applied, err := c.dlq.ProcessWithRetry(ctx, c.repo, &msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("Shutting down Kafka consumer, message %d/%d is not committed", msg.Partition, msg.Offset)
+				return nil
+			}
+			return fmt.Errorf("kafka consumer: message %d/%d is not processed: %w", msg.Partition, msg.Offset, err)
+		}
+		c.ingested(data, applied)
+
+		if err = c.reader.CommitMessages(ctx, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("kafka consumer: commit message %d/%d: %w", msg.Partition, msg.Offset, err)
 		}
 	}
 }
 
-func processMessage(ctx context.Context, repo repository.OrderRepository, msg *kafka.Message) error {
-	var data models.CombinedData
-	log.Printf("Received message: %s\n", string(msg.Value))
-	err := json.Unmarshal(msg.Value, &data)
-	if err != nil {
-		log.Printf("Error unmarshalling message: %s\n", err)
-		return err
+// ingested updates cache after order is processed, so fresh orders are served
+// from memory and are not served as missing or with old data
+// Data which is not applied, e.g. of stale message, is never cached,
+// because database keeps other data of the order.
+func (c *Consumer) ingested(data *models.CombinedData, applied bool) {
+	switch {
+	case c.cache == nil || data == nil:
+	case c.writeThrough && applied:
+		c.cache.Set(data.Order.OrderUID, data)
+	default:
+		c.cache.Invalidate(data.Order.OrderUID)
 	}
+}
+
+func (c *Consumer) close() {
+	if err := c.reader.Close(); err != nil {
+		log.Println(err)
+	}
+	if err := c.dlq.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+func parseStartOffset(offset string) (int64, error) {
+	switch offset {
+	case "first":
+		return kafka.FirstOffset, nil
+	case "last":
+		return kafka.LastOffset, nil
+	default:
+		return 0, fmt.Errorf("unknown start offset %q", offset)
+	}
+}
+
+// waitForTopic checks topic several times, because broker may still be creating it
+func waitForTopic(ctx context.Context, brokers []string, topic string) error {
+	const maxAttempts = 5
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = checkTopic(ctx, brokers, topic); err == nil {
+			return nil
+		}
+		log.Printf("Topic check attempt #%d: %v", attempt, err)
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// checkTopic makes sure that topic exists on one of the brokers
+func checkTopic(ctx context.Context, brokers []string, topic string) error {
+	var errs []error
+	for _, broker := range brokers {
+		partitions, err := readPartitions(ctx, broker, topic)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", broker, err))
+			continue
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("topic %s does not exist", topic)
+		}
 
-	if err = validateData(&data); err != nil {
-		log.Printf("Error validating data: %s\n", err)
-		return err
+		log.Printf("Topic %s has %d partitions", topic, len(partitions))
+		return nil
 	}
 
-	err = repo.InsertWithRetry(ctx, &data)
+	return fmt.Errorf("could not check topic %s: %w", topic, errors.Join(errs...))
+}
+
+func readPartitions(ctx context.Context, broker, topic string) (partitions []kafka.Partition, err error) {
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
 	if err != nil {
-		log.Printf("Error inserting order: %s\n", err)
-		return err
+		return nil, err
 	}
+	defer func() {
+		if errClose := conn.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
 
-	log.Printf("Message on %s: %s\n", msg.Topic, string(msg.Value))
-	return nil
+	return conn.ReadPartitions(topic)
 }
 
-func validateData(data *models.CombinedData) error {
-	validate := validator.New()
-	if err := validate.Struct(data); err != nil {
-		return err
+// assignmentLogger prints partition assignments which kafka reader reports after each rebalance
+type assignmentLogger struct {
+	groupID string
+}
+
+func (l assignmentLogger) Printf(format string, args ...interface{}) {
+	if strings.HasPrefix(format, "subscribed to topics and partitions") {
+		log.Printf("Group %s rebalanced, "+format, append([]interface{}{l.groupID}, args...)...)
 	}
+}
 
-	if data.Order.DateCreated.After(time.Now()) {
-		return errors.New("Order date created is in the future")
+func processMessage(ctx context.Context, repo repository.OrderRepository, msg *kafka.Message) (*models.CombinedData, bool, error) {
+	data, err := decodeMessage(msg)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if _, err := mail.ParseAddress(*data.Delivery.Email); err != nil {
-		return err
+	applied, err := repo.InsertWithRetry(ctx, data)
+	if err != nil {
+		log.Printf("Error inserting order: %s\n", err)
+		return nil, false, err
 	}
 
-	for _, item := range data.Items {
-		if *item.Price < 0 {
-			return errors.New("Item price is negative")
-		}
+	log.Printf("Message on %s: %s\n", msg.Topic, string(msg.Value))
+	return data, applied, nil
+}
+
+// decodeMessage unmarshals and validates order from message
+// Errors are permanent: the same message can never be decoded.
+// Retried and replayed messages keep their first position, so repository
+// ignores them when newer message of the same order is already saved.
+func decodeMessage(msg *kafka.Message) (*models.CombinedData, error) {
+	log.Printf("Received message: %s\n", string(msg.Value))
+	data, err := validation.Decode(msg.Value)
+	if err != nil {
+		log.Printf("Error decoding message: %s\n", err)
+		return nil, retry.Permanent(err)
 	}
+	data.Source = messageSource(msg)
 
-	return nil
+	return data, nil
 }
@@ -2,15 +2,24 @@ package kafka
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Kost0/L0/internal/cache"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func createValidData() *models.CombinedData {
@@ -60,118 +69,107 @@ func createValidData() *models.CombinedData {
 
 	data := models.CombinedData{
 		Order: models.Order{
-			orderUUID,
-			&track,
-			&entry,
-			&deliveryUUID,
-			&locale,
-			&internalSignature,
-			&customer,
-			&deliveryService,
-			&shardKey,
-			&smID,
-			&orderTime,
-			&oofShard,
+			OrderUID:          orderUUID,
+			TrackNumber:       &track,
+			Entry:             &entry,
+			DeliveryID:        &deliveryUUID,
+			Locale:            &locale,
+			InternalSignature: &internalSignature,
+			CustomerID:        &customer,
+			DeliveryService:   &deliveryService,
+			Shardkey:          &shardKey,
+			SmID:              &smID,
+			DateCreated:       &orderTime,
+			OofShard:          &oofShard,
 		},
 		Delivery: models.Delivery{
-			&deliveryUUID,
-			&name,
-			&phone,
-			&zip,
-			&city,
-			&address,
-			&region,
-			&email,
+			ID:      &deliveryUUID,
+			Name:    &name,
+			Phone:   &phone,
+			Zip:     &zip,
+			City:    &city,
+			Address: &address,
+			Region:  &region,
+			Email:   &email,
 		},
 		Payment: models.Payment{
-			&orderUUID,
-			&requestId,
-			&currency,
-			&provider,
-			&amount,
-			&paymentDT,
-			&bank,
-			&deliveryCost,
-			&goodsTotal,
-			&customFee,
+			Transaction:  &orderUUID,
+			RequestID:    &requestId,
+			Currency:     &currency,
+			Provider:     &provider,
+			Amount:       &amount,
+			PaymentDT:    &paymentDT,
+			Bank:         &bank,
+			DeliveryCost: &deliveryCost,
+			GoodsTotal:   &goodsTotal,
+			CustomFee:    &customFee,
 		},
-		Items: []models.Item{models.Item{
-			&chrtID,
-			&track,
-			&price,
-			&rid,
-			&name2,
-			&sale,
-			&size,
-			&totalPrice,
-			&nmId,
-			&brand,
-			&status,
+		Items: []models.Item{{
+			ChrtID:      &chrtID,
+			TrackNumber: &track,
+			Price:       &price,
+			Rid:         &rid,
+			Name:        &name2,
+			Sale:        &sale,
+			Size:        &size,
+			TotalPrice:  &totalPrice,
+			NmID:        &nmId,
+			Brand:       &brand,
+			Status:      &status,
 		}},
 	}
 
 	return &data
 }
 
-func TestValidateData_ValidData(t *testing.T) {
-	data := createValidData()
-
-	err := validateData(data)
-	assert.NoError(t, err)
+type MockOrderRepository struct {
+	mock.Mock
 }
 
-func TestValidateData_FutureDate(t *testing.T) {
-	data := createValidData()
-	futureTime := data.Order.DateCreated.Add(2 * time.Hour)
-	data.Order.DateCreated = &futureTime
-
-	err := validateData(data)
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "future")
+func (m *MockOrderRepository) SelectOrder(ctx context.Context, orderID string) (*models.CombinedData, error) {
+	args := m.Called(ctx, orderID)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func TestValidateData_InvalidEmail(t *testing.T) {
-	data := createValidData()
-	wrongEmail := ""
-
-	data.Delivery.Email = &wrongEmail
-
-	err := validateData(data)
-	assert.Error(t, err)
+func (m *MockOrderRepository) SelectWithRetry(ctx context.Context, orderID string) (*models.CombinedData, error) {
+	args := m.Called(orderID)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func TestValidateData_NegativePrice(t *testing.T) {
-	data := createValidData()
-	wrongPrice := -100
-
-	data.Items[0].Price = &wrongPrice
-
-	err := validateData(data)
-	assert.Error(t, err)
+func (m *MockOrderRepository) ListOrders(ctx context.Context, filter models.OrderFilter) (*models.OrderPage, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).(*models.OrderPage), args.Error(1)
 }
 
-type MockOrderRepository struct {
-	mock.Mock
+func (m *MockOrderRepository) SelectByTrackNumber(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(ctx, trackNumber)
+	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func (m *MockOrderRepository) SelectOrder(orderID string) (*models.CombinedData, error) {
-	args := m.Called(orderID)
+func (m *MockOrderRepository) SelectByTrackWithRetry(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	args := m.Called(trackNumber)
 	return args.Get(0).(*models.CombinedData), args.Error(1)
 }
 
-func (m *MockOrderRepository) SelectWithRetry(ctx context.Context, orderID string) (*models.CombinedData, error) {
-	args := m.Called(orderID)
-	return args.Get(0).(*models.CombinedData), args.Error(1)
+func (m *MockOrderRepository) SelectHistory(ctx context.Context, orderID string) ([]models.OrderVersion, error) {
+	args := m.Called(ctx, orderID)
+	return args.Get(0).([]models.OrderVersion), args.Error(1)
+}
+
+func (m *MockOrderRepository) InsertOrders(ctx context.Context, orders []*models.CombinedData) ([]bool, error) {
+	args := m.Called(ctx, orders)
+	applied, _ := args.Get(0).([]bool)
+	return applied, args.Error(1)
 }
 
-func (m *MockOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) error {
+func (m *MockOrderRepository) InsertWithRetry(ctx context.Context, order *models.CombinedData) (bool, error) {
 	args := m.Called(ctx, order)
-	return args.Error(0)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockOrderRepository) InsertOrder(order *models.CombinedData) error {
-	args := m.Called(order)
-	return args.Error(0)
+func (m *MockOrderRepository) InsertOrder(ctx context.Context, order *models.CombinedData) (bool, error) {
+	args := m.Called(ctx, order)
+	return args.Bool(0), args.Error(1)
 }
 
 func TestProcessMessage_ValidMessage(t *testing.T) {
@@ -188,9 +186,9 @@ func TestProcessMessage_ValidMessage(t *testing.T) {
 	ctx := context.Background()
 
 	mockRepo := new(MockOrderRepository)
-	mockRepo.On("InsertWithRetry", ctx, mock.AnythingOfType("*models.CombinedData")).Return(nil)
+	mockRepo.On("InsertWithRetry", ctx, mock.AnythingOfType("*models.CombinedData")).Return(true, nil)
 
-	err = processMessage(ctx, mockRepo, msg)
+	_, _, err = processMessage(ctx, mockRepo, msg)
 
 	assert.NoError(t, err)
 	mockRepo.AssertExpectations(t)
@@ -201,9 +199,10 @@ func TestProcessMessage_InvalidJSON(t *testing.T) {
 		Value: []byte(`{invalid json}`),
 	}
 
-	err := processMessage(context.Background(), nil, msg)
+	_, _, err := processMessage(context.Background(), nil, msg)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid character")
+	assert.True(t, retry.IsPermanent(err))
 }
 
 func TestProcessMessage_ValidationFailed(t *testing.T) {
@@ -218,7 +217,443 @@ func TestProcessMessage_ValidationFailed(t *testing.T) {
 		Value: jsonData,
 	}
 
-	err = processMessage(context.Background(), nil, msg)
+	_, _, err = processMessage(context.Background(), nil, msg)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "no address")
+	assert.True(t, retry.IsPermanent(err))
+}
+
+func TestNewConsumer_MissingRepo(t *testing.T) {
+	_, err := NewConsumer(config.Default().Kafka, Deps{})
+	assert.Error(t, err)
+}
+
+func TestParseStartOffset(t *testing.T) {
+	offset, err := parseStartOffset("first")
+	assert.NoError(t, err)
+	assert.Equal(t, kafka.FirstOffset, offset)
+
+	offset, err = parseStartOffset("last")
+	assert.NoError(t, err)
+	assert.Equal(t, kafka.LastOffset, offset)
+
+	_, err = parseStartOffset("middle")
+	assert.Error(t, err)
+}
+
+// fakeBroker keeps messages of one partition and committed offset of the group
+type fakeBroker struct {
+	mu        sync.Mutex
+	messages  []kafka.Message
+	committed int64
+}
+
+func newFakeBroker(values ...[]byte) *fakeBroker {
+	b := &fakeBroker{}
+	for i, v := range values {
+		b.messages = append(b.messages, kafka.Message{Topic: "orders", Offset: int64(i), Value: v})
+	}
+	return b
+}
+
+// reader returns new group member which starts from committed offset like after restart
+func (b *fakeBroker) reader() *fakeReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &fakeReader{broker: b, next: b.committed}
+}
+
+func (b *fakeBroker) committedOffset() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed
+}
+
+type fakeReader struct {
+	broker *fakeBroker
+	next   int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.broker.mu.Lock()
+	if r.next < int64(len(r.broker.messages)) {
+		msg := r.broker.messages[r.next]
+		r.next++
+		r.broker.mu.Unlock()
+		return msg, nil
+	}
+	r.broker.mu.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+	for _, msg := range msgs {
+		if msg.Offset+1 > r.broker.committed {
+			r.broker.committed = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+type fakeWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	err      error
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
+
+func (w *fakeWriter) written() []kafka.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]kafka.Message(nil), w.messages...)
+}
+
+func newTestConsumer(t testing.TB, repo *MockOrderRepository, reader Reader, dlq Writer) *Consumer {
+	cfg := config.Default().Kafka
+	cfg.RetryDelay = time.Millisecond
+
+	c, err := NewConsumer(cfg, Deps{Repo: repo, Reader: reader, DLQWriter: dlq})
+	assert.NoError(t, err)
+	return c
+}
+
+func validMessageValue(t *testing.T) []byte {
+	return validMessageValueOf(t, createValidData())
+}
+
+func validMessageValueOf(t testing.TB, data *models.CombinedData) []byte {
+	value, err := json.Marshal(data)
+	assert.NoError(t, err)
+	return value
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsumer_Run_CommitsAfterInsert(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), validMessageValue(t))
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	c := newTestConsumer(t, repo, broker.reader(), &fakeWriter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 2 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	repo.AssertNumberOfCalls(t, "InsertWithRetry", 2)
+}
+
+func TestConsumer_Run_InvalidatesMissingOrder(t *testing.T) {
+	data := createValidData()
+	broker := newFakeBroker(validMessageValueOf(t, data))
+
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+	_, err := orderCache.GetOrLoad(context.Background(), data.Order.OrderUID, func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		return nil, sql.ErrNoRows
+	})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	c, err := NewConsumer(config.Default().Kafka, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, Cache: orderCache})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	assert.Equal(t, 0, orderCache.Stats().NegativeEntries)
+}
+
+func TestConsumer_Run_WritesThroughCache(t *testing.T) {
+	data := createValidData()
+	broker := newFakeBroker(validMessageValueOf(t, data))
+
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	c, err := NewConsumer(config.Default().Kafka, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, Cache: orderCache, WriteThrough: true})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	cached, found := orderCache.Get(data.Order.OrderUID)
+	assert.True(t, found)
+	assert.Equal(t, data.Order.OrderUID, cached.Order.OrderUID)
+	assert.Equal(t, *data.Delivery.Email, *cached.Delivery.Email)
+}
+
+func TestConsumer_Run_StaleMessageNotCached(t *testing.T) {
+	stale := createValidData()
+	broker := newFakeBroker(validMessageValueOf(t, stale))
+
+	newer := createValidData()
+	newer.Order.OrderUID = stale.Order.OrderUID
+	email := "newer@gmail.com"
+	newer.Delivery.Email = &email
+
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+	orderCache.Set(newer.Order.OrderUID, newer)
+
+	// database keeps data of newer message
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(false, nil)
+
+	c, err := NewConsumer(config.Default().Kafka, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, Cache: orderCache, WriteThrough: true})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	cached, err := orderCache.GetOrLoad(context.Background(), newer.Order.OrderUID, func(ctx context.Context, orderID string) (*models.CombinedData, error) {
+		return newer, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, email, *cached.Delivery.Email)
+}
+
+func TestConsumer_RunBatch_WritesThroughCache(t *testing.T) {
+	first, second := createValidData(), createValidData()
+	broker := newFakeBroker(validMessageValueOf(t, first), validMessageValueOf(t, second))
+
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertOrders", mock.Anything, mock.Anything).Return([]bool{true, true}, nil)
+
+	cfg := config.Default().Kafka
+	cfg.BatchSize = 2
+	c, err := NewConsumer(cfg, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, Cache: orderCache, WriteThrough: true})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 2 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	for _, data := range []*models.CombinedData{first, second} {
+		_, found := orderCache.Get(data.Order.OrderUID)
+		assert.True(t, found)
+	}
+}
+
+func TestConsumer_Run_InvalidatesCachedOrderWithoutWriteThrough(t *testing.T) {
+	data := createValidData()
+	broker := newFakeBroker(validMessageValueOf(t, data))
+
+	orderCache := cache.NewOrderCache(config.Default().Cache)
+	defer orderCache.Close()
+	orderCache.Set(data.Order.OrderUID, &models.CombinedData{Order: models.Order{OrderUID: data.Order.OrderUID}})
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	c, err := NewConsumer(config.Default().Kafka, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, Cache: orderCache})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	_, found := orderCache.Get(data.Order.OrderUID)
+	assert.False(t, found)
+}
+
+func TestConsumer_Run_RedeliveredAfterCrash(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t))
+
+	// first instance crashes while the order is being inserted
+	inserting := make(chan struct{})
+	crashedRepo := new(MockOrderRepository)
+	crashedRepo.On("InsertWithRetry", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			close(inserting)
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return(false, context.Canceled)
+
+	dlq := &fakeWriter{}
+	c := newTestConsumer(t, crashedRepo, broker.reader(), dlq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	<-inserting
+	cancel()
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(0), broker.committedOffset())
+	assert.Empty(t, dlq.written())
+
+	// after restart the same message is delivered again
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	c = newTestConsumer(t, repo, broker.reader(), dlq)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	repo.AssertNumberOfCalls(t, "InsertWithRetry", 1)
+	assert.Empty(t, dlq.written())
+}
+
+func TestConsumer_Run_NotCommittedOnDBFailure(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t), validMessageValue(t))
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(false, errors.New("db down"))
+
+	dlq := &fakeWriter{err: errors.New("kafka down")}
+	c := newTestConsumer(t, repo, broker.reader(), dlq)
+
+	err := c.Run(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "kafka down")
+	assert.Equal(t, int64(0), broker.committedOffset())
+	repo.AssertNumberOfCalls(t, "InsertWithRetry", config.Default().Kafka.MaxRetries)
+}
+
+func TestConsumer_Run_CommitsAfterDLQ(t *testing.T) {
+	broker := newFakeBroker([]byte(`{invalid json}`))
+
+	dlq := &fakeWriter{}
+	c := newTestConsumer(t, new(MockOrderRepository), broker.reader(), dlq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	assert.Len(t, dlq.written(), 1)
+}
+
+func TestDLQHandler_ProcessWithRetry_PermanentErrorToDLQAtOnce(t *testing.T) {
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).
+		Return(false, fmt.Errorf("insert: %w", &pq.Error{Code: "23502"}))
+
+	dlq := &fakeWriter{}
+	c := newTestConsumer(t, repo, nil, dlq)
+	msg := &kafka.Message{Topic: "orders", Value: validMessageValue(t)}
+
+	data, _, err := c.dlq.ProcessWithRetry(context.Background(), repo, msg)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Len(t, dlq.written(), 1)
+	repo.AssertNumberOfCalls(t, "InsertWithRetry", 1)
+}
+
+func TestDLQHandler_ProcessWithRetry_ValidationErrorsInHeader(t *testing.T) {
+	data := createValidData()
+	wrongEmail := "not an email"
+	wrongPrice := -1
+	data.Order.TrackNumber = nil
+	data.Delivery.Email = &wrongEmail
+	data.Items[0].Price = &wrongPrice
+
+	dlq := &fakeWriter{}
+	c := newTestConsumer(t, new(MockOrderRepository), nil, dlq)
+	msg := &kafka.Message{Topic: "orders", Value: validMessageValueOf(t, data)}
+
+	_, _, err := c.dlq.ProcessWithRetry(context.Background(), new(MockOrderRepository), msg)
+	require.NoError(t, err)
+	require.Len(t, dlq.written(), 1)
+
+	var fields []models.FieldError
+	require.NoError(t, json.Unmarshal([]byte(header(dlq.written()[0].Headers, HeaderValidationErrors)), &fields))
+	paths := make([]string, len(fields))
+	for i, f := range fields {
+		paths[i] = f.Path
+	}
+	assert.Equal(t, []string{"order.trackNumber", "delivery.email", "items[0].price"}, paths)
+	assert.Equal(t, "required", fields[0].Rule)
+	assert.Contains(t, header(dlq.written()[0].Headers, HeaderError), "items[0].price")
+}
+
+func TestDLQHandler_ProcessWithRetry_TransientErrorRetried(t *testing.T) {
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).
+		Return(false, &pq.Error{Code: "40001"}).Once()
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(true, nil)
+
+	dlq := &fakeWriter{}
+	c := newTestConsumer(t, repo, nil, dlq)
+	msg := &kafka.Message{Topic: "orders", Value: validMessageValue(t)}
+
+	data, _, err := c.dlq.ProcessWithRetry(context.Background(), repo, msg)
+	assert.NoError(t, err)
+	assert.NotNil(t, data)
+	assert.Empty(t, dlq.written())
+	repo.AssertNumberOfCalls(t, "InsertWithRetry", 2)
 }
@@ -2,83 +2,216 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
 	"github.com/Kost0/L0/internal/repository"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/Kost0/L0/internal/validation"
 	"github.com/segmentio/kafka-go"
 )
 
+// Headers of messages sent to retry topics and DLQ
+const (
+	HeaderOriginalTopic = "original_topic"
+	HeaderError         = "error"
+	HeaderTimestamp     = "timestamp"
+	// HeaderRetryAttempt is number of retry topics message went through
+	HeaderRetryAttempt = "retry_attempt"
+	// HeaderRetryAt is time in RFC3339 after which message of retry topic is processed
+	HeaderRetryAt = "retry_at"
+	// HeaderValidationErrors is JSON array of failed fields of invalid message
+	HeaderValidationErrors = "validation_errors"
+	// HeaderSourceTopic, HeaderSourcePartition and HeaderSourceOffset are position of message
+	// in the topic it was consumed from first. They are kept on retry and replay,
+	// so data of an old message does not overwrite newer data of the same order.
+	HeaderSourceTopic     = "source_topic"
+	HeaderSourcePartition = "source_partition"
+	HeaderSourceOffset    = "source_offset"
+)
+
+// DLQHandler retries processing of messages and sends failed ones to retry topics,
+// dead letter topic and quarantine table
 type DLQHandler struct {
-	mainReader *kafka.Reader
-	dlqWriter  *kafka.Writer
-	maxRetries int
+	dlqWriter   Writer
+	retryWriter Writer
+	quarantine  repository.QuarantineRepository
+	tiers       []retryTier
+	maxRetries  int
+	backoff     retry.Backoff
 }
 
-func NewDLQHandler(brokers []string, mainTopic, dlqTopic string) *DLQHandler {
+// NewDLQHandler create new DLQHandler
+// Accepts:
+//   - cfg: settings of kafka
+//   - dlqWriter: writer to dead letter topic, may be nil if failed messages are only quarantined
+//   - retryWriter: writer to retry topics, topic is set in every message; may be nil without retry tiers
+//   - quarantine: store of failed messages, may be nil if they are only sent to dead letter topic
+//
+// Returns:
+//   - *DLQHandler
+func NewDLQHandler(cfg config.KafkaConfig, dlqWriter, retryWriter Writer, quarantine repository.QuarantineRepository) *DLQHandler {
 	return &DLQHandler{
-		mainReader: kafka.NewReader(kafka.ReaderConfig{
-			Brokers: brokers,
-			Topic:   mainTopic,
-			GroupID: "main",
-		}),
-		dlqWriter: &kafka.Writer{
-			Addr:     kafka.TCP(brokers...),
-			Topic:    dlqTopic,
-			Balancer: &kafka.Hash{},
-		},
-		maxRetries: 3,
+		dlqWriter:   dlqWriter,
+		retryWriter: retryWriter,
+		quarantine:  quarantine,
+		tiers:       retryTiers(cfg),
+		maxRetries:  cfg.MaxRetries,
+		backoff:     retry.Backoff{Base: cfg.RetryDelay, Max: cfg.MaxRetryDelay},
 	}
 }
 
-func (h *DLQHandler) ProcessWithRetry(ctx context.Context, repo repository.OrderRepository) error {
-	for {
-		msg, err := h.mainReader.ReadMessage(context.Background())
-		if err != nil {
-			if ctx.Err() != nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
-				return err
-			}
-			log.Printf("Error reading message: %s\n", err)
-			continue
+// ProcessWithRetry processes message several times and sends it to the next retry topic
+// or to DLQ if all attempts fail
+// Permanent errors, such as broken JSON or invalid order, are sent to DLQ at once.
+// Other errors are retried with exponential backoff and jitter.
+// Accepts:
+//   - ctx: context
+//   - repo: repository
+//   - msg: message from kafka
+//
+// Returns:
+//   - order of message, nil if message was sent to retry topic or DLQ
+//   - true if data of order is saved, false if database keeps other data, e.g. of newer message
+//   - error if message was not processed and was not sent further
+func (h *DLQHandler) ProcessWithRetry(ctx context.Context, repo repository.OrderRepository, msg *kafka.Message) (*models.CombinedData, bool, error) {
+	for attempt := 1; ; attempt++ {
+		data, applied, err := processMessage(ctx, repo, msg)
+		if err == nil {
+			return data, applied, nil
+		}
+
+		// message is not sent to DLQ when processing was interrupted by shutdown
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		err = retry.Classify(err)
+		log.Printf("Attempt #%d: %v", attempt, err)
+
+		if retry.IsPermanent(err) {
+			return nil, false, h.sendToDLQ(ctx, msg, err)
+		}
+		if attempt >= h.maxRetries {
+			return nil, false, h.forward(ctx, msg, err)
 		}
 
-		if err = h.processWithRetry(ctx, repo, &msg); err != nil {
-			log.Printf("Final processing error: %v", err)
+		if err = retry.Sleep(ctx, h.backoff.Delay(attempt)); err != nil {
+			return nil, false, err
 		}
 	}
 }
 
-func (h *DLQHandler) processWithRetry(ctx context.Context, repo repository.OrderRepository, msg *kafka.Message) error {
-	for attempt := 1; attempt <= h.maxRetries; attempt++ {
-		err := processMessage(ctx, repo, msg)
-		if err == nil {
-			return nil
-		}
+// forward sends failed message to the next retry topic, or to DLQ after the last one
+func (h *DLQHandler) forward(ctx context.Context, msg *kafka.Message, err error) error {
+	attempt := retryAttempt(msg)
+	if attempt >= len(h.tiers) {
+		return h.sendToDLQ(ctx, msg, err)
+	}
 
-		log.Printf("Attempt #%d: %v", attempt, err)
+	tier := h.tiers[attempt]
+	log.Printf("Message %d/%d of %s is sent to %s", msg.Partition, msg.Offset, msg.Topic, tier.topic)
+
+	retryMsg := failedMessage(msg, err)
+	retryMsg.Topic = tier.topic
+	retryMsg.Headers = setHeader(retryMsg.Headers, HeaderRetryAttempt, strconv.Itoa(attempt+1))
+	retryMsg.Headers = setHeader(retryMsg.Headers, HeaderRetryAt, time.Now().Add(tier.delay).Format(time.RFC3339Nano))
+
+	return h.retryWriter.WriteMessages(ctx, retryMsg)
+}
+
+// sendToDLQ stores failed message in quarantine table and sends it to dead letter topic
+func (h *DLQHandler) sendToDLQ(ctx context.Context, msg *kafka.Message, err error) error {
+	if h.quarantine != nil {
+		if errSave := h.quarantine.Quarantine(ctx, quarantinedMessage(msg, err)); errSave != nil {
+			return fmt.Errorf("quarantine message %d/%d: %w", msg.Partition, msg.Offset, errSave)
+		}
+	}
+	if h.dlqWriter == nil {
+		return nil
+	}
+	return h.dlqWriter.WriteMessages(ctx, failedMessage(msg, err))
+}
 
-		if attempt == h.maxRetries {
-			return h.sendToDLQ(msg, err)
+// failedMessage copies message with headers describing the failure
+// Original topic and source position are kept when message comes from retry topic.
+func failedMessage(msg *kafka.Message, err error) kafka.Message {
+	headers := append([]kafka.Header(nil), msg.Headers...)
+	if header(headers, HeaderOriginalTopic) == "" {
+		headers = setHeader(headers, HeaderOriginalTopic, msg.Topic)
+	}
+	headers = setSource(headers, messageSource(msg))
+	headers = setHeader(headers, HeaderError, err.Error())
+	headers = setHeader(headers, HeaderTimestamp, time.Now().Format(time.RFC3339))
+	if fields := validation.Fields(err); fields != nil {
+		if value, jerr := json.Marshal(fields); jerr == nil {
+			headers = setHeader(headers, HeaderValidationErrors, string(value))
 		}
+	}
+
+	return kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+		Time:    msg.Time,
+	}
+}
 
-		time.Sleep(time.Duration(attempt) * time.Second)
+// messageSource returns position of message in the topic it was consumed from first
+// Messages without source headers are consumed for the first time.
+func messageSource(msg *kafka.Message) *models.Source {
+	topic := header(msg.Headers, HeaderSourceTopic)
+	partition, errPartition := strconv.Atoi(header(msg.Headers, HeaderSourcePartition))
+	offset, errOffset := strconv.ParseInt(header(msg.Headers, HeaderSourceOffset), 10, 64)
+	if topic == "" || errPartition != nil || errOffset != nil {
+		return &models.Source{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
 	}
+	return &models.Source{Topic: topic, Partition: partition, Offset: offset}
+}
 
-	return nil
+// setSource writes position of message to source headers
+func setSource(headers []kafka.Header, src *models.Source) []kafka.Header {
+	headers = setHeader(headers, HeaderSourceTopic, src.Topic)
+	headers = setHeader(headers, HeaderSourcePartition, strconv.Itoa(src.Partition))
+	return setHeader(headers, HeaderSourceOffset, strconv.FormatInt(src.Offset, 10))
 }
 
-func (h *DLQHandler) sendToDLQ(msg *kafka.Message, err error) error {
-	dlqMsg := kafka.Message{
-		Key:   msg.Key,
-		Value: msg.Value,
-		Headers: append(msg.Headers,
-			kafka.Header{Key: "original_topic", Value: []byte(msg.Topic)},
-			kafka.Header{Key: "error", Value: []byte(err.Error())},
-			kafka.Header{Key: "timestamp", Value: []byte(time.Now().Format(time.RFC3339))},
-		),
-		Time: msg.Time,
+// header returns value of header with key, empty if there is no such header
+func header(headers []kafka.Header, key string) string {
+	for _, h := range headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
 	}
+	return ""
+}
 
-	return h.dlqWriter.WriteMessages(context.Background(), dlqMsg)
+// setHeader replaces value of header with key or appends new header
+func setHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	for i := range headers {
+		if headers[i].Key == key {
+			headers[i].Value = []byte(value)
+			return headers
+		}
+	}
+	return append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// Close closes writers of handler
+// Returns:
+//   - error if something wrong
+func (h *DLQHandler) Close() error {
+	var errs []error
+	for _, w := range []Writer{h.dlqWriter, h.retryWriter} {
+		if w != nil {
+			errs = append(errs, w.Close())
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,190 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// result is an outcome of message processing by worker
+type result struct {
+	msg kafka.Message
+	err error
+}
+
+// runPool processes messages by several workers
+// Messages with the same key always go to the same worker, so orders are processed
+// in the order they were written. Offsets are committed in order of partition:
+// a message is committed only when all previous messages are processed.
+func (c *Consumer) runPool(ctx context.Context) error {
+	workersCtx, cancelWorkers := context.WithCancel(ctx)
+	defer cancelWorkers()
+
+	inFlight := make(chan struct{}, c.cfg.MaxInFlight)
+	results := make(chan result, c.cfg.MaxInFlight)
+	tracker := newOffsetTracker()
+
+	var wg sync.WaitGroup
+	workers := make([]chan kafka.Message, c.cfg.Workers)
+	for i := range workers {
+		workers[i] = make(chan kafka.Message, c.cfg.MaxInFlight)
+		wg.Add(1)
+		go func(in <-chan kafka.Message) {
+			defer wg.Done()
+			for msg := range in {
+				data, applied, err := c.dlq.ProcessWithRetry(workersCtx, c.repo, &msg)
+				if err == nil {
+					c.ingested(data, applied)
+				}
+				results <- result{msg: msg, err: err}
+			}
+		}(workers[i])
+	}
+	defer func() {
+		cancelWorkers()
+		for _, w := range workers {
+			close(w)
+		}
+		wg.Wait()
+	}()
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	// fetcher
+	g.Go(func() error {
+		for {
+			select {
+			case inFlight <- struct{}{}:
+			case <-gctx.Done():
+				return nil
+			}
+
+			msg, err := c.reader.FetchMessage(gctx)
+			if err != nil {
+				<-inFlight
+				if gctx.Err() != nil {
+					return nil
+				}
+				if errors.Is(err, io.EOF) {
+					return fmt.Errorf("kafka consumer: %w", err)
+				}
+				log.Printf("Error reading message: %s\n", err)
+				continue
+			}
+
+			tracker.add(msg)
+			workers[workerIndex(msg, len(workers))] <- msg
+		}
+	})
+
+	// committer
+	g.Go(func() error {
+		for {
+			select {
+			case res := <-results:
+				if res.err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					return fmt.Errorf("kafka consumer: message %d/%d is not processed: %w", res.msg.Partition, res.msg.Offset, res.err)
+				}
+
+				commit, released := tracker.done(res.msg)
+				if commit != nil {
+					if err := c.reader.CommitMessages(gctx, *commit); err != nil {
+						if gctx.Err() != nil {
+							return nil
+						}
+						return fmt.Errorf("kafka consumer: commit message %d/%d: %w", commit.Partition, commit.Offset, err)
+					}
+				}
+				for i := 0; i < released; i++ {
+					<-inFlight
+				}
+			case <-gctx.Done():
+				return nil
+			}
+		}
+	})
+
+	err := g.Wait()
+	if err == nil {
+		log.Println("Shutting down Kafka consumer...")
+	}
+	return err
+}
+
+// workerIndex chooses worker by key of message
+func workerIndex(msg kafka.Message, workers int) int {
+	h := fnv.New32a()
+	if len(msg.Key) > 0 {
+		_, _ = h.Write(msg.Key)
+	} else {
+		_, _ = fmt.Fprintf(h, "%d/%d", msg.Partition, msg.Offset)
+	}
+	return int(h.Sum32() % uint32(workers))
+}
+
+// offsetTracker keeps fetched offsets of every partition until they can be committed
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]kafka.Message
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: map[int]*partitionOffsets{}}
+}
+
+// add registers fetched message, messages must be added in order of fetching
+func (t *offsetTracker) add(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[msg.Partition]
+	if !ok {
+		p = &partitionOffsets{done: map[int64]kafka.Message{}}
+		t.partitions[msg.Partition] = p
+	}
+	p.pending = append(p.pending, msg.Offset)
+}
+
+// done marks message as processed
+// Returns the last message which can be committed now, or nil,
+// and the number of messages which left the tracker.
+func (t *offsetTracker) done(msg kafka.Message) (*kafka.Message, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[msg.Partition]
+	if !ok {
+		return nil, 0
+	}
+	p.done[msg.Offset] = msg
+
+	var commit *kafka.Message
+	released := 0
+	for len(p.pending) > 0 {
+		m, ok := p.done[p.pending[0]]
+		if !ok {
+			break
+		}
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+		commit = &m
+		released++
+	}
+
+	return commit, released
+}
@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowRepo imitates database which spends some time on every insert
+type slowRepo struct {
+	MockOrderRepository
+	delay time.Duration
+
+	mu      sync.Mutex
+	offsets map[string][]int64
+}
+
+func newSlowRepo(delay time.Duration) *slowRepo {
+	return &slowRepo{delay: delay, offsets: map[string][]int64{}}
+}
+
+func (r *slowRepo) InsertWithRetry(ctx context.Context, data *models.CombinedData) (bool, error) {
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.offsets[data.Order.OrderUID] = append(r.offsets[data.Order.OrderUID], data.Source.Offset)
+	return true, nil
+}
+
+// newKeyedBroker creates broker with messages of several orders, every order is written several times
+func newKeyedBroker(t testing.TB, orders, versions int) *fakeBroker {
+	broker := &fakeBroker{}
+	for v := 0; v < versions; v++ {
+		for o := 0; o < orders; o++ {
+			data := createValidData()
+			data.Order.OrderUID = fmt.Sprintf("order-%d", o)
+			value := validMessageValueOf(t, data)
+			broker.messages = append(broker.messages, kafka.Message{
+				Topic:  "orders",
+				Offset: int64(len(broker.messages)),
+				Key:    []byte(data.Order.OrderUID),
+				Value:  value,
+			})
+		}
+	}
+	return broker
+}
+
+func newPoolConsumer(t testing.TB, repo *slowRepo, reader Reader, workers int) *Consumer {
+	cfg := config.Default().Kafka
+	cfg.RetryDelay = time.Millisecond
+	cfg.Workers = workers
+	cfg.MaxInFlight = 4 * workers
+
+	c, err := NewConsumer(cfg, Deps{Repo: repo, Reader: reader, DLQWriter: &fakeWriter{}})
+	assert.NoError(t, err)
+	return c
+}
+
+func TestConsumer_RunPool_PreservesOrderPerKey(t *testing.T) {
+	broker := newKeyedBroker(t, 5, 10)
+	repo := newSlowRepo(time.Millisecond)
+
+	c := newPoolConsumer(t, repo, broker.reader(), 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == int64(len(broker.messages)) })
+	cancel()
+	assert.NoError(t, <-done)
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Len(t, repo.offsets, 5)
+	for id, offsets := range repo.offsets {
+		assert.Len(t, offsets, 10, id)
+		assert.IsIncreasing(t, offsets, id)
+	}
+}
+
+func TestOffsetTracker_CommitsInOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, msg := range []kafka.Message{
+		{Partition: 0, Offset: 1},
+		{Partition: 0, Offset: 2},
+		{Partition: 1, Offset: 7},
+		{Partition: 0, Offset: 3},
+	} {
+		tracker.add(msg)
+	}
+
+	commit, released := tracker.done(kafka.Message{Partition: 0, Offset: 2})
+	assert.Nil(t, commit)
+	assert.Equal(t, 0, released)
+
+	commit, released = tracker.done(kafka.Message{Partition: 1, Offset: 7})
+	assert.Equal(t, int64(7), commit.Offset)
+	assert.Equal(t, 1, released)
+
+	commit, released = tracker.done(kafka.Message{Partition: 0, Offset: 1})
+	assert.Equal(t, int64(2), commit.Offset)
+	assert.Equal(t, 2, released)
+
+	commit, released = tracker.done(kafka.Message{Partition: 0, Offset: 3})
+	assert.Equal(t, int64(3), commit.Offset)
+	assert.Equal(t, 1, released)
+}
+
+// discardLog turns off logging and returns function to turn it on
+func discardLog() func() {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	return func() { log.SetOutput(out) }
+}
+
+func benchmarkConsumer(b *testing.B, workers int) {
+	defer discardLog()()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		broker := newKeyedBroker(b, 50, 4)
+		repo := newSlowRepo(time.Millisecond)
+		c := newPoolConsumer(b, repo, broker.reader(), workers)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		b.StartTimer()
+
+		go func() { done <- c.Run(ctx) }()
+		for broker.committedOffset() < int64(len(broker.messages)) {
+			time.Sleep(100 * time.Microsecond)
+		}
+
+		b.StopTimer()
+		cancel()
+		<-done
+		b.StartTimer()
+	}
+}
+
+func BenchmarkConsumer_Sequential(b *testing.B) {
+	benchmarkConsumer(b, 1)
+}
+
+func BenchmarkConsumer_Pool4(b *testing.B) {
+	benchmarkConsumer(b, 4)
+}
+
+func BenchmarkConsumer_Pool16(b *testing.B) {
+	benchmarkConsumer(b, 16)
+}
@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/segmentio/kafka-go"
+)
+
+// quarantinedMessage describes failed message for quarantine table
+func quarantinedMessage(msg *kafka.Message, err error) *models.QuarantinedMessage {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, h := range msg.Headers {
+		if !isFailureHeader(h.Key) {
+			headers[h.Key] = string(h.Value)
+		}
+	}
+	// resubmitted message keeps its first position, so repository can still recognize it as stale
+	for _, h := range setSource(nil, messageSource(msg)) {
+		headers[h.Key] = string(h.Value)
+	}
+
+	originalTopic := header(msg.Headers, HeaderOriginalTopic)
+	if originalTopic == "" {
+		originalTopic = msg.Topic
+	}
+
+	return &models.QuarantinedMessage{
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		OriginalTopic: originalTopic,
+		Key:           string(msg.Key),
+		Payload:       string(msg.Value),
+		Headers:       headers,
+		Error:         err.Error(),
+		ErrorChain:    errorChain(err),
+		Attempts:      retryAttempt(msg) + 1,
+	}
+}
+
+// errorChain returns texts of err and errors it wraps, texts equal to the previous one are skipped
+// Of joined errors only the first one is followed.
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		if text := err.Error(); len(chain) == 0 || chain[len(chain)-1] != text {
+			chain = append(chain, text)
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Unwrap() []error }:
+			errs := e.Unwrap()
+			if len(errs) == 0 {
+				return chain
+			}
+			err = errs[0]
+		default:
+			err = nil
+		}
+	}
+	return chain
+}
+
+// Resubmitter publishes quarantined messages to their original topics again
+type Resubmitter struct {
+	writer Writer
+}
+
+// NewResubmitter create new Resubmitter
+// Accepts:
+//   - cfg: settings of kafka
+//   - writer: writer without its own topic, may be nil to create it from config
+//
+// Returns:
+//   - *Resubmitter
+func NewResubmitter(cfg config.KafkaConfig, writer Writer) *Resubmitter {
+	if writer == nil {
+		writer = &kafka.Writer{
+			Addr:     kafka.TCP(cfg.Brokers...),
+			Balancer: &kafka.Hash{},
+		}
+	}
+	return &Resubmitter{writer: writer}
+}
+
+// Resubmit validates payload of quarantined message and publishes it to original topic
+// Position in quarantine is kept in replayed_from header.
+// Accepts:
+//   - ctx: context
+//   - msg: quarantined message
+//
+// Returns:
+//   - error if something wrong, permanent error if payload is still invalid
+func (r *Resubmitter) Resubmit(ctx context.Context, msg *models.QuarantinedMessage) error {
+	if msg.OriginalTopic == "" {
+		return retry.Permanent(errors.New("message has no original topic"))
+	}
+
+	out := kafka.Message{
+		Topic: msg.OriginalTopic,
+		Key:   []byte(msg.Key),
+		Value: []byte(msg.Payload),
+	}
+	if err := CheckMessage(&out); err != nil {
+		return err
+	}
+
+	for key, value := range msg.Headers {
+		if !isFailureHeader(key) && key != HeaderReplayedFrom {
+			out.Headers = append(out.Headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+	}
+	if header(out.Headers, HeaderSourceTopic) == "" {
+		// message was quarantined without source headers, its stored position is the source
+		out.Headers = setSource(out.Headers, &models.Source{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+	}
+	out.Headers = append(out.Headers, kafka.Header{Key: HeaderReplayedFrom, Value: []byte("quarantine/" + strconv.FormatInt(msg.ID, 10))})
+
+	return r.writer.WriteMessages(ctx, out)
+}
+
+// Close closes writer of resubmitter
+// Returns:
+//   - error if something wrong
+func (r *Resubmitter) Close() error {
+	return r.writer.Close()
+}
@@ -0,0 +1,216 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQuarantine keeps quarantined messages in memory
+type fakeQuarantine struct {
+	mu       sync.Mutex
+	messages []*models.QuarantinedMessage
+	err      error
+}
+
+func (q *fakeQuarantine) Quarantine(_ context.Context, msg *models.QuarantinedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	q.messages = append(q.messages, msg)
+	return nil
+}
+
+func (q *fakeQuarantine) ListQuarantined(context.Context, models.QuarantineFilter) ([]models.QuarantinedMessage, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (q *fakeQuarantine) GetQuarantined(context.Context, int64) (*models.QuarantinedMessage, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (q *fakeQuarantine) UpdateQuarantinedPayload(context.Context, int64, []byte) error {
+	return errors.New("not implemented")
+}
+
+func (q *fakeQuarantine) ResolveQuarantined(context.Context, int64, string) error {
+	return errors.New("not implemented")
+}
+
+func (q *fakeQuarantine) saved() []*models.QuarantinedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]*models.QuarantinedMessage(nil), q.messages...)
+}
+
+func TestConsumer_Run_QuarantinesPoisonMessage(t *testing.T) {
+	broker := newFakeBroker([]byte(`{invalid json}`))
+	broker.messages[0].Key = []byte("order-1")
+	broker.messages[0].Headers = []kafka.Header{{Key: "trace_id", Value: []byte("abc")}}
+
+	cfg := config.Default().Kafka
+	cfg.DeadLetter = config.DeadLetterTable
+	quarantine := &fakeQuarantine{}
+	dlq := &fakeWriter{}
+
+	c, err := NewConsumer(cfg, Deps{Repo: new(MockOrderRepository), Reader: broker.reader(), DLQWriter: dlq, Quarantine: quarantine})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+	assert.NoError(t, <-done)
+
+	assert.Empty(t, dlq.written())
+	require.Len(t, quarantine.saved(), 1)
+	msg := quarantine.saved()[0]
+	assert.Equal(t, "orders", msg.Topic)
+	assert.Equal(t, "orders", msg.OriginalTopic)
+	assert.Equal(t, "order-1", msg.Key)
+	assert.Equal(t, `{invalid json}`, msg.Payload)
+	assert.Equal(t, map[string]string{
+		"trace_id":            "abc",
+		HeaderSourceTopic:     "orders",
+		HeaderSourcePartition: "0",
+		HeaderSourceOffset:    "0",
+	}, msg.Headers)
+	assert.Contains(t, msg.Error, "invalid character")
+	assert.Equal(t, 1, msg.Attempts)
+}
+
+func TestDLQHandler_SendToDLQ_Both(t *testing.T) {
+	quarantine := &fakeQuarantine{}
+	dlq := &fakeWriter{}
+	h := NewDLQHandler(config.Default().Kafka, dlq, nil, quarantine)
+
+	msg := &kafka.Message{
+		Topic:  "orders.retry.10m",
+		Offset: 7,
+		Headers: []kafka.Header{
+			{Key: HeaderOriginalTopic, Value: []byte("orders")},
+			{Key: HeaderRetryAttempt, Value: []byte("3")},
+		},
+	}
+	require.NoError(t, h.sendToDLQ(context.Background(), msg, errors.New("db down")))
+
+	assert.Len(t, dlq.written(), 1)
+	require.Len(t, quarantine.saved(), 1)
+	saved := quarantine.saved()[0]
+	assert.Equal(t, "orders.retry.10m", saved.Topic)
+	assert.Equal(t, int64(7), saved.Offset)
+	assert.Equal(t, "orders", saved.OriginalTopic)
+	// message without source headers is consumed for the first time from retry topic
+	assert.Equal(t, map[string]string{
+		HeaderSourceTopic:     "orders.retry.10m",
+		HeaderSourcePartition: "0",
+		HeaderSourceOffset:    "7",
+	}, saved.Headers)
+	assert.Equal(t, 4, saved.Attempts)
+
+	// message is not committed when it can not be quarantined
+	quarantine.err = errors.New("db down")
+	assert.Error(t, h.sendToDLQ(context.Background(), msg, errors.New("db down")))
+	assert.Len(t, dlq.written(), 1)
+}
+
+func TestNewConsumer_TableRequiresQuarantine(t *testing.T) {
+	cfg := config.Default().Kafka
+	cfg.DeadLetter = config.DeadLetterBoth
+
+	_, err := NewConsumer(cfg, Deps{Repo: new(MockOrderRepository), Reader: newFakeBroker().reader()})
+	assert.Error(t, err)
+}
+
+func TestErrorChain(t *testing.T) {
+	base := errors.New("connection refused")
+	err := fmt.Errorf("insert order: %w", retry.Transient(fmt.Errorf("dial: %w", base)))
+
+	assert.Equal(t, []string{
+		"insert order: dial: connection refused",
+		"dial: connection refused",
+		"connection refused",
+	}, errorChain(err))
+}
+
+func TestResubmitter_Resubmit(t *testing.T) {
+	w := &fakeWriter{}
+	r := NewResubmitter(config.Default().Kafka, w)
+
+	msg := &models.QuarantinedMessage{
+		ID:            42,
+		OriginalTopic: "orders",
+		Key:           "order-1",
+		Payload:       string(validMessageValue(t)),
+		Headers:       map[string]string{"trace_id": "abc"},
+	}
+	require.NoError(t, r.Resubmit(context.Background(), msg))
+
+	require.Len(t, w.written(), 1)
+	out := w.written()[0]
+	assert.Equal(t, "orders", out.Topic)
+	assert.Equal(t, []byte("order-1"), out.Key)
+	assert.Equal(t, "abc", header(out.Headers, "trace_id"))
+	assert.Equal(t, "quarantine/42", header(out.Headers, HeaderReplayedFrom))
+}
+
+func TestDLQHandler_SendToDLQ_KeepsSource(t *testing.T) {
+	quarantine := &fakeQuarantine{}
+	h := NewDLQHandler(config.Default().Kafka, &fakeWriter{}, nil, quarantine)
+
+	msg := &kafka.Message{Topic: "orders.retry.10m", Partition: 2, Offset: 7}
+	msg.Headers = setSource([]kafka.Header{{Key: HeaderOriginalTopic, Value: []byte("orders")}},
+		&models.Source{Topic: "orders", Partition: 1, Offset: 3})
+	require.NoError(t, h.sendToDLQ(context.Background(), msg, errors.New("db down")))
+
+	require.Len(t, quarantine.saved(), 1)
+	w := &fakeWriter{}
+	require.NoError(t, NewResubmitter(config.Default().Kafka, w).Resubmit(context.Background(), &models.QuarantinedMessage{
+		OriginalTopic: "orders",
+		Payload:       string(validMessageValue(t)),
+		Headers:       quarantine.saved()[0].Headers,
+	}))
+
+	require.Len(t, w.written(), 1)
+	out := w.written()[0]
+	assert.Equal(t, &models.Source{Topic: "orders", Partition: 1, Offset: 3}, messageSource(&out))
+}
+
+func TestResubmitter_Resubmit_SourceFromStoredPosition(t *testing.T) {
+	w := &fakeWriter{}
+	r := NewResubmitter(config.Default().Kafka, w)
+
+	require.NoError(t, r.Resubmit(context.Background(), &models.QuarantinedMessage{
+		Topic:         "orders",
+		Partition:     1,
+		Offset:        5,
+		OriginalTopic: "orders",
+		Payload:       string(validMessageValue(t)),
+	}))
+
+	require.Len(t, w.written(), 1)
+	out := w.written()[0]
+	assert.Equal(t, &models.Source{Topic: "orders", Partition: 1, Offset: 5}, messageSource(&out))
+}
+
+func TestResubmitter_Resubmit_InvalidPayload(t *testing.T) {
+	w := &fakeWriter{}
+	r := NewResubmitter(config.Default().Kafka, w)
+
+	err := r.Resubmit(context.Background(), &models.QuarantinedMessage{OriginalTopic: "orders", Payload: `{invalid json}`})
+	assert.True(t, retry.IsPermanent(err))
+	assert.Empty(t, w.written())
+}
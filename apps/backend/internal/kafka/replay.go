@@ -0,0 +1,231 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/Kost0/L0/internal/validation"
+	"github.com/segmentio/kafka-go"
+)
+
+// HeaderReplayedFrom is set on replayed message to position in DLQ it was taken from, e.g. dlq/0/15
+const HeaderReplayedFrom = "replayed_from"
+
+// failureHeaders are removed from replayed message, so it starts from the first attempt again
+var failureHeaders = []string{HeaderOriginalTopic, HeaderError, HeaderTimestamp, HeaderRetryAttempt, HeaderRetryAt, HeaderValidationErrors}
+
+// DeadLetterFilter selects messages of DLQ, zero fields match any message
+type DeadLetterFilter struct {
+	// ErrorContains is substring of error header
+	ErrorContains string
+	// Since and Until limit time of failure, Until is exclusive
+	Since time.Time
+	Until time.Time
+	Key   string
+}
+
+// Match reports whether message of DLQ passes filter
+// Accepts:
+//   - msg: message of DLQ
+//
+// Returns:
+//   - true if message matches all conditions
+func (f DeadLetterFilter) Match(msg *kafka.Message) bool {
+	if f.ErrorContains != "" && !strings.Contains(header(msg.Headers, HeaderError), f.ErrorContains) {
+		return false
+	}
+	if f.Key != "" && string(msg.Key) != f.Key {
+		return false
+	}
+
+	failedAt := FailedAt(msg)
+	if !f.Since.IsZero() && failedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !failedAt.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// FailedAt returns time when message was sent to DLQ, message time if it has no timestamp header
+func FailedAt(msg *kafka.Message) time.Time {
+	if t, err := time.Parse(time.RFC3339, header(msg.Headers, HeaderTimestamp)); err == nil {
+		return t
+	}
+	return msg.Time
+}
+
+// Header returns value of header of message with key, empty if there is no such header
+func Header(msg *kafka.Message, key string) string {
+	return header(msg.Headers, key)
+}
+
+// CheckMessage decodes and validates order of message like consumer does, but without logging
+// Accepts:
+//   - msg: message
+//
+// Returns:
+//   - permanent error if order of message would be rejected
+func CheckMessage(msg *kafka.Message) error {
+	if _, err := validation.Decode(msg.Value); err != nil {
+		return retry.Permanent(err)
+	}
+	return nil
+}
+
+// ReplayMessage returns copy of DLQ message which is published to its original topic again
+// Headers of failure are dropped and position in DLQ is kept in replayed_from header.
+// Accepts:
+//   - msg: message of DLQ
+//   - topic: target topic, empty means original topic of message
+//
+// Returns:
+//   - message to publish
+//   - error if target topic is unknown
+func ReplayMessage(msg *kafka.Message, topic string) (kafka.Message, error) {
+	if topic == "" {
+		topic = header(msg.Headers, HeaderOriginalTopic)
+	}
+	if topic == "" {
+		return kafka.Message{}, fmt.Errorf("message %d/%d has no %s header", msg.Partition, msg.Offset, HeaderOriginalTopic)
+	}
+
+	headers := make([]kafka.Header, 0, len(msg.Headers)+1)
+	for _, h := range msg.Headers {
+		if !isFailureHeader(h.Key) && h.Key != HeaderReplayedFrom {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers, kafka.Header{
+		Key:   HeaderReplayedFrom,
+		Value: []byte(msg.Topic + "/" + strconv.Itoa(msg.Partition) + "/" + strconv.FormatInt(msg.Offset, 10)),
+	})
+
+	return kafka.Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}, nil
+}
+
+func isFailureHeader(key string) bool {
+	for _, k := range failureHeaders {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDeadLetters reads all messages which are in topic at the moment of call
+// Messages are read without consumer group, so reading does not change any offsets.
+// Accepts:
+//   - ctx: context
+//   - brokers: kafka brokers
+//   - topic: dead letter topic
+//   - fn: called for every message, reading stops if it returns error
+//
+// Returns:
+//   - error if something wrong
+func ReadDeadLetters(ctx context.Context, brokers []string, topic string, fn func(msg *kafka.Message) error) error {
+	var partitions []kafka.Partition
+	var broker string
+	var errs []error
+	for _, b := range brokers {
+		var err error
+		if partitions, err = readPartitions(ctx, b, topic); err == nil {
+			broker = b
+			break
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b, err))
+	}
+	if broker == "" {
+		return fmt.Errorf("could not read partitions of %s: %w", topic, errors.Join(errs...))
+	}
+
+	for _, p := range partitions {
+		if err := readPartition(ctx, brokers, broker, topic, p.ID, fn); err != nil {
+			return fmt.Errorf("partition %d: %w", p.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// readIdleTimeout is how long reading of partition waits for the next message
+// Offsets of partition may have gaps, e.g. after compaction or transaction markers,
+// so offset before the end is not always read.
+const readIdleTimeout = 5 * time.Second
+
+// readPartition reads partition, its offsets are asked from broker which answered with partitions
+func readPartition(ctx context.Context, brokers []string, broker, topic string, partition int, fn func(msg *kafka.Message) error) error {
+	first, last, err := offsetRange(ctx, broker, topic, partition)
+	if err != nil {
+		return err
+	}
+	if first >= last {
+		return nil
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokers,
+		Topic:     topic,
+		Partition: partition,
+		MinBytes:  1,
+		MaxBytes:  10e6,
+	})
+	defer r.Close()
+
+	if err = r.SetOffset(first); err != nil {
+		return err
+	}
+
+	return readUntil(ctx, r, last, readIdleTimeout, fn)
+}
+
+// offsetRange returns offset of the first message of partition and offset after the last one
+func offsetRange(ctx context.Context, broker, topic string, partition int) (first, last int64, err error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", broker, topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if errClose := conn.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
+
+	return conn.ReadOffsets()
+}
+
+// readUntil passes messages to fn until offset of reader reaches end
+// Reading also stops when there is no message during idle, because the rest of
+// offsets before end may have no messages.
+func readUntil(ctx context.Context, r Reader, end int64, idle time.Duration, fn func(msg *kafka.Message) error) error {
+	for offset := int64(-1); offset < end; {
+		fetchCtx, cancel := context.WithTimeout(ctx, idle)
+		msg, err := r.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				log.Printf("No messages for %s before offset %d, reading stops", idle, end)
+				return nil
+			}
+			return err
+		}
+		if err = fn(&msg); err != nil {
+			return err
+		}
+		offset = msg.Offset + 1
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deadLetter(key, errText string, failedAt time.Time) *kafka.Message {
+	return &kafka.Message{
+		Topic:     "dlq",
+		Partition: 1,
+		Offset:    15,
+		Key:       []byte(key),
+		Headers: []kafka.Header{
+			{Key: "trace_id", Value: []byte("abc")},
+			{Key: HeaderOriginalTopic, Value: []byte("orders")},
+			{Key: HeaderError, Value: []byte(errText)},
+			{Key: HeaderTimestamp, Value: []byte(failedAt.Format(time.RFC3339))},
+			{Key: HeaderRetryAttempt, Value: []byte("3")},
+		},
+	}
+}
+
+func TestDeadLetterFilter_Match(t *testing.T) {
+	failedAt := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := deadLetter("order-1", "pq: deadlock detected", failedAt)
+
+	tests := []struct {
+		name   string
+		filter DeadLetterFilter
+		match  bool
+	}{
+		{"empty", DeadLetterFilter{}, true},
+		{"error", DeadLetterFilter{ErrorContains: "deadlock"}, true},
+		{"other error", DeadLetterFilter{ErrorContains: "invalid character"}, false},
+		{"key", DeadLetterFilter{Key: "order-1"}, true},
+		{"other key", DeadLetterFilter{Key: "order-2"}, false},
+		{"in range", DeadLetterFilter{Since: failedAt, Until: failedAt.Add(time.Hour)}, true},
+		{"before range", DeadLetterFilter{Since: failedAt.Add(time.Second)}, false},
+		{"until is exclusive", DeadLetterFilter{Until: failedAt}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, tt.filter.Match(msg))
+		})
+	}
+}
+
+func TestFailedAt_WithoutHeader(t *testing.T) {
+	msg := &kafka.Message{Time: time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)}
+	assert.Equal(t, msg.Time, FailedAt(msg))
+}
+
+func TestReplayMessage(t *testing.T) {
+	msg := deadLetter("order-1", "db down", time.Now())
+	msg.Value = []byte(`{}`)
+
+	replayed, err := ReplayMessage(msg, "")
+	require.NoError(t, err)
+	assert.Equal(t, "orders", replayed.Topic)
+	assert.Equal(t, msg.Key, replayed.Key)
+	assert.Equal(t, msg.Value, replayed.Value)
+	assert.Equal(t, []kafka.Header{
+		{Key: "trace_id", Value: []byte("abc")},
+		{Key: HeaderReplayedFrom, Value: []byte("dlq/1/15")},
+	}, replayed.Headers)
+
+	replayed, err = ReplayMessage(msg, "orders-v2")
+	require.NoError(t, err)
+	assert.Equal(t, "orders-v2", replayed.Topic)
+
+	_, err = ReplayMessage(&kafka.Message{Topic: "dlq"}, "")
+	assert.Error(t, err)
+
+	// position of the first delivery survives replay
+	msg.Headers = setSource(msg.Headers, &models.Source{Topic: "orders", Partition: 1, Offset: 3})
+	replayed, err = ReplayMessage(msg, "")
+	require.NoError(t, err)
+	replayed.Offset = 99
+	assert.Equal(t, &models.Source{Topic: "orders", Partition: 1, Offset: 3}, messageSource(&replayed))
+}
+
+func TestCheckMessage(t *testing.T) {
+	// dlqctl checks every replayed message, payloads must not be logged
+	buf := bytes.Buffer{}
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	assert.NoError(t, CheckMessage(&kafka.Message{Value: validMessageValue(t)}))
+
+	data := createValidData()
+	email := "not an email"
+	data.Delivery.Email = &email
+	err := CheckMessage(&kafka.Message{Value: validMessageValueOf(t, data)})
+	assert.True(t, retry.IsPermanent(err))
+	assert.Empty(t, buf.String())
+}
+
+func TestReadUntil(t *testing.T) {
+	broker := newFakeBroker([]byte("1"), []byte("2"), []byte("3"))
+
+	var read []string
+	err := readUntil(context.Background(), broker.reader(), 2, time.Second, func(msg *kafka.Message) error {
+		read = append(read, string(msg.Value))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, read)
+}
+
+func TestReadUntil_StopsWhenOffsetsHaveGap(t *testing.T) {
+	broker := newFakeBroker([]byte("1"), []byte("2"))
+
+	// offset 2 is transaction marker, it is never fetched
+	var read []string
+	err := readUntil(context.Background(), broker.reader(), 3, 50*time.Millisecond, func(msg *kafka.Message) error {
+		read = append(read, string(msg.Value))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, read)
+}
+
+func TestReadUntil_CancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := readUntil(ctx, newFakeBroker().reader(), 1, time.Second, func(*kafka.Message) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/segmentio/kafka-go"
+)
+
+// retryTier is a retry topic, its messages are processed not earlier than delay after failure
+type retryTier struct {
+	topic string
+	delay time.Duration
+}
+
+func retryTiers(cfg config.KafkaConfig) []retryTier {
+	tiers := make([]retryTier, len(cfg.RetryTiers))
+	for i, delay := range cfg.RetryTiers {
+		tiers[i] = retryTier{topic: RetryTopic(cfg.Topic, delay), delay: delay}
+	}
+	return tiers
+}
+
+// RetryTopic returns name of retry topic of tier with delay, e.g. orders.retry.10s, orders.retry.1m
+// Accepts:
+//   - topic: main topic
+//   - delay: delay of tier
+//
+// Returns:
+//   - name of retry topic
+func RetryTopic(topic string, delay time.Duration) string {
+	return topic + ".retry." + delaySuffix(delay)
+}
+
+// RetryGroup returns consumer group of retry topic of tier with delay, e.g. orders-group.retry.10s
+// Every tier has its own group, so the main group does not rebalance and does not
+// commit offsets of retry topics.
+// Accepts:
+//   - groupID: consumer group of main topic
+//   - delay: delay of tier
+//
+// Returns:
+//   - consumer group of retry topic
+func RetryGroup(groupID string, delay time.Duration) string {
+	return groupID + ".retry." + delaySuffix(delay)
+}
+
+func delaySuffix(delay time.Duration) string {
+	switch {
+	case delay%time.Hour == 0:
+		return fmt.Sprintf("%dh", delay/time.Hour)
+	case delay%time.Minute == 0:
+		return fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		return fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		return fmt.Sprintf("%dms", delay/time.Millisecond)
+	}
+}
+
+// retryAttempt returns number of retry topics message went through
+func retryAttempt(msg *kafka.Message) int {
+	attempt, err := strconv.Atoi(header(msg.Headers, HeaderRetryAttempt))
+	if err != nil || attempt < 0 {
+		return 0
+	}
+	return attempt
+}
+
+// NewRetryConsumer create Consumer of retry topic of tier
+// It waits until delay of tier passes after failure of a message and processes it again.
+// Messages failed again are sent to the next tier or to DLQ.
+// Consumer reads retry topic in its own group, see RetryGroup.
+// Accepts:
+//   - cfg: settings of kafka
+//   - tier: index of delay in cfg.RetryTiers
+//   - deps: dependencies, Reader must read retry topic if it is set
+//
+// Returns:
+//   - *Consumer
+//   - error if something wrong
+func NewRetryConsumer(cfg config.KafkaConfig, tier int, deps Deps) (*Consumer, error) {
+	if tier < 0 || tier >= len(cfg.RetryTiers) {
+		return nil, fmt.Errorf("kafka consumer: unknown retry tier %d", tier)
+	}
+	delay := cfg.RetryTiers[tier]
+
+	return newConsumer(cfg, RetryTopic(cfg.Topic, delay), RetryGroup(cfg.GroupID, delay), delay, deps)
+}
+
+// waitRetry waits until message of retry topic may be processed
+// Delay is counted from retry_at header, or from message time if there is no header,
+// and is never longer than delay of tier, so clock skew does not stop the consumer.
+func (c *Consumer) waitRetry(ctx context.Context, msg *kafka.Message) error {
+	at, err := time.Parse(time.RFC3339Nano, header(msg.Headers, HeaderRetryAt))
+	if err != nil {
+		if msg.Time.IsZero() {
+			return nil
+		}
+		at = msg.Time.Add(c.delay)
+	}
+
+	wait := min(time.Until(at), c.delay)
+	if wait <= 0 {
+		return nil
+	}
+
+	log.Printf("Message %d/%d of %s is retried in %s", msg.Partition, msg.Offset, msg.Topic, wait.Round(time.Millisecond))
+	return retry.Sleep(ctx, wait)
+}
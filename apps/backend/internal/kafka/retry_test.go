@@ -0,0 +1,183 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newRetryConfig(tiers ...time.Duration) config.KafkaConfig {
+	cfg := config.Default().Kafka
+	cfg.Topic = "orders"
+	cfg.MaxRetries = 1
+	cfg.RetryDelay = time.Millisecond
+	cfg.RetryTiers = tiers
+	return cfg
+}
+
+func TestRetryTopic(t *testing.T) {
+	assert.Equal(t, "orders.retry.10s", RetryTopic("orders", 10*time.Second))
+	assert.Equal(t, "orders.retry.1m", RetryTopic("orders", time.Minute))
+	assert.Equal(t, "orders.retry.90s", RetryTopic("orders", 90*time.Second))
+	assert.Equal(t, "orders.retry.2h", RetryTopic("orders", 2*time.Hour))
+	assert.Equal(t, "orders.retry.500ms", RetryTopic("orders", 500*time.Millisecond))
+}
+
+func TestRetryGroup(t *testing.T) {
+	assert.Equal(t, "orders-group.retry.10s", RetryGroup("orders-group", 10*time.Second))
+	assert.Equal(t, "orders-group.retry.1m", RetryGroup("orders-group", time.Minute))
+}
+
+func TestNewRetryConsumer_OwnGroup(t *testing.T) {
+	cfg := newRetryConfig(10*time.Second, time.Minute)
+
+	main, err := NewConsumer(cfg, Deps{Repo: new(MockOrderRepository), Reader: newFakeBroker().reader()})
+	require.NoError(t, err)
+	assert.Equal(t, cfg.GroupID, main.groupID)
+
+	tier, err := NewRetryConsumer(cfg, 1, Deps{Repo: new(MockOrderRepository), Reader: newFakeBroker().reader()})
+	require.NoError(t, err)
+	assert.Equal(t, "orders.retry.1m", tier.topic)
+	assert.Equal(t, cfg.GroupID+".retry.1m", tier.groupID)
+}
+
+func TestDLQHandler_ProcessWithRetry_GoesThroughTiers(t *testing.T) {
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).Return(false, errors.New("db down"))
+
+	dlq, retries := &fakeWriter{}, &fakeWriter{}
+	h := NewDLQHandler(newRetryConfig(time.Minute, 10*time.Minute), dlq, retries, nil)
+	msg := kafka.Message{Topic: "orders", Key: []byte("key"), Value: validMessageValue(t)}
+
+	start := time.Now()
+	_, _, err := h.ProcessWithRetry(context.Background(), repo, &msg)
+	require.NoError(t, err)
+	require.Len(t, retries.written(), 1)
+
+	first := retries.written()[0]
+	assert.Equal(t, "orders.retry.1m", first.Topic)
+	assert.Equal(t, []byte("key"), first.Key)
+	assert.Equal(t, "1", header(first.Headers, HeaderRetryAttempt))
+	assert.Equal(t, "orders", header(first.Headers, HeaderOriginalTopic))
+	assert.Equal(t, "db down", header(first.Headers, HeaderError))
+	retryAt, err := time.Parse(time.RFC3339Nano, header(first.Headers, HeaderRetryAt))
+	require.NoError(t, err)
+	assert.WithinDuration(t, start.Add(time.Minute), retryAt, time.Second)
+
+	_, _, err = h.ProcessWithRetry(context.Background(), repo, &first)
+	require.NoError(t, err)
+	require.Len(t, retries.written(), 2)
+
+	second := retries.written()[1]
+	assert.Equal(t, "orders.retry.10m", second.Topic)
+	assert.Equal(t, "2", header(second.Headers, HeaderRetryAttempt))
+	assert.Equal(t, "orders", header(second.Headers, HeaderOriginalTopic))
+	assert.Len(t, second.Headers, len(first.Headers))
+	assert.Empty(t, dlq.written())
+
+	// after the last tier message is dead-lettered
+	_, _, err = h.ProcessWithRetry(context.Background(), repo, &second)
+	require.NoError(t, err)
+	require.Len(t, dlq.written(), 1)
+	assert.Empty(t, dlq.written()[0].Topic)
+	assert.Equal(t, "orders", header(dlq.written()[0].Headers, HeaderOriginalTopic))
+	assert.Len(t, retries.written(), 2)
+}
+
+func TestDLQHandler_ProcessWithRetry_KeepsSourcePosition(t *testing.T) {
+	source := &models.Source{Topic: "orders", Partition: 2, Offset: 40}
+	isSource := func(data *models.CombinedData) bool { return assert.ObjectsAreEqual(source, data.Source) }
+
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.MatchedBy(isSource)).Return(false, errors.New("db down")).Once()
+	repo.On("InsertWithRetry", mock.Anything, mock.MatchedBy(isSource)).Return(true, nil).Once()
+
+	retries := &fakeWriter{}
+	h := NewDLQHandler(newRetryConfig(time.Minute), &fakeWriter{}, retries, nil)
+	msg := kafka.Message{Topic: "orders", Partition: 2, Offset: 40, Value: validMessageValue(t)}
+
+	_, _, err := h.ProcessWithRetry(context.Background(), repo, &msg)
+	require.NoError(t, err)
+	require.Len(t, retries.written(), 1)
+
+	// retried message is compared with stored version by its position in main topic
+	retried := retries.written()[0]
+	retried.Partition, retried.Offset = 0, 7
+	assert.Equal(t, source, messageSource(&retried))
+
+	data, _, err := h.ProcessWithRetry(context.Background(), repo, &retried)
+	require.NoError(t, err)
+	assert.Equal(t, source, data.Source)
+	repo.AssertExpectations(t)
+}
+
+func TestDLQHandler_ProcessWithRetry_PoisonMessageSkipsTiers(t *testing.T) {
+	dlq, retries := &fakeWriter{}, &fakeWriter{}
+	h := NewDLQHandler(newRetryConfig(time.Minute), dlq, retries, nil)
+	msg := kafka.Message{Topic: "orders", Value: []byte(`{invalid json}`)}
+
+	_, _, err := h.ProcessWithRetry(context.Background(), new(MockOrderRepository), &msg)
+	assert.NoError(t, err)
+	assert.Len(t, dlq.written(), 1)
+	assert.Empty(t, retries.written())
+}
+
+func TestRetryConsumer_WaitsForDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+
+	broker := newFakeBroker(validMessageValue(t))
+	retryAt := time.Now().Add(100 * time.Millisecond)
+	broker.messages[0].Topic = RetryTopic("orders", delay)
+	broker.messages[0].Headers = []kafka.Header{
+		{Key: HeaderRetryAttempt, Value: []byte("1")},
+		{Key: HeaderRetryAt, Value: []byte(retryAt.Format(time.RFC3339Nano))},
+	}
+
+	var insertedAt time.Time
+	repo := new(MockOrderRepository)
+	repo.On("InsertWithRetry", mock.Anything, mock.Anything).
+		Run(func(mock.Arguments) { insertedAt = time.Now() }).
+		Return(true, nil)
+
+	c, err := NewRetryConsumer(newRetryConfig(delay), 0, Deps{Repo: repo, Reader: broker.reader(), DLQWriter: &fakeWriter{}, RetryWriter: &fakeWriter{}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	waitFor(t, func() bool { return broker.committedOffset() == 1 })
+	cancel()
+
+	assert.NoError(t, <-done)
+	assert.False(t, insertedAt.Before(retryAt))
+}
+
+func TestRetryConsumer_ShutdownWhileWaiting(t *testing.T) {
+	broker := newFakeBroker(validMessageValue(t))
+	broker.messages[0].Headers = []kafka.Header{
+		{Key: HeaderRetryAt, Value: []byte(time.Now().Add(time.Hour).Format(time.RFC3339Nano))},
+	}
+
+	c, err := NewRetryConsumer(newRetryConfig(time.Hour), 0, Deps{Repo: new(MockOrderRepository), Reader: broker.reader(), DLQWriter: &fakeWriter{}, RetryWriter: &fakeWriter{}})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, c.Run(ctx))
+	assert.Equal(t, int64(0), broker.committedOffset())
+}
+
+func TestNewRetryConsumer_UnknownTier(t *testing.T) {
+	_, err := NewRetryConsumer(newRetryConfig(time.Minute), 1, Deps{Repo: new(MockOrderRepository)})
+	assert.Error(t, err)
+}
@@ -77,4 +77,140 @@ type CombinedData struct {
 	Delivery Delivery `json:"delivery"`
 	// items information
 	Items []Item `json:"items"`
+	// Source is the kafka message the data came from, it is not part of the payload
+	Source *Source `json:"-"`
+}
+
+// Source provides position of kafka message
+type Source struct {
+	Topic     string
+	Partition int
+	Offset    int64
+}
+
+// OrderVersion presents one saved version of the order
+// @Description Version of the order with the kafka message it came from
+type OrderVersion struct {
+	// Number of version, starting from 1
+	Version int `json:"version"`
+	// Time when version was saved
+	CreatedAt time.Time `json:"createdAt"`
+	// Kafka topic of message
+	Topic *string `json:"topic"`
+	// Kafka partition of message
+	Partition *int `json:"partition"`
+	// Kafka offset of message
+	Offset *int64 `json:"offset"`
+	// Data of the order in this version
+	Data CombinedData `json:"data"`
+}
+
+// OrderFilter presents conditions of order search, empty fields are not used
+type OrderFilter struct {
+	CustomerID      string
+	TrackNumber     string
+	DeliveryService string
+	// CreatedFrom is inclusive lower bound of date_created
+	CreatedFrom *time.Time
+	// CreatedTo is exclusive upper bound of date_created
+	CreatedTo *time.Time
+	Brand     string
+	NmID      *int
+	Email     string
+	Phone     string
+	// Sort is name of sort field, prefixed with "-" for descending order
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// OrderPage presents one page of found orders
+// @Description Page of orders and cursor of the next page
+type OrderPage struct {
+	// Found orders
+	Orders []*CombinedData `json:"orders"`
+	// Cursor of the next page, empty if this page is the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ErrorResponse presents error returned by API
+// @Description Error returned by all endpoints of API
+type ErrorResponse struct {
+	// Machine readable code of error: invalid_argument, unauthenticated, not_found, conflict, timeout or internal
+	Code string `json:"code" example:"not_found"`
+	// Human readable description of error
+	Message string `json:"message" example:"order not found"`
+	// ID of request, also returned in X-Request-Id header
+	RequestID string `json:"requestID,omitempty" example:"host/abcdef-000001"`
+	// Additional information, e.g. invalid parameters
+	Details map[string]string `json:"details,omitempty"`
+	// Failed fields of order, returned when order is invalid
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError presents one failed field of order
+// @Description Failed field of order
+type FieldError struct {
+	// JSON path of field, empty if payload can not be parsed at all
+	Path string `json:"path" example:"items[2].price"`
+	// Code of failed rule: required, email, not_future, non_negative, type, syntax, ...
+	Rule string `json:"rule" example:"non_negative"`
+	// Human readable description of error
+	Message string `json:"message" example:"must not be negative"`
+}
+
+// ValidationResult presents result of successful order validation
+// Invalid order is described by ErrorResponse with every failed field.
+// @Description Result of successful order validation
+type ValidationResult struct {
+	Valid bool `json:"valid" example:"true"`
+}
+
+// Statuses of quarantined message
+const (
+	QuarantineStatusQuarantined = "quarantined"
+	QuarantineStatusResubmitted = "resubmitted"
+	QuarantineStatusDiscarded   = "discarded"
+)
+
+// QuarantinedMessage presents message which could not be processed and is kept for support team
+// @Description Failed kafka message stored in database
+type QuarantinedMessage struct {
+	ID int64 `json:"id" example:"42"`
+	// Kafka topic, partition and offset of failed message
+	Topic     string `json:"topic" example:"orders.retry.10m"`
+	Partition int    `json:"partition" example:"0"`
+	Offset    int64  `json:"offset" example:"15"`
+	// Topic message was originally published to, message is resubmitted to it
+	OriginalTopic string `json:"originalTopic" example:"orders"`
+	Key           string `json:"key"`
+	// Raw payload of message, it may be edited before resubmit
+	Payload string            `json:"payload"`
+	Headers map[string]string `json:"headers"`
+	// Error of the last attempt and errors it wraps
+	Error      string   `json:"error" example:"pq: deadlock detected"`
+	ErrorChain []string `json:"errorChain"`
+	// Number of deliveries of message to consumer
+	Attempts int `json:"attempts" example:"4"`
+	// Status: quarantined, resubmitted or discarded
+	Status    string    `json:"status" example:"quarantined"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// QuarantineFilter presents conditions of quarantined messages list
+type QuarantineFilter struct {
+	// Status of messages, empty means any status
+	Status string
+	// BeforeID selects messages with smaller ID, it is ID of the last message of previous page
+	BeforeID int64
+	Limit    int
+}
+
+// QuarantinePage presents one page of quarantined messages
+// @Description Page of quarantined messages, newest first
+type QuarantinePage struct {
+	Messages []QuarantinedMessage `json:"messages"`
+	// ID to pass as before parameter to get the next page, 0 if this page is the last one
+	NextBefore int64 `json:"nextBefore,omitempty"`
 }
@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/lib/pq"
+)
+
+// maxParams is the limit of parameters in one postgres statement
+const maxParams = 65535
+
+const (
+	insertDeliveryPrefix = `INSERT INTO delivery (id, name, phone, zip, city, address, region, email)`
+	insertOrderPrefix    = `INSERT INTO orders (order_uid, track_number, entry, delivery_id, locale, internal_signature, customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard, payload_hash, version)`
+	insertPaymentPrefix  = `INSERT INTO payment (transaction, request_id, currency, provider, amount, payment_dt, bank, delivery_cost, goods_total, custom_fee)`
+	insertItemPrefix     = `INSERT INTO items (chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status)`
+	insertVersionPrefix  = `INSERT INTO order_versions (order_uid, version, payload, kafka_topic, kafka_partition, kafka_offset)`
+)
+
+// querySelectStoredBatch is querySelectStored for several orders
+const querySelectStoredBatch = `
+SELECT o.order_uid, o.payload_hash, o.version, v.kafka_topic, v.kafka_partition, v.kafka_offset
+FROM orders o
+LEFT JOIN order_versions v ON v.order_uid = o.order_uid AND v.version = o.version
+WHERE o.order_uid = ANY($1::uuid[])
+FOR UPDATE OF o;
+`
+
+// InsertOrders insert several orders to database in one transaction
+// New orders are written by multi-row statements, orders which are already
+// in database are merged one by one like in InsertOrder.
+// Accepts:
+//   - ctx: context
+//   - orders: all data about orders
+//
+// Returns:
+//   - for every order true if its data is inserted or updated, false if database keeps previous data
+//   - error if something wrong, then nothing is saved
+func (r *SQLOrderRepository) InsertOrders(ctx context.Context, orders []*models.CombinedData) ([]bool, error) {
+	if len(orders) == 0 {
+		return nil, nil
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := selectStored(ctx, tx, orders)
+	if err != nil {
+		return nil, rollback(tx, err)
+	}
+
+	b := &batchRows{pending: map[string]bool{}}
+	results := map[string]int64{}
+	applied := make([]bool, len(orders))
+	for i, data := range orders {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return nil, rollback(tx, err)
+		}
+		hash := payloadHash(payload)
+		uid := data.Order.OrderUID
+
+		// previous data of the same order must be in database before merge
+		if b.pending[uid] {
+			if err = b.flush(ctx, tx); err != nil {
+				return nil, rollback(tx, err)
+			}
+		}
+
+		if st, ok := stored[uid]; ok {
+			result, version, err := r.mergeOrder(ctx, tx, data, payload, hash, st)
+			if err != nil {
+				return nil, rollback(tx, err)
+			}
+			results[result]++
+			if result == mergeUpdated {
+				stored[uid] = newStoredOrder(data, hash, version)
+				applied[i] = true
+			}
+			continue
+		}
+
+		b.add(data, payload, hash)
+		stored[uid] = newStoredOrder(data, hash, 1)
+		applied[i] = true
+	}
+
+	if err = b.flush(ctx, tx); err != nil {
+		return nil, rollback(tx, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	// failed batch is processed again message by message, so results are counted only after commit
+	for result, n := range results {
+		ingestStats.Add(result, n)
+	}
+	log.Printf("Batch of %d orders inserted in db", len(orders))
+	return applied, nil
+}
+
+// selectStored locks orders of the batch which are already in database
+func selectStored(ctx context.Context, tx *sql.Tx, orders []*models.CombinedData) (stored map[string]storedOrder, err error) {
+	uids := make([]string, 0, len(orders))
+	for _, data := range orders {
+		uids = append(uids, data.Order.OrderUID)
+	}
+
+	rows, err := tx.QueryContext(ctx, querySelectStoredBatch, pq.Array(uids))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = errClose
+		}
+	}()
+
+	stored = map[string]storedOrder{}
+	for rows.Next() {
+		uid := ""
+		st := storedOrder{}
+		if err = rows.Scan(append([]any{&uid}, st.dest()...)...); err != nil {
+			return nil, err
+		}
+		stored[uid] = st
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// batchRows collects rows of new orders for multi-row statements
+type batchRows struct {
+	pending    map[string]bool
+	deliveries [][]any
+	orders     [][]any
+	payments   [][]any
+	items      [][]any
+	versions   [][]any
+}
+
+func (b *batchRows) add(data *models.CombinedData, payload []byte, hash string) {
+	b.pending[data.Order.OrderUID] = true
+	b.deliveries = append(b.deliveries, deliveryArgs(&data.Delivery))
+	b.orders = append(b.orders, orderArgs(&data.Order, hash, 1))
+	b.payments = append(b.payments, paymentArgs(&data.Payment))
+	for i := range data.Items {
+		b.items = append(b.items, itemArgs(&data.Items[i]))
+	}
+	b.versions = append(b.versions, versionArgs(data, payload, 1))
+}
+
+// flush writes collected rows, order of tables follows foreign keys
+func (b *batchRows) flush(ctx context.Context, tx *sql.Tx) error {
+	for _, table := range []struct {
+		prefix string
+		rows   [][]any
+	}{
+		{insertDeliveryPrefix, b.deliveries},
+		{insertOrderPrefix, b.orders},
+		{insertPaymentPrefix, b.payments},
+		{insertItemPrefix, b.items},
+		{insertVersionPrefix, b.versions},
+	} {
+		if err := execMultiInsert(ctx, tx, table.prefix, table.rows); err != nil {
+			return err
+		}
+	}
+
+	*b = batchRows{pending: map[string]bool{}}
+	return nil
+}
+
+// execMultiInsert inserts rows by statements with several VALUES tuples
+func execMultiInsert(ctx context.Context, tx *sql.Tx, prefix string, rows [][]any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	perStatement := maxParams / len(rows[0])
+	for start := 0; start < len(rows); start += perStatement {
+		end := min(start+perStatement, len(rows))
+
+		query := strings.Builder{}
+		query.WriteString(prefix)
+		query.WriteString(" VALUES ")
+		args := make([]any, 0, (end-start)*len(rows[0]))
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for j := range row {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				fmt.Fprintf(&query, "$%d", len(args)+j+1)
+			}
+			query.WriteString(")")
+			args = append(args, row...)
+		}
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
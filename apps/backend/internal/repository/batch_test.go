@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func expectStoredBatch(mock sqlmock.Sqlmock, stored ...*models.CombinedData) {
+	rows := sqlmock.NewRows([]string{"order_uid", "payload_hash", "version", "kafka_topic", "kafka_partition", "kafka_offset"})
+	for _, data := range stored {
+		rows.AddRow(data.Order.OrderUID, "other", 2, nil, nil, nil)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.order_uid, o.payload_hash, o.version(.+)WHERE o.order_uid = ANY").WillReturnRows(rows)
+}
+
+func TestSQLOrderRepository_InsertOrders_NewOrders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	first, second := createValidData(), createValidData()
+
+	expectStoredBatch(mock)
+	mock.ExpectExec(`INSERT INTO delivery \(.+\) VALUES \(\$1, .+, \$8\), \(\$9, .+, \$16\)$`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO orders \(.+\) VALUES \(.+\), \(.+\)$`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO payment \(.+\) VALUES \(.+\), \(.+\)$`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO items \(.+\) VALUES \(.+\), \(.+\)$`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO order_versions \(.+\) VALUES \(.+\), \(.+\)$`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	_, err = repo.InsertOrders(context.Background(), []*models.CombinedData{first, second})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrders_MergesExisting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	existing := createValidData()
+	fresh := createValidData()
+
+	expectStoredBatch(mock, existing)
+	mock.ExpectExec("DELETE FROM items").WithArgs(existing.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WithArgs(existing.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO delivery (.+) ON CONFLICT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE orders SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO delivery \(.+\) VALUES`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	applied, err := repo.InsertOrders(context.Background(), []*models.CombinedData{existing, fresh})
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true}, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrders_RolledBackMergeNotCounted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	existing := createValidData()
+	before := ingestCount("updated")
+
+	expectStoredBatch(mock, existing)
+	mock.ExpectExec("DELETE FROM items").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO delivery (.+) ON CONFLICT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE orders SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO delivery \(.+\) VALUES`).WillReturnError(errors.New("db down"))
+	mock.ExpectRollback()
+
+	_, err = repo.InsertOrders(context.Background(), []*models.CombinedData{existing, createValidData()})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, before, ingestCount("updated"))
+}
+
+func TestSQLOrderRepository_InsertOrders_FailureRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	expectStoredBatch(mock)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO orders").WillReturnError(errors.New("db down"))
+	mock.ExpectRollback()
+
+	_, err = repo.InsertOrders(context.Background(), []*models.CombinedData{createValidData(), createValidData()})
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrders_CancelledContextRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	expectStoredBatch(mock)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO orders").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = repo.InsertOrders(ctx, []*models.CombinedData{createValidData(), createValidData()})
+	assert.Error(t, err)
+	expectRolledBack(t, mock)
+}
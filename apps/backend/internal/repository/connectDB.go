@@ -3,21 +3,19 @@ package repository
 import (
 	"database/sql"
 	"fmt"
-	"os"
+
+	"github.com/Kost0/L0/internal/config"
 )
 
 // ConnectDB connects to the database
+// Accepts:
+//   - cfg: settings of connection
+//
 // Returns:
 //   - pointer on database
 //   - error if something wrong
-func ConnectDB() (*sql.DB, error) {
-	dbHost := os.Getenv("DB_HOST")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	dbPort := os.Getenv("DB_PORT")
-
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
+func ConnectDB(cfg config.DBConfig) (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s", cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name, cfg.SSLMode)
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
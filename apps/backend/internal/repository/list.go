@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/google/uuid"
+)
+
+// Limits of page size of ListOrders
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// DefaultListSort is sort of ListOrders when filter has no sort, newest orders first
+const DefaultListSort = "-date_created"
+
+// ErrInvalidFilter is returned by ListOrders when filter has unknown sort or broken cursor
+var ErrInvalidFilter = errors.New("invalid order filter")
+
+// sortField describes column which orders can be sorted by
+type sortField struct {
+	column string
+	// value returns value of column of order, stored in cursor
+	value func(data *models.CombinedData) string
+	// arg converts value from cursor to query argument
+	arg func(value string) (any, error)
+}
+
+var sortFields = map[string]sortField{
+	"date_created": {
+		column: "o.date_created",
+		value: func(data *models.CombinedData) string {
+			if data.Order.DateCreated == nil {
+				return ""
+			}
+			return data.Order.DateCreated.Format(time.RFC3339Nano)
+		},
+		arg: func(value string) (any, error) {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			return t.UTC(), err
+		},
+	},
+	"track_number": {
+		column: "o.track_number",
+		value: func(data *models.CombinedData) string {
+			if data.Order.TrackNumber == nil {
+				return ""
+			}
+			return *data.Order.TrackNumber
+		},
+		arg: func(value string) (any, error) {
+			return value, nil
+		},
+	},
+}
+
+// listCursor is position of the last order of page
+// Sort is kept in cursor, so cursor can not be used with other sort.
+type listCursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	OrderUID string `json:"id"`
+}
+
+func encodeCursor(c listCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	c := listCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// ListOrders select page of orders matching filter
+// Orders are paginated by cursor: position of the last order of page,
+// so pages do not shift when new orders are inserted.
+// Accepts:
+//   - ctx: context
+//   - filter: conditions, sort, page size and cursor
+//
+// Returns:
+//   - page of orders with cursor of the next page
+//   - error if something wrong, ErrInvalidFilter if filter can not be used
+func (r *SQLOrderRepository) ListOrders(ctx context.Context, filter models.OrderFilter) (page *models.OrderPage, err error) {
+	sort := filter.Sort
+	if sort == "" {
+		sort = DefaultListSort
+	}
+	desc := strings.HasPrefix(sort, "-")
+	field, ok := sortFields[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %q", ErrInvalidFilter, sort)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	var conds []string
+	var args []any
+	// where adds condition, %d in cond is replaced by number of argument
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.CustomerID != "" {
+		where("o.customer_id = $%d", filter.CustomerID)
+	}
+	if filter.TrackNumber != "" {
+		where("o.track_number = $%d", filter.TrackNumber)
+	}
+	if filter.DeliveryService != "" {
+		where("o.delivery_service = $%d", filter.DeliveryService)
+	}
+	// date_created is timestamp without time zone in UTC, and database would drop offset
+	// of time instead of converting it
+	if filter.CreatedFrom != nil {
+		where("o.date_created >= $%d", filter.CreatedFrom.UTC())
+	}
+	if filter.CreatedTo != nil {
+		where("o.date_created < $%d", filter.CreatedTo.UTC())
+	}
+	if filter.Brand != "" {
+		where("EXISTS (SELECT 1 FROM items i WHERE i.track_number = o.track_number AND i.brand = $%d)", filter.Brand)
+	}
+	if filter.NmID != nil {
+		where("EXISTS (SELECT 1 FROM items i WHERE i.track_number = o.track_number AND i.nm_id = $%d)", *filter.NmID)
+	}
+	if filter.Email != "" {
+		where("d.email = $%d", filter.Email)
+	}
+	if filter.Phone != "" {
+		where("d.phone = $%d", filter.Phone)
+	}
+
+	if filter.Cursor != "" {
+		cursor, err := decodeCursor(filter.Cursor)
+		if err != nil || cursor.Sort != sort {
+			return nil, fmt.Errorf("%w: broken cursor", ErrInvalidFilter)
+		}
+		if _, err = uuid.Parse(cursor.OrderUID); err != nil {
+			return nil, fmt.Errorf("%w: broken cursor", ErrInvalidFilter)
+		}
+		value, err := field.arg(cursor.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: broken cursor", ErrInvalidFilter)
+		}
+
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		args = append(args, value, cursor.OrderUID)
+		conds = append(conds, fmt.Sprintf("(%s, o.order_uid) %s ($%d, $%d)", field.column, op, len(args)-1, len(args)))
+	}
+
+	query := querySelectOrders
+	if len(conds) > 0 {
+		query += "WHERE " + strings.Join(conds, "\n  AND ") + "\n"
+	}
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	// one more order is selected to know whether there is the next page
+	args = append(args, limit+1)
+	query += fmt.Sprintf("ORDER BY %s %s, o.order_uid %s\nLIMIT $%d", field.column, direction, direction, len(args))
+
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
+
+	page = &models.OrderPage{Orders: []*models.CombinedData{}}
+	for rows.Next() {
+		data, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Orders = append(page.Orders, data)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Orders) > limit {
+		page.Orders = page.Orders[:limit]
+		last := page.Orders[limit-1]
+		page.NextCursor = encodeCursor(listCursor{
+			Sort:     sort,
+			Value:    field.value(last),
+			OrderUID: last.Order.OrderUID,
+		})
+	}
+
+	return page, nil
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orderRows returns rows of querySelectOrders with orders created a minute apart
+func orderRows(created time.Time, ids ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{
+		"order_uid", "track_number", "entry", "delivery_id", "locale", "internal_signature", "customer_id", "delivery_service", "shardkey", "sm_id", "date_created", "oof_shard",
+		"id", "name", "phone", "zip", "city", "address", "region", "email",
+		"transaction", "request_id", "currency", "provider", "amount", "payment_dt", "bank", "delivery_cost", "goods_total", "custom_fee",
+		"items",
+	})
+	for i, id := range ids {
+		rows.AddRow(
+			id, "WB-"+id, "WBIL", "del-"+id, "en", "", "cust", "meest", "9", 99, created.Add(-time.Duration(i)*time.Minute), "1",
+			"del-"+id, "Test", "+7", "123", "City", "Addr", "Region", "test@com",
+			id, "", "USD", "wb", 100, 123, "alpha", 50, 50, 0,
+			"[]",
+		)
+	}
+	return rows
+}
+
+func TestSQLOrderRepository_ListOrders_Filters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	nmID := 2389212
+	mock.ExpectQuery(`WHERE o.customer_id = \$1 AND o.date_created >= \$2 AND EXISTS \(SELECT 1 FROM items i WHERE i.track_number = o.track_number AND i.nm_id = \$3\) AND d.email = \$4 ORDER BY o.date_created DESC, o.order_uid DESC LIMIT \$5`).
+		WithArgs("cust", from, nmID, "test@com", DefaultListLimit+1).
+		WillReturnRows(orderRows(time.Now(), "order-1"))
+
+	page, err := repo.ListOrders(context.Background(), models.OrderFilter{
+		CustomerID:  "cust",
+		CreatedFrom: &from,
+		NmID:        &nmID,
+		Email:       "test@com",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, page.Orders, 1)
+	assert.Empty(t, page.NextCursor)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_ListOrders_Pagination(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	created := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`ORDER BY o.date_created ASC, o.order_uid ASC LIMIT \$1`).
+		WithArgs(3).
+		WillReturnRows(orderRows(created, "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a01", "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a02", "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a03"))
+
+	page, err := repo.ListOrders(context.Background(), models.OrderFilter{Sort: "date_created", Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Orders, 2)
+	require.NotEmpty(t, page.NextCursor)
+
+	mock.ExpectQuery(`WHERE \(o.date_created, o.order_uid\) > \(\$1, \$2\) ORDER BY o.date_created ASC, o.order_uid ASC LIMIT \$3`).
+		WithArgs(created.Add(-time.Minute), "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a02", 3).
+		WillReturnRows(orderRows(created.Add(-2*time.Minute), "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a03"))
+
+	page, err = repo.ListOrders(context.Background(), models.OrderFilter{Sort: "date_created", Limit: 2, Cursor: page.NextCursor})
+	assert.NoError(t, err)
+	assert.Len(t, page.Orders, 1)
+	assert.Empty(t, page.NextCursor)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_ListOrders_TimeWithOffset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	moscow := time.FixedZone("MSK", 3*60*60)
+	from := time.Date(2026, 1, 1, 3, 0, 0, 0, moscow)
+	to := time.Date(2026, 1, 2, 3, 0, 0, 0, moscow)
+	cursor := encodeCursor(listCursor{Sort: "date_created", Value: "2026-01-01T15:00:00+03:00", OrderUID: "b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a01"})
+
+	// date_created is stored in UTC without time zone, so times are converted before binding
+	mock.ExpectQuery(`WHERE o.date_created >= \$1 AND o.date_created < \$2 AND \(o.date_created, o.order_uid\) > \(\$3, \$4\)`).
+		WithArgs(
+			time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+			"b563feb7-b2b8-4b6c-9f3a-7c3d1e2f4a01", DefaultListLimit+1,
+		).
+		WillReturnRows(orderRows(time.Now()))
+
+	_, err = repo.ListOrders(context.Background(), models.OrderFilter{
+		Sort:        "date_created",
+		CreatedFrom: &from,
+		CreatedTo:   &to,
+		Cursor:      cursor,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_ListOrders_InvalidFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+	ctx := context.Background()
+
+	_, err = repo.ListOrders(ctx, models.OrderFilter{Sort: "price"})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	_, err = repo.ListOrders(ctx, models.OrderFilter{Cursor: "not a cursor"})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	// cursor of other sort
+	cursor := encodeCursor(listCursor{Sort: "track_number", Value: "WB", OrderUID: "order-1"})
+	_, err = repo.ListOrders(ctx, models.OrderFilter{Cursor: cursor})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	// order id of cursor is not uuid
+	cursor = encodeCursor(listCursor{Sort: "date_created", Value: "2024-01-01T00:00:00Z", OrderUID: "order-1"})
+	_, err = repo.ListOrders(ctx, models.OrderFilter{Sort: "date_created", Cursor: cursor})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,43 +2,54 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
-	"time"
 
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
+	"github.com/lib/pq"
 )
 
 // SQLOrderRepository provides information about database
 type SQLOrderRepository struct {
-	DB *sql.DB
+	DB  *sql.DB
+	cfg config.RepositoryConfig
 }
 
 // NewOrderRepository create new SQLOrderRepository
 // Accepts:
 //   - db: database
+//   - cfg: settings of retries
 //
 // Returns:
 //   - *SQLOrderRepository
-func NewOrderRepository(db *sql.DB) *SQLOrderRepository {
-	return &SQLOrderRepository{DB: db}
+func NewOrderRepository(db *sql.DB, cfg config.RepositoryConfig) *SQLOrderRepository {
+	return &SQLOrderRepository{DB: db, cfg: cfg}
 }
 
-// InsertOrder insert data to database
-// Accepts:
-//   - data: all data about order
-//
-// Returns:
-//   - error if something wrong
-func (r *SQLOrderRepository) InsertOrder(data *models.CombinedData) error {
-	delivery := data.Delivery
-	payment := data.Payment
-	order := data.Order
-	items := data.Items
+// ErrOrderConflict is returned when order already exists with other data and policy is reject
+var ErrOrderConflict = retry.Permanent(errors.New("order already exists with other data"))
+
+// ingestStats counts results of InsertOrder, published on /debug/vars
+// Results are counted after transaction is finished, so retried attempts are not counted twice.
+var ingestStats = expvar.NewMap("order_ingestion")
 
-	queryDelivery := `
+// Results of merge of order which is already in database
+const (
+	mergeUpdated   = "updated"
+	mergeDuplicate = "duplicate"
+	mergeIgnored   = "ignored"
+	mergeRejected  = "rejected"
+)
+
+const queryInsertDelivery = `
 INSERT INTO delivery (
     id,
     name,
@@ -51,7 +62,28 @@ INSERT INTO delivery (
 ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
 `
 
-	queryPayment := `
+const queryUpsertDelivery = `
+INSERT INTO delivery (
+    id,
+    name,
+    phone,
+    zip,
+    city,
+    address,
+    region,
+    email
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (id) DO UPDATE SET
+    name = EXCLUDED.name,
+    phone = EXCLUDED.phone,
+    zip = EXCLUDED.zip,
+    city = EXCLUDED.city,
+    address = EXCLUDED.address,
+    region = EXCLUDED.region,
+    email = EXCLUDED.email;
+`
+
+const queryInsertPayment = `
 INSERT INTO payment (
     transaction,
     request_id,
@@ -66,7 +98,7 @@ INSERT INTO payment (
 ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
 `
 
-	queryOrder := `
+const queryInsertOrder = `
 INSERT INTO orders (
     order_uid,
     track_number,
@@ -79,10 +111,51 @@ INSERT INTO orders (
     shardkey,
     sm_id,
     date_created,
-    oof_shard
-) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);
+    oof_shard,
+    payload_hash,
+    version
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);
+`
+
+const queryUpdateOrder = `
+UPDATE orders SET
+    track_number = $2,
+    entry = $3,
+    delivery_id = $4,
+    locale = $5,
+    internal_signature = $6,
+    customer_id = $7,
+    delivery_service = $8,
+    shardkey = $9,
+    sm_id = $10,
+    date_created = $11,
+    oof_shard = $12,
+    payload_hash = $13,
+    version = $14
+WHERE order_uid = $1;
+`
+
+const queryInsertVersion = `
+INSERT INTO order_versions (
+    order_uid,
+    version,
+    payload,
+    kafka_topic,
+    kafka_partition,
+    kafka_offset
+) VALUES ($1, $2, $3, $4, $5, $6);
+`
+
+// querySelectStored locks the order and reads kafka source of its current version
+const querySelectStored = `
+SELECT o.payload_hash, o.version, v.kafka_topic, v.kafka_partition, v.kafka_offset
+FROM orders o
+LEFT JOIN order_versions v ON v.order_uid = o.order_uid AND v.version = o.version
+WHERE o.order_uid = $1
+FOR UPDATE OF o;
 `
-	queryItem := `
+
+const queryInsertItem = `
 INSERT INTO items (
     chrt_id,
     track_number,
@@ -98,12 +171,216 @@ INSERT INTO items (
 ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
 `
 
-	tx, err := r.DB.Begin()
+// InsertOrder insert data to database
+// Repeated message with the same data is skipped. If order exists with other data,
+// it is rejected, ignored or overwritten depending on the duplicate policy.
+// Data of message which is not newer than the one of stored version in the same
+// kafka partition is ignored, so redelivered old message does not overwrite newer data.
+// Every accepted data is saved as a new version of the order.
+// Accepts:
+//   - ctx: context, cancelling it aborts the query and rolls back the transaction
+//   - data: all data about order
+//
+// Returns:
+//   - true if data is inserted or updated, false if database keeps its previous data
+//   - error if something wrong
+func (r *SQLOrderRepository) InsertOrder(ctx context.Context, data *models.CombinedData) (bool, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	hash := payloadHash(payload)
+
+	applied, err := r.saveOrder(ctx, data, payload, hash)
+	if isUniqueViolation(err) {
+		// SELECT ... FOR UPDATE can not lock order which is not inserted yet, so concurrent
+		// insert of the same order fails on unique key. The winner is committed by now
+		// and the order is merged with its data.
+		log.Printf("Order %s is inserted concurrently, merging: %v", data.Order.OrderUID, err)
+		applied, err = r.saveOrder(ctx, data, payload, hash)
+	}
+	return applied, err
+}
+
+// saveOrder inserts new order or merges data of stored one in one transaction
+func (r *SQLOrderRepository) saveOrder(ctx context.Context, data *models.CombinedData, payload []byte, hash string) (bool, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
+		return false, err
+	}
+
+	stored, result := storedOrder{}, ""
+	err = tx.QueryRowContext(ctx, querySelectStored, data.Order.OrderUID).Scan(stored.dest()...)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err = insertOrder(ctx, tx, data, hash); err != nil {
+			return false, rollback(tx, err)
+		}
+		if err = insertVersion(ctx, tx, data, payload, 1); err != nil {
+			return false, rollback(tx, err)
+		}
+	case err != nil:
+		return false, rollback(tx, err)
+	default:
+		result, _, err = r.mergeOrder(ctx, tx, data, payload, hash, stored)
+		if err != nil || result != mergeUpdated {
+			err = rollback(tx, err)
+			// rejected order is not retried, so it is counted once as well
+			if result != "" && (err == nil || errors.Is(err, ErrOrderConflict)) {
+				ingestStats.Add(result, 1)
+			}
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	if result != "" {
+		ingestStats.Add(result, 1)
+	}
+	log.Println("Data inserted in db")
+	return true, nil
+}
+
+// storedOrder is the state of order in database used to recognize repeated and stale data
+type storedOrder struct {
+	hash    sql.NullString
+	version int
+	// kafka source of the current version, null for orders saved without it
+	topic     sql.NullString
+	partition sql.NullInt64
+	offset    sql.NullInt64
+}
+
+// dest returns destinations to scan columns of querySelectStored
+func (s *storedOrder) dest() []any {
+	return []any{&s.hash, &s.version, &s.topic, &s.partition, &s.offset}
+}
+
+// newStoredOrder describes order after data is saved as version
+func newStoredOrder(data *models.CombinedData, hash string, version int) storedOrder {
+	st := storedOrder{hash: sql.NullString{String: hash, Valid: true}, version: version}
+	if data.Source != nil {
+		st.topic = sql.NullString{String: data.Source.Topic, Valid: true}
+		st.partition = sql.NullInt64{Int64: int64(data.Source.Partition), Valid: true}
+		st.offset = sql.NullInt64{Int64: data.Source.Offset, Valid: true}
+	}
+	return st
+}
+
+// isNewerThan reports whether current version comes from the same partition as src
+// and not from an earlier message. Messages of other partitions can not be ordered.
+func (s storedOrder) isNewerThan(src *models.Source) bool {
+	return src != nil && s.topic.Valid && s.partition.Valid && s.offset.Valid &&
+		s.topic.String == src.Topic && s.partition.Int64 == int64(src.Partition) && s.offset.Int64 >= src.Offset
+}
+
+// mergeOrder applies data of the order which is already in database
+// Result is not counted, it is counted by caller after the end of transaction.
+// Returns:
+//   - result of merge, data is saved only if it is updated
+//   - version of the order after merge
+//   - error if something wrong or order is rejected
+func (r *SQLOrderRepository) mergeOrder(ctx context.Context, tx *sql.Tx, data *models.CombinedData, payload []byte, hash string, stored storedOrder) (string, int, error) {
+	switch {
+	case stored.hash.Valid && stored.hash.String == hash:
+		log.Printf("Order %s is already in db, skipped", data.Order.OrderUID)
+		return mergeDuplicate, stored.version, nil
+	case stored.isNewerThan(data.Source):
+		// redelivered or replayed old message must not overwrite newer data
+		log.Printf("Order %s is already in db with data of newer message, ignored", data.Order.OrderUID)
+		return mergeIgnored, stored.version, nil
+	case r.cfg.DuplicatePolicy == config.DuplicateReject:
+		return mergeRejected, stored.version, fmt.Errorf("%w: %s", ErrOrderConflict, data.Order.OrderUID)
+	case r.cfg.DuplicatePolicy == config.DuplicateIgnore:
+		log.Printf("Order %s is already in db with other data, ignored", data.Order.OrderUID)
+		return mergeIgnored, stored.version, nil
+	}
+
+	version := stored.version + 1
+	if err := updateOrder(ctx, tx, data, hash, version); err != nil {
+		return "", stored.version, err
+	}
+	if err := insertVersion(ctx, tx, data, payload, version); err != nil {
+		return "", stored.version, err
+	}
+
+	return mergeUpdated, version, nil
+}
+
+func insertOrder(ctx context.Context, tx *sql.Tx, data *models.CombinedData, hash string) error {
+	if err := execDelivery(ctx, tx, queryInsertDelivery, &data.Delivery); err != nil {
+		return err
+	}
+
+	if err := execOrder(ctx, tx, queryInsertOrder, &data.Order, hash, 1); err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(queryDelivery,
+	if err := execPayment(ctx, tx, &data.Payment); err != nil {
+		return err
+	}
+
+	return execItems(ctx, tx, data.Items)
+}
+
+// updateOrder replaces all data of existing order
+func updateOrder(ctx context.Context, tx *sql.Tx, data *models.CombinedData, hash string, version int) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM items WHERE track_number = (SELECT track_number FROM orders WHERE order_uid = $1)`, data.Order.OrderUID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM payment WHERE transaction = $1`, data.Order.OrderUID)
+	if err != nil {
+		return err
+	}
+
+	if err = execDelivery(ctx, tx, queryUpsertDelivery, &data.Delivery); err != nil {
+		return err
+	}
+
+	if err = execOrder(ctx, tx, queryUpdateOrder, &data.Order, hash, version); err != nil {
+		return err
+	}
+
+	if err = execPayment(ctx, tx, &data.Payment); err != nil {
+		return err
+	}
+
+	return execItems(ctx, tx, data.Items)
+}
+
+// insertVersion saves data of the order to history together with its kafka source
+func insertVersion(ctx context.Context, tx *sql.Tx, data *models.CombinedData, payload []byte, version int) error {
+	_, err := tx.ExecContext(ctx, queryInsertVersion, versionArgs(data, payload, version)...)
+	return err
+}
+
+func versionArgs(data *models.CombinedData, payload []byte, version int) []any {
+	var (
+		topic     sql.NullString
+		partition sql.NullInt64
+		offset    sql.NullInt64
+	)
+	if data.Source != nil {
+		topic = sql.NullString{String: data.Source.Topic, Valid: true}
+		partition = sql.NullInt64{Int64: int64(data.Source.Partition), Valid: true}
+		offset = sql.NullInt64{Int64: data.Source.Offset, Valid: true}
+	}
+
+	return []any{data.Order.OrderUID, version, payload, topic, partition, offset}
+}
+
+func execDelivery(ctx context.Context, tx *sql.Tx, query string, delivery *models.Delivery) error {
+	_, err := tx.ExecContext(ctx, query, deliveryArgs(delivery)...)
+	return err
+}
+
+func deliveryArgs(delivery *models.Delivery) []any {
+	return []any{
 		*delivery.ID,
 		*delivery.Name,
 		*delivery.Phone,
@@ -112,16 +389,16 @@ INSERT INTO items (
 		*delivery.Address,
 		*delivery.Region,
 		*delivery.Email,
-	)
-	if err != nil {
-		errRollBack := tx.Rollback()
-		if errRollBack != nil {
-			return errRollBack
-		}
-		return err
 	}
+}
+
+func execOrder(ctx context.Context, tx *sql.Tx, query string, order *models.Order, hash string, version int) error {
+	_, err := tx.ExecContext(ctx, query, orderArgs(order, hash, version)...)
+	return err
+}
 
-	_, err = tx.Exec(queryOrder,
+func orderArgs(order *models.Order, hash string, version int) []any {
+	return []any{
 		order.OrderUID,
 		*order.TrackNumber,
 		*order.Entry,
@@ -134,16 +411,18 @@ INSERT INTO items (
 		*order.SmID,
 		*order.DateCreated,
 		*order.OofShard,
-	)
-	if err != nil {
-		errRollBack := tx.Rollback()
-		if errRollBack != nil {
-			return errRollBack
-		}
-		return err
+		hash,
+		version,
 	}
+}
 
-	_, err = tx.Exec(queryPayment,
+func execPayment(ctx context.Context, tx *sql.Tx, payment *models.Payment) error {
+	_, err := tx.ExecContext(ctx, queryInsertPayment, paymentArgs(payment)...)
+	return err
+}
+
+func paymentArgs(payment *models.Payment) []any {
+	return []any{
 		*payment.Transaction,
 		*payment.RequestID,
 		*payment.Currency,
@@ -154,44 +433,54 @@ INSERT INTO items (
 		*payment.DeliveryCost,
 		*payment.GoodsTotal,
 		*payment.CustomFee,
-	)
-	if err != nil {
-		errRollBack := tx.Rollback()
-		if errRollBack != nil {
-			return errRollBack
-		}
-		return err
 	}
+}
 
-	for _, i := range items {
-		_, err = tx.Exec(queryItem,
-			*i.ChrtID,
-			*i.TrackNumber,
-			*i.Price,
-			*i.Rid,
-			*i.Name,
-			*i.Sale,
-			*i.Size,
-			*i.TotalPrice,
-			*i.NmID,
-			*i.Brand,
-			*i.Status,
-		)
+func execItems(ctx context.Context, tx *sql.Tx, items []models.Item) error {
+	for i := range items {
+		_, err := tx.ExecContext(ctx, queryInsertItem, itemArgs(&items[i])...)
 		if err != nil {
-			errRollBack := tx.Rollback()
-			if errRollBack != nil {
-				return errRollBack
-			}
 			return err
 		}
 	}
+	return nil
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+func itemArgs(i *models.Item) []any {
+	return []any{
+		*i.ChrtID,
+		*i.TrackNumber,
+		*i.Price,
+		*i.Rid,
+		*i.Name,
+		*i.Sale,
+		*i.Size,
+		*i.TotalPrice,
+		*i.NmID,
+		*i.Brand,
+		*i.Status,
 	}
-	log.Println("Data inserted in db")
-	return nil
+}
+
+// rollback cancels transaction and returns err or error of rollback
+// Transaction of cancelled context is already rolled back by database/sql.
+func rollback(tx *sql.Tx, err error) error {
+	if errRollBack := tx.Rollback(); errRollBack != nil && !errors.Is(errRollBack, sql.ErrTxDone) {
+		return errRollBack
+	}
+	return err
+}
+
+// isUniqueViolation reports whether err is violation of unique or primary key
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// payloadHash returns checksum of order data to recognize repeated messages
+func payloadHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
 }
 
 // InsertWithRetry insert data to database using multiple attempts if necessary
@@ -200,48 +489,122 @@ INSERT INTO items (
 //   - data: all data about order
 //
 // Returns:
+//   - true if data is inserted or updated, false if database keeps its previous data
 //   - error if something wrong
-func (r *SQLOrderRepository) InsertWithRetry(ctx context.Context, data *models.CombinedData) error {
-	maxRetries := 5
-	delay := time.Millisecond * 50
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		err := r.InsertOrder(data)
-		if err == nil {
-			return nil
-		}
+func (r *SQLOrderRepository) InsertWithRetry(ctx context.Context, data *models.CombinedData) (bool, error) {
+	applied := false
+	err := retry.Do(ctx, r.cfg.MaxRetries, r.backoff(), func() (err error) {
+		applied, err = r.InsertOrder(ctx, data)
+		return err
+	})
+	return applied, err
+}
 
-		if !(errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone)) {
-			return err
-		}
+// backoff returns delays between attempts of database operations
+func (r *SQLOrderRepository) backoff() retry.Backoff {
+	return retry.Backoff{Base: r.cfg.RetryDelay, Max: r.cfg.MaxRetryDelay}
+}
 
-		delay *= 2
+// querySelectOrders selects orders with delivery, payment and items, conditions are appended to it
+const querySelectOrders = `
+SELECT
+    o.order_uid,
+    o.track_number,
+    o.entry,
+    o.delivery_id,
+    o.locale,
+    o.internal_signature,
+    o.customer_id,
+    o.delivery_service,
+    o.shardkey,
+    o.sm_id,
+    o.date_created,
+    o.oof_shard,
+    d.id,
+    d.name,
+    d.phone,
+    d.zip,
+    d.city,
+    d.address,
+    d.region,
+    d.email,
+    p.transaction,
+    p.request_id,
+    p.currency,
+    p.provider,
+    p.amount,
+    p.payment_dt,
+    p.bank,
+    p.delivery_cost,
+    p.goods_total,
+    p.custom_fee,
+    COALESCE((
+        SELECT json_agg(json_build_object(
+            'chrtID', i.chrt_id,
+            'trackNumber', i.track_number,
+            'price', i.price,
+            'rid', i.rid,
+            'name', i.name,
+            'sale', i.sale,
+            'size', i.size,
+            'totalPrice', i.total_price,
+            'nmID', i.nm_id,
+            'brand', i.brand,
+            'status', i.status
+        ))
+        FROM items i
+        WHERE i.track_number = o.track_number
+    ), '[]')
+FROM orders o
+JOIN delivery d ON d.id = o.delivery_id
+JOIN payment p ON p.transaction = o.order_uid
+`
 
-		select {
-		case <-time.After(delay):
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-	}
+const querySelectOrder = querySelectOrders + `WHERE o.order_uid = $1
+`
 
-	return fmt.Errorf("insert failed, retry after %d attempts", maxRetries)
-}
+const querySelectOrderByTrack = querySelectOrders + `WHERE o.track_number = $1
+`
 
-// SelectOrder select data from database
+// SelectOrder select data from database in one query
+// Items are aggregated to json array by database.
 // Accepts:
+//   - ctx: context
 //   - orderID: identifier
 //
 // Returns:
 //   - all data about order
-//   - error if something wrong
-func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.CombinedData, err error) {
-	order := models.Order{}
-	delivery := models.Delivery{}
-	payment := models.Payment{}
-	items := []models.Item{}
-
-	queryOrder := `SELECT * FROM orders WHERE order_uid = $1`
-	row := r.DB.QueryRow(queryOrder, orderUID)
-	err = row.Scan(
+//   - error if something wrong, sql.ErrNoRows if there is no such order
+func (r *SQLOrderRepository) SelectOrder(ctx context.Context, orderUID string) (*models.CombinedData, error) {
+	return scanOrder(r.DB.QueryRowContext(ctx, querySelectOrder, orderUID))
+}
+
+// SelectByTrackNumber select order by its track number in one query
+// Accepts:
+//   - ctx: context
+//   - trackNumber: track number of order
+//
+// Returns:
+//   - all data about order
+//   - error if something wrong, sql.ErrNoRows if there is no such order
+func (r *SQLOrderRepository) SelectByTrackNumber(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	return scanOrder(r.DB.QueryRowContext(ctx, querySelectOrderByTrack, trackNumber))
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanOrder reads order selected by querySelectOrders
+func scanOrder(row rowScanner) (*models.CombinedData, error) {
+	data := &models.CombinedData{}
+	order := &data.Order
+	delivery := &data.Delivery
+	payment := &data.Payment
+	items := []byte{}
+
+	err := row.Scan(
 		&order.OrderUID,
 		&order.TrackNumber,
 		&order.Entry,
@@ -254,14 +617,6 @@ func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.Combined
 		&order.SmID,
 		&order.DateCreated,
 		&order.OofShard,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	queryDelivery := `SELECT * FROM delivery WHERE id = $1`
-	row = r.DB.QueryRow(queryDelivery, &order.DeliveryID)
-	err = row.Scan(
 		&delivery.ID,
 		&delivery.Name,
 		&delivery.Phone,
@@ -270,14 +625,6 @@ func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.Combined
 		&delivery.Address,
 		&delivery.Region,
 		&delivery.Email,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	queryPayment := `SELECT * FROM payment WHERE transaction = $1`
-	row = r.DB.QueryRow(queryPayment, &order.OrderUID)
-	err = row.Scan(
 		&payment.Transaction,
 		&payment.RequestID,
 		&payment.Currency,
@@ -288,13 +635,35 @@ func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.Combined
 		&payment.DeliveryCost,
 		&payment.GoodsTotal,
 		&payment.CustomFee,
+		&items,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	queryItems := `SELECT * FROM items WHERE track_number = $1`
-	rows, err := r.DB.Query(queryItems, &order.TrackNumber)
+	if err = json.Unmarshal(items, &data.Items); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// SelectHistory select all versions of the order
+// Accepts:
+//   - ctx: context
+//   - orderUID: identifier
+//
+// Returns:
+//   - versions of order from oldest to newest
+//   - error if something wrong, sql.ErrNoRows if there is no such order
+func (r *SQLOrderRepository) SelectHistory(ctx context.Context, orderUID string) (versions []models.OrderVersion, err error) {
+	query := `
+SELECT version, created_at, kafka_topic, kafka_partition, kafka_offset, payload
+FROM order_versions
+WHERE order_uid = $1
+ORDER BY version`
+
+	rows, err := r.DB.QueryContext(ctx, query, orderUID)
 	if err != nil {
 		return nil, err
 	}
@@ -304,34 +673,43 @@ func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.Combined
 		}
 	}()
 
+	versions = []models.OrderVersion{}
 	for rows.Next() {
-		item := models.Item{}
+		version := models.OrderVersion{}
+		payload := []byte{}
 		err = rows.Scan(
-			&item.ChrtID,
-			&item.TrackNumber,
-			&item.Price,
-			&item.Rid,
-			&item.Name,
-			&item.Sale,
-			&item.Size,
-			&item.TotalPrice,
-			&item.NmID,
-			&item.Brand,
-			&item.Status,
+			&version.Version,
+			&version.CreatedAt,
+			&version.Topic,
+			&version.Partition,
+			&version.Offset,
+			&payload,
 		)
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, item)
+		if err = json.Unmarshal(payload, &version.Data); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	data = &models.CombinedData{
-		Order:    order,
-		Payment:  payment,
-		Delivery: delivery,
-		Items:    items,
+	// orders saved before history was introduced have no versions
+	if len(versions) == 0 {
+		exists := false
+		err = r.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM orders WHERE order_uid = $1)`, orderUID).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, sql.ErrNoRows
+		}
 	}
-	return
+
+	return versions, nil
 }
 
 // SelectWithRetry select data from database using multiple attempts if necessary
@@ -343,26 +721,35 @@ func (r *SQLOrderRepository) SelectOrder(orderUID string) (data *models.Combined
 //   - all data about order
 //   - error if something wrong
 func (r *SQLOrderRepository) SelectWithRetry(ctx context.Context, orderUID string) (*models.CombinedData, error) {
-	maxRetries := 5
-	delay := time.Millisecond * 50
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		data, err := r.SelectOrder(orderUID)
-		if err == nil {
-			return data, nil
-		}
-
-		if !(errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone)) {
-			return nil, err
-		}
+	return r.selectWithRetry(ctx, func() (*models.CombinedData, error) {
+		return r.SelectOrder(ctx, orderUID)
+	})
+}
 
-		delay *= 2
+// SelectByTrackWithRetry select order by track number using multiple attempts if necessary
+// Accepts:
+//   - ctx: context
+//   - trackNumber: track number of order
+//
+// Returns:
+//   - all data about order
+//   - error if something wrong
+func (r *SQLOrderRepository) SelectByTrackWithRetry(ctx context.Context, trackNumber string) (*models.CombinedData, error) {
+	return r.selectWithRetry(ctx, func() (*models.CombinedData, error) {
+		return r.SelectByTrackNumber(ctx, trackNumber)
+	})
+}
 
-		select {
-		case <-time.After(delay):
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+// selectWithRetry repeats selection while transient errors occur
+func (r *SQLOrderRepository) selectWithRetry(ctx context.Context, selectOrder func() (*models.CombinedData, error)) (*models.CombinedData, error) {
+	var data *models.CombinedData
+	err := retry.Do(ctx, r.cfg.MaxRetries, r.backoff(), func() (err error) {
+		data, err = selectOrder()
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("select failed, retry after %d attempts", maxRetries)
+	return data, nil
 }
@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/config"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// setupBenchDB starts postgres in container and applies migrations of the service
+func setupBenchDB(b *testing.B) *sql.DB {
+	ctx := context.Background()
+
+	container, err := postgres.Run(
+		ctx,
+		"postgres:15",
+		postgres.WithDatabase("test"),
+		postgres.WithUsername("test"),
+		postgres.WithPassword("test"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(30*time.Second),
+		),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := container.Terminate(ctx); err != nil {
+			b.Logf("failed to terminate test container: %v", err)
+		}
+	})
+
+	connStr, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	m, err := migrate.New("file://../../migrations", connStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		b.Fatal(err)
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+// BenchmarkSelectOrder compares single query with json aggregation
+// and previous implementation with four sequential queries
+func BenchmarkSelectOrder(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping integration benchmark")
+	}
+
+	db := setupBenchDB(b)
+	repo := NewOrderRepository(db, config.Default().Repository)
+	ctx := context.Background()
+
+	data := createValidData()
+	for i := 1; i < 5; i++ {
+		item := data.Items[0]
+		chrtID := *item.ChrtID + i
+		item.ChrtID = &chrtID
+		data.Items = append(data.Items, item)
+	}
+	if _, err := repo.InsertOrder(ctx, data); err != nil {
+		b.Fatal(err)
+	}
+	uid := data.Order.OrderUID
+
+	for _, bench := range []struct {
+		name  string
+		fetch func(ctx context.Context, orderUID string) (*models.CombinedData, error)
+	}{
+		{"single_query", repo.SelectOrder},
+		{"sequential", func(ctx context.Context, orderUID string) (*models.CombinedData, error) {
+			return selectOrderSequential(ctx, db, orderUID)
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				got, err := bench.fetch(ctx, uid)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(got.Items) != len(data.Items) {
+					b.Fatalf("expected %d items, got %d", len(data.Items), len(got.Items))
+				}
+			}
+		})
+	}
+}
+
+// selectOrderSequential is the previous implementation of SelectOrder, kept for comparison
+func selectOrderSequential(ctx context.Context, db *sql.DB, orderUID string) (data *models.CombinedData, err error) {
+	order := models.Order{}
+	delivery := models.Delivery{}
+	payment := models.Payment{}
+	items := []models.Item{}
+
+	queryOrder := `
+SELECT order_uid, track_number, entry, delivery_id, locale, internal_signature,
+       customer_id, delivery_service, shardkey, sm_id, date_created, oof_shard
+FROM orders WHERE order_uid = $1`
+	err = db.QueryRowContext(ctx, queryOrder, orderUID).Scan(
+		&order.OrderUID,
+		&order.TrackNumber,
+		&order.Entry,
+		&order.DeliveryID,
+		&order.Locale,
+		&order.InternalSignature,
+		&order.CustomerID,
+		&order.DeliveryService,
+		&order.Shardkey,
+		&order.SmID,
+		&order.DateCreated,
+		&order.OofShard,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryDelivery := `SELECT id, name, phone, zip, city, address, region, email FROM delivery WHERE id = $1`
+	err = db.QueryRowContext(ctx, queryDelivery, &order.DeliveryID).Scan(
+		&delivery.ID,
+		&delivery.Name,
+		&delivery.Phone,
+		&delivery.Zip,
+		&delivery.City,
+		&delivery.Address,
+		&delivery.Region,
+		&delivery.Email,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryPayment := `
+SELECT transaction, request_id, currency, provider, amount, payment_dt,
+       bank, delivery_cost, goods_total, custom_fee
+FROM payment WHERE transaction = $1`
+	err = db.QueryRowContext(ctx, queryPayment, &order.OrderUID).Scan(
+		&payment.Transaction,
+		&payment.RequestID,
+		&payment.Currency,
+		&payment.Provider,
+		&payment.Amount,
+		&payment.PaymentDT,
+		&payment.Bank,
+		&payment.DeliveryCost,
+		&payment.GoodsTotal,
+		&payment.CustomFee,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	queryItems := `
+SELECT chrt_id, track_number, price, rid, name, sale, size, total_price, nm_id, brand, status
+FROM items WHERE track_number = $1`
+	rows, err := db.QueryContext(ctx, queryItems, &order.TrackNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil {
+			err = errClose
+		}
+	}()
+
+	for rows.Next() {
+		item := models.Item{}
+		err = rows.Scan(
+			&item.ChrtID,
+			&item.TrackNumber,
+			&item.Price,
+			&item.Rid,
+			&item.Name,
+			&item.Sale,
+			&item.Size,
+			&item.TotalPrice,
+			&item.NmID,
+			&item.Brand,
+			&item.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return &models.CombinedData{
+		Order:    order,
+		Payment:  payment,
+		Delivery: delivery,
+		Items:    items,
+	}, nil
+}
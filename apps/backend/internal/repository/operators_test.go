@@ -3,13 +3,18 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/config"
 	"github.com/Kost0/L0/internal/models"
+	"github.com/Kost0/L0/internal/retry"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -60,53 +65,53 @@ func createValidData() *models.CombinedData {
 
 	data := models.CombinedData{
 		Order: models.Order{
-			orderUUID,
-			&track,
-			&entry,
-			&deliveryUUID,
-			&locale,
-			&internalSignature,
-			&customer,
-			&deliveryService,
-			&shardKey,
-			&smID,
-			&orderTime,
-			&oofShard,
+			OrderUID:          orderUUID,
+			TrackNumber:       &track,
+			Entry:             &entry,
+			DeliveryID:        &deliveryUUID,
+			Locale:            &locale,
+			InternalSignature: &internalSignature,
+			CustomerID:        &customer,
+			DeliveryService:   &deliveryService,
+			Shardkey:          &shardKey,
+			SmID:              &smID,
+			DateCreated:       &orderTime,
+			OofShard:          &oofShard,
 		},
 		Delivery: models.Delivery{
-			&deliveryUUID,
-			&name,
-			&phone,
-			&zip,
-			&city,
-			&address,
-			&region,
-			&email,
+			ID:      &deliveryUUID,
+			Name:    &name,
+			Phone:   &phone,
+			Zip:     &zip,
+			City:    &city,
+			Address: &address,
+			Region:  &region,
+			Email:   &email,
 		},
 		Payment: models.Payment{
-			&orderUUID,
-			&requestId,
-			&currency,
-			&provider,
-			&amount,
-			&paymentDT,
-			&bank,
-			&deliveryCost,
-			&goodsTotal,
-			&customFee,
+			Transaction:  &orderUUID,
+			RequestID:    &requestId,
+			Currency:     &currency,
+			Provider:     &provider,
+			Amount:       &amount,
+			PaymentDT:    &paymentDT,
+			Bank:         &bank,
+			DeliveryCost: &deliveryCost,
+			GoodsTotal:   &goodsTotal,
+			CustomFee:    &customFee,
 		},
-		Items: []models.Item{models.Item{
-			&chrtID,
-			&track,
-			&price,
-			&rid,
-			&name2,
-			&sale,
-			&size,
-			&totalPrice,
-			&nmId,
-			&brand,
-			&status,
+		Items: []models.Item{{
+			ChrtID:      &chrtID,
+			TrackNumber: &track,
+			Price:       &price,
+			Rid:         &rid,
+			Name:        &name2,
+			Sale:        &sale,
+			Size:        &size,
+			TotalPrice:  &totalPrice,
+			NmID:        &nmId,
+			Brand:       &brand,
+			Status:      &status,
 		}},
 	}
 
@@ -118,11 +123,12 @@ func TestSQLOrderRepository_InsertOrder_Success(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	data := createValidData()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 
 	mock.ExpectExec("INSERT INTO delivery").
 		WithArgs(
@@ -137,7 +143,7 @@ func TestSQLOrderRepository_InsertOrder_Success(t *testing.T) {
 			*data.Order.DeliveryID, *data.Order.Locale,
 			*data.Order.InternalSignature, *data.Order.CustomerID,
 			*data.Order.DeliveryService, *data.Order.Shardkey, *data.Order.SmID,
-			data.Order.DateCreated, *data.Order.OofShard,
+			data.Order.DateCreated, *data.Order.OofShard, sqlmock.AnyArg(), 1,
 		).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectExec("INSERT INTO payment").
@@ -157,10 +163,15 @@ func TestSQLOrderRepository_InsertOrder_Success(t *testing.T) {
 			).WillReturnResult(sqlmock.NewResult(1, 1))
 	}
 
+	mock.ExpectExec("INSERT INTO order_versions").
+		WithArgs(data.Order.OrderUID, 1, sqlmock.AnyArg(), nil, nil, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
 	mock.ExpectCommit()
 
-	err = repo.InsertOrder(data)
+	applied, err := repo.InsertOrder(context.Background(), data)
 	assert.NoError(t, err)
+	assert.True(t, applied)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -169,17 +180,18 @@ func TestSQLOrderRepository_InsertOrder(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	data := createValidData()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 
 	mock.ExpectExec("INSERT INTO delivery").WillReturnError(errors.New("db down"))
 
 	mock.ExpectRollback()
 
-	err = repo.InsertOrder(data)
+	_, err = repo.InsertOrder(context.Background(), data)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "db down")
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -190,18 +202,20 @@ func TestSQLOrderRepository_InsertWithRetry_SuccessOnFirstAttempt(t *testing.T)
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	data := createValidData()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err = repo.InsertOrder(data)
+	_, err = repo.InsertOrder(context.Background(), data)
 	assert.NoError(t, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -211,40 +225,92 @@ func TestSQLOrderRepository_InsertWithRetry_RetryOnConnDone(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	data := createValidData()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO delivery").WillReturnError(sql.ErrConnDone)
 	mock.ExpectRollback()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err = repo.InsertWithRetry(context.Background(), data)
+	_, err = repo.InsertWithRetry(context.Background(), data)
 	assert.NoError(t, err)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestSQLOrderRepository_InsertWithRetry_RetryOnSerializationFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO orders").WillReturnError(&pq.Error{Code: "40001"})
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, err = repo.InsertWithRetry(context.Background(), data)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertWithRetry_NoRetryOnConstraintViolation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnError(&pq.Error{Code: "23502"})
+	mock.ExpectRollback()
+
+	_, err = repo.InsertWithRetry(context.Background(), data)
+	assert.True(t, retry.IsPermanent(retry.Classify(err)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestSQLOrderRepository_InsertWithRetry_NoRetryError(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	data := createValidData()
 
 	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO delivery").WillReturnError(errors.New("invalid email"))
 	mock.ExpectRollback()
 
-	err = repo.InsertWithRetry(context.Background(), data)
+	_, err = repo.InsertWithRetry(context.Background(), data)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid email")
 }
@@ -254,35 +320,457 @@ func TestSQLOrderRepository_SelectOrder_Success(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	repo := &SQLOrderRepository{DB: db}
+	repo := NewOrderRepository(db, config.Default().Repository)
 
 	orderID := "order-1"
 
-	rowsOrder := sqlmock.NewRows([]string{"order_uid", "track_number", "entry", "delivery_id", "locale", "internal_signature", "customer_id", "delivery_service", "shardkey", "sm_id", "date_created", "oof_shard"}).
-		AddRow(orderID, "WB", "WBIL", "del-1", "en", "", "cust", "meest", "9", 99, time.Now(), "1")
+	columns := []string{
+		"order_uid", "track_number", "entry", "delivery_id", "locale", "internal_signature", "customer_id", "delivery_service", "shardkey", "sm_id", "date_created", "oof_shard",
+		"id", "name", "phone", "zip", "city", "address", "region", "email",
+		"transaction", "request_id", "currency", "provider", "amount", "payment_dt", "bank", "delivery_cost", "goods_total", "custom_fee",
+		"items",
+	}
+	items := `[{"chrtID": 123, "trackNumber": "WB", "price": 100, "rid": "rid", "name": "Item", "sale": 0, "size": "M", "totalPrice": 100, "nmID": 456, "brand": "Brand", "status": 202}]`
+	rows := sqlmock.NewRows(columns).AddRow(
+		orderID, "WB", "WBIL", "del-1", "en", "", "cust", "meest", "9", 99, time.Now(), "1",
+		"del-1", "Test", "+7", "123", "City", "Addr", "Region", "test@com",
+		orderID, "", "USD", "wb", 100, 123, "alpha", 50, 50, 0,
+		items,
+	)
+
+	mock.ExpectQuery("SELECT (.+) FROM orders o JOIN delivery d (.+) JOIN payment p").WithArgs(orderID).WillReturnRows(rows)
+
+	data, err := repo.SelectOrder(context.Background(), orderID)
+	assert.NoError(t, err)
+	assert.Equal(t, orderID, data.Order.OrderUID)
+	assert.Equal(t, "test@com", *data.Delivery.Email)
+	assert.Equal(t, orderID, *data.Payment.Transaction)
+	assert.Len(t, data.Items, 1)
+	assert.Equal(t, 456, *data.Items[0].NmID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_SelectOrder_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	mock.ExpectQuery("SELECT (.+) FROM orders").WithArgs("order-1").WillReturnError(sql.ErrNoRows)
 
-	mock.ExpectQuery("SELECT \\* FROM orders").WithArgs(orderID).WillReturnRows(rowsOrder)
+	data, err := repo.SelectOrder(context.Background(), "order-1")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.Nil(t, data)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
 
-	rowsDel := sqlmock.NewRows([]string{"id", "name", "phone", "zip", "city", "address", "region", "email"}).
-		AddRow("del-1", "Test", "+7", "123", "City", "Addr", "Region", "test@com")
+func storedRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"payload_hash", "version", "kafka_topic", "kafka_partition", "kafka_offset"})
+}
 
-	mock.ExpectQuery("SELECT \\* FROM delivery").WithArgs("del-1").WillReturnRows(rowsDel)
+func expectStoredHash(mock sqlmock.Sqlmock, data *models.CombinedData, hash string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").
+		WithArgs(data.Order.OrderUID).
+		WillReturnRows(storedRows().AddRow(hash, 2, nil, nil, nil))
+}
 
-	rowsPay := sqlmock.NewRows([]string{"transaction", "request_id", "currency", "provider", "amount", "payment_dt", "bank", "delivery_cost", "goods_total", "custom_fee"}).
-		AddRow(orderID, "", "USD", "wb", 100, 123, "alpha", 50, 50, 0)
+func TestSQLOrderRepository_SelectByTrackNumber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
 
-	mock.ExpectQuery("SELECT \\* FROM payment").WithArgs(orderID).WillReturnRows(rowsPay)
+	repo := NewOrderRepository(db, config.Default().Repository)
 
-	rowsItems := sqlmock.NewRows([]string{"chrt_id", "track_number", "price", "rid", "name", "sale", "size", "total_price", "nm_id", "brand", "status"}).
-		AddRow(123, "WB", 100, "rid", "Item", 0, "M", 100, 456, "Brand", 202)
+	mock.ExpectQuery(`JOIN payment p ON p.transaction = o.order_uid WHERE o.track_number = \$1`).
+		WithArgs("WB-order-1").
+		WillReturnRows(orderRows(time.Now(), "order-1"))
+	mock.ExpectQuery(`WHERE o.track_number = \$1`).
+		WithArgs("unknown").
+		WillReturnError(sql.ErrNoRows)
 
-	mock.ExpectQuery("SELECT \\* FROM items").WithArgs("WB").WillReturnRows(rowsItems)
+	data, err := repo.SelectByTrackWithRetry(context.Background(), "WB-order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", data.Order.OrderUID)
 
-	data, err := repo.SelectOrder(orderID)
+	_, err = repo.SelectByTrackWithRetry(context.Background(), "unknown")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_Duplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
-	assert.Equal(t, orderID, data.Order.OrderUID)
-	assert.Equal(t, "test@com", *data.Delivery.Email)
-	assert.Equal(t, orderID, *data.Payment.Transaction)
-	assert.Len(t, data.Items, 1)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	payload, err := json.Marshal(data)
+	assert.NoError(t, err)
+	hash := payloadHash(payload)
+
+	before := ingestStats.Get("duplicate")
+	expectStoredHash(mock, data, hash)
+	mock.ExpectRollback()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NotEqual(t, before, ingestStats.Get("duplicate"))
+}
+
+func TestSQLOrderRepository_InsertOrder_ConflictReject(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	cfg := config.Default().Repository
+	cfg.DuplicatePolicy = config.DuplicateReject
+	repo := NewOrderRepository(db, cfg)
+
+	data := createValidData()
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectRollback()
+
+	_, err = repo.InsertOrder(context.Background(), data)
+	assert.ErrorIs(t, err, ErrOrderConflict)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_ConflictIgnore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	cfg := config.Default().Repository
+	cfg.DuplicatePolicy = config.DuplicateIgnore
+	repo := NewOrderRepository(db, cfg)
+
+	data := createValidData()
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectRollback()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_ConflictOverwrite(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	data.Source = &models.Source{Topic: "orders", Partition: 1, Offset: 42}
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectExec("DELETE FROM items").WithArgs(data.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WithArgs(data.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO delivery (.+) ON CONFLICT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE orders SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_ConcurrentInsertMerged(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnError(&pq.Error{Code: "23505", Constraint: "delivery_pkey"})
+	mock.ExpectRollback()
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectExec("DELETE FROM items").WithArgs(data.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WithArgs(data.Order.OrderUID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO delivery (.+) ON CONFLICT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE orders SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_ConcurrentInsertSameData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	payload, err := json.Marshal(data)
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO orders").WillReturnError(&pq.Error{Code: "23505", Constraint: "orders_pkey"})
+	mock.ExpectRollback()
+
+	expectStoredHash(mock, data, payloadHash(payload))
+	mock.ExpectRollback()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_UniqueViolationOfOtherOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	violation := &pq.Error{Code: "23505", Constraint: "orders_track_number_key"}
+
+	for range 2 {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("INSERT INTO delivery").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO orders").WillReturnError(violation)
+		mock.ExpectRollback()
+	}
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.ErrorIs(t, err, violation)
+	assert.False(t, applied)
+	assert.True(t, retry.IsPermanent(retry.Classify(err)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_InsertOrder_FailedCommitNotCounted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	before := ingestCount("updated")
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectExec("DELETE FROM items").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO delivery (.+) ON CONFLICT").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE orders SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payment").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO items").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO order_versions").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+
+	_, err = repo.InsertOrder(context.Background(), data)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, before, ingestCount("updated"))
+}
+
+// ingestCount returns value of ingestStats counter
+func ingestCount(name string) int64 {
+	if v, ok := ingestStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSQLOrderRepository_InsertOrder_OlderMessageIgnored(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	data.Source = &models.Source{Topic: "orders", Partition: 1, Offset: 42}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").
+		WithArgs(data.Order.OrderUID).
+		WillReturnRows(storedRows().AddRow("other", 3, "orders", 1, 50))
+	mock.ExpectRollback()
+
+	applied, err := repo.InsertOrder(context.Background(), data)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStoredOrder_IsNewerThan(t *testing.T) {
+	stored := newStoredOrder(&models.CombinedData{Source: &models.Source{Topic: "orders", Partition: 1, Offset: 50}}, "hash", 3)
+
+	assert.True(t, stored.isNewerThan(&models.Source{Topic: "orders", Partition: 1, Offset: 42}))
+	assert.True(t, stored.isNewerThan(&models.Source{Topic: "orders", Partition: 1, Offset: 50}))
+	assert.False(t, stored.isNewerThan(&models.Source{Topic: "orders", Partition: 1, Offset: 51}))
+	// messages of other partitions and topics can not be ordered
+	assert.False(t, stored.isNewerThan(&models.Source{Topic: "orders", Partition: 2, Offset: 42}))
+	assert.False(t, stored.isNewerThan(&models.Source{Topic: "orders-v2", Partition: 1, Offset: 42}))
+	assert.False(t, stored.isNewerThan(nil))
+	assert.False(t, storedOrder{}.isNewerThan(&models.Source{Topic: "orders", Partition: 1, Offset: 42}))
+}
+
+func TestSQLOrderRepository_InsertOrder_OverwriteFailureRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	expectStoredHash(mock, data, "other")
+	mock.ExpectExec("DELETE FROM items").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM payment").WillReturnError(errors.New("db down"))
+	mock.ExpectRollback()
+
+	_, err = repo.InsertOrder(context.Background(), data)
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_SelectHistory_Success(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+	payload, err := json.Marshal(data)
+	assert.NoError(t, err)
+
+	rows := sqlmock.NewRows([]string{"version", "created_at", "kafka_topic", "kafka_partition", "kafka_offset", "payload"}).
+		AddRow(1, time.Now(), nil, nil, nil, payload).
+		AddRow(2, time.Now(), "orders", 0, 15, payload)
+	mock.ExpectQuery("SELECT (.+) FROM order_versions").WithArgs(data.Order.OrderUID).WillReturnRows(rows)
+
+	versions, err := repo.SelectHistory(context.Background(), data.Order.OrderUID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Nil(t, versions[0].Offset)
+	assert.Equal(t, int64(15), *versions[1].Offset)
+	assert.Equal(t, "orders", *versions[1].Topic)
+	assert.Equal(t, data.Order.OrderUID, versions[1].Data.Order.OrderUID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLOrderRepository_SelectHistory_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	mock.ExpectQuery("SELECT (.+) FROM order_versions").WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at", "kafka_topic", "kafka_partition", "kafka_offset", "payload"}))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	_, err = repo.SelectHistory(context.Background(), "order-1")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// expectRolledBack waits for rollback, database/sql rolls back transaction
+// of cancelled context in background
+func expectRolledBack(t *testing.T, mock sqlmock.Sqlmock) {
+	assert.Eventually(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSQLOrderRepository_InsertOrder_CancelledContextRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO delivery").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = repo.InsertOrder(ctx, data)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, sql.ErrTxDone)
+	assert.Less(t, time.Since(start), time.Second)
+	expectRolledBack(t, mock)
+}
+
+func TestSQLOrderRepository_InsertWithRetry_CancelledContextNoRetry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	data := createValidData()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT o.payload_hash, o.version").WithArgs(data.Order.OrderUID).WillDelayFor(time.Second).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = repo.InsertWithRetry(ctx, data)
+	assert.Error(t, err)
+	expectRolledBack(t, mock)
+}
+
+func TestSQLOrderRepository_SelectOrder_CancelledContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	repo := NewOrderRepository(db, config.Default().Repository)
+
+	mock.ExpectQuery("SELECT (.+) FROM orders").WithArgs("order-1").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"order_uid"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	data, err := repo.SelectOrder(ctx, "order-1")
+	assert.Error(t, err)
+	assert.Nil(t, data)
+	assert.Less(t, time.Since(start), time.Second)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Kost0/L0/internal/models"
+)
+
+// Limits of page size of ListQuarantined
+const (
+	DefaultQuarantineLimit = 50
+	MaxQuarantineLimit     = 100
+)
+
+// ErrQuarantineResolved is returned when quarantined message is already resubmitted or discarded
+var ErrQuarantineResolved = errors.New("quarantined message is already resolved")
+
+// SQLQuarantineRepository keeps failed messages in quarantined_messages table
+type SQLQuarantineRepository struct {
+	DB *sql.DB
+}
+
+// NewQuarantineRepository create new SQLQuarantineRepository
+// Accepts:
+//   - db: database
+//
+// Returns:
+//   - *SQLQuarantineRepository
+func NewQuarantineRepository(db *sql.DB) *SQLQuarantineRepository {
+	return &SQLQuarantineRepository{DB: db}
+}
+
+const querySelectQuarantined = `
+SELECT id, kafka_topic, kafka_partition, kafka_offset, original_topic, message_key, payload,
+       headers, error, error_chain, attempts, status, created_at, updated_at
+FROM quarantined_messages
+`
+
+// Quarantine saves failed message
+// The same kafka message delivered again updates its error and attempts.
+// Accepts:
+//   - ctx: context
+//   - msg: failed message, its ID, status and times are set after saving
+//
+// Returns:
+//   - error if something wrong
+func (r *SQLQuarantineRepository) Quarantine(ctx context.Context, msg *models.QuarantinedMessage) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+	chain, err := json.Marshal(msg.ErrorChain)
+	if err != nil {
+		return err
+	}
+
+	query := `
+INSERT INTO quarantined_messages (kafka_topic, kafka_partition, kafka_offset, original_topic, message_key, payload, headers, error, error_chain, attempts)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (kafka_topic, kafka_partition, kafka_offset) DO UPDATE
+SET error = EXCLUDED.error, error_chain = EXCLUDED.error_chain, attempts = EXCLUDED.attempts, updated_at = NOW()
+RETURNING id, status, created_at, updated_at`
+
+	return r.DB.QueryRowContext(ctx, query,
+		msg.Topic, msg.Partition, msg.Offset, msg.OriginalTopic, []byte(msg.Key), []byte(msg.Payload),
+		headers, msg.Error, chain, msg.Attempts,
+	).Scan(&msg.ID, &msg.Status, &msg.CreatedAt, &msg.UpdatedAt)
+}
+
+// ListQuarantined select page of quarantined messages, newest first
+// Accepts:
+//   - ctx: context
+//   - filter: status, page size and ID of the last message of previous page
+//
+// Returns:
+//   - messages
+//   - error if something wrong
+func (r *SQLQuarantineRepository) ListQuarantined(ctx context.Context, filter models.QuarantineFilter) (msgs []models.QuarantinedMessage, err error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultQuarantineLimit
+	}
+	if limit > MaxQuarantineLimit {
+		limit = MaxQuarantineLimit
+	}
+
+	query := querySelectQuarantined + `WHERE ($1 = '' OR status = $1)
+  AND ($2 = 0 OR id < $2)
+ORDER BY id DESC
+LIMIT $3`
+
+	rows, err := r.DB.QueryContext(ctx, query, filter.Status, filter.BeforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if errClose := rows.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}()
+
+	msgs = []models.QuarantinedMessage{}
+	for rows.Next() {
+		msg, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, *msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// GetQuarantined select quarantined message
+// Accepts:
+//   - ctx: context
+//   - id: ID of message
+//
+// Returns:
+//   - message
+//   - error if something wrong, sql.ErrNoRows if there is no such message
+func (r *SQLQuarantineRepository) GetQuarantined(ctx context.Context, id int64) (*models.QuarantinedMessage, error) {
+	return scanQuarantined(r.DB.QueryRowContext(ctx, querySelectQuarantined+"WHERE id = $1", id))
+}
+
+// UpdateQuarantinedPayload replaces payload of message which is still quarantined
+// Accepts:
+//   - ctx: context
+//   - id: ID of message
+//   - payload: new payload
+//
+// Returns:
+//   - error if something wrong, sql.ErrNoRows if there is no such message,
+//     ErrQuarantineResolved if message is resubmitted or discarded
+func (r *SQLQuarantineRepository) UpdateQuarantinedPayload(ctx context.Context, id int64, payload []byte) error {
+	return r.updateQuarantined(ctx, id, `UPDATE quarantined_messages SET payload = $2, updated_at = NOW() WHERE id = $1 AND status = $3`, payload)
+}
+
+// ResolveQuarantined changes status of message which is still quarantined
+// Accepts:
+//   - ctx: context
+//   - id: ID of message
+//   - status: resubmitted or discarded
+//
+// Returns:
+//   - error if something wrong, sql.ErrNoRows if there is no such message,
+//     ErrQuarantineResolved if message is already resubmitted or discarded
+func (r *SQLQuarantineRepository) ResolveQuarantined(ctx context.Context, id int64, status string) error {
+	return r.updateQuarantined(ctx, id, `UPDATE quarantined_messages SET status = $2, updated_at = NOW() WHERE id = $1 AND status = $3`, status)
+}
+
+// updateQuarantined executes update of quarantined message, query has ID, value and quarantined status as arguments
+func (r *SQLQuarantineRepository) updateQuarantined(ctx context.Context, id int64, query string, value any) error {
+	res, err := r.DB.ExecContext(ctx, query, id, value, models.QuarantineStatusQuarantined)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// message is missing or is not quarantined anymore
+	exists := false
+	err = r.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM quarantined_messages WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return fmt.Errorf("%w: %d", ErrQuarantineResolved, id)
+}
+
+// scanQuarantined reads message selected by querySelectQuarantined
+func scanQuarantined(row rowScanner) (*models.QuarantinedMessage, error) {
+	msg := &models.QuarantinedMessage{}
+	var key, payload, headers, chain []byte
+	err := row.Scan(
+		&msg.ID, &msg.Topic, &msg.Partition, &msg.Offset, &msg.OriginalTopic, &key, &payload,
+		&headers, &msg.Error, &chain, &msg.Attempts, &msg.Status, &msg.CreatedAt, &msg.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Key = string(key)
+	msg.Payload = string(payload)
+	if err = json.Unmarshal(headers, &msg.Headers); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(chain, &msg.ErrorChain); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func quarantinedRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "kafka_topic", "kafka_partition", "kafka_offset", "original_topic", "message_key", "payload",
+		"headers", "error", "error_chain", "attempts", "status", "created_at", "updated_at",
+	})
+}
+
+func TestSQLQuarantineRepository_Quarantine(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewQuarantineRepository(db)
+	msg := &models.QuarantinedMessage{
+		Topic:         "orders",
+		Partition:     1,
+		Offset:        15,
+		OriginalTopic: "orders",
+		Key:           "order-1",
+		Payload:       `{invalid json}`,
+		Headers:       map[string]string{"trace_id": "abc"},
+		Error:         "invalid character 'i'",
+		ErrorChain:    []string{"invalid character 'i'"},
+		Attempts:      1,
+	}
+
+	created := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`INSERT INTO quarantined_messages (.+) ON CONFLICT \(kafka_topic, kafka_partition, kafka_offset\) DO UPDATE`).
+		WithArgs("orders", 1, int64(15), "orders", []byte("order-1"), []byte(`{invalid json}`),
+			[]byte(`{"trace_id":"abc"}`), "invalid character 'i'", []byte(`["invalid character 'i'"]`), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "created_at", "updated_at"}).
+			AddRow(7, models.QuarantineStatusQuarantined, created, created))
+
+	err = repo.Quarantine(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), msg.ID)
+	assert.Equal(t, models.QuarantineStatusQuarantined, msg.Status)
+	assert.Equal(t, created, msg.CreatedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLQuarantineRepository_ListQuarantined(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewQuarantineRepository(db)
+
+	now := time.Now()
+	mock.ExpectQuery(`FROM quarantined_messages WHERE \(\$1 = '' OR status = \$1\) AND \(\$2 = 0 OR id < \$2\) ORDER BY id DESC LIMIT \$3`).
+		WithArgs(models.QuarantineStatusQuarantined, int64(10), DefaultQuarantineLimit).
+		WillReturnRows(quarantinedRows().
+			AddRow(9, "orders", 0, 3, "orders", []byte("k"), []byte("{}"), []byte(`{}`), "db down", []byte(`["db down"]`), 4, "quarantined", now, now))
+
+	msgs, err := repo.ListQuarantined(context.Background(), models.QuarantineFilter{Status: models.QuarantineStatusQuarantined, BeforeID: 10})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, int64(9), msgs[0].ID)
+	assert.Equal(t, "k", msgs[0].Key)
+	assert.Equal(t, "{}", msgs[0].Payload)
+	assert.Equal(t, []string{"db down"}, msgs[0].ErrorChain)
+	assert.Equal(t, 4, msgs[0].Attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLQuarantineRepository_GetQuarantined_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewQuarantineRepository(db)
+
+	mock.ExpectQuery(`FROM quarantined_messages WHERE id = \$1`).WithArgs(int64(5)).WillReturnRows(quarantinedRows())
+
+	_, err = repo.GetQuarantined(context.Background(), 5)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSQLQuarantineRepository_ResolveQuarantined(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := NewQuarantineRepository(db)
+	ctx := context.Background()
+
+	mock.ExpectExec(`UPDATE quarantined_messages SET status = \$2`).
+		WithArgs(int64(5), models.QuarantineStatusDiscarded, models.QuarantineStatusQuarantined).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, repo.ResolveQuarantined(ctx, 5, models.QuarantineStatusDiscarded))
+
+	// already resolved
+	mock.ExpectExec(`UPDATE quarantined_messages SET status = \$2`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs(int64(5)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	assert.ErrorIs(t, repo.ResolveQuarantined(ctx, 5, models.QuarantineStatusDiscarded), ErrQuarantineResolved)
+
+	// missing
+	mock.ExpectExec(`UPDATE quarantined_messages SET payload = \$2`).
+		WithArgs(int64(6), []byte("{}"), models.QuarantineStatusQuarantined).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs(int64(6)).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	assert.ErrorIs(t, repo.UpdateQuarantinedPayload(ctx, 6, []byte("{}")), sql.ErrNoRows)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -4,6 +4,7 @@
 //   - connecting to database
 //   - migrations
 //   - operators
+//   - quarantine of failed messages
 package repository
 
 import (
@@ -14,8 +15,22 @@ import (
 
 // OrderRepository defines interface for working with database
 type OrderRepository interface {
-	SelectOrder(orderID string) (*models.CombinedData, error)
+	SelectOrder(ctx context.Context, orderID string) (*models.CombinedData, error)
 	SelectWithRetry(ctx context.Context, orderUID string) (*models.CombinedData, error)
-	InsertOrder(data *models.CombinedData) error
-	InsertWithRetry(ctx context.Context, data *models.CombinedData) error
+	SelectByTrackNumber(ctx context.Context, trackNumber string) (*models.CombinedData, error)
+	SelectByTrackWithRetry(ctx context.Context, trackNumber string) (*models.CombinedData, error)
+	SelectHistory(ctx context.Context, orderUID string) ([]models.OrderVersion, error)
+	ListOrders(ctx context.Context, filter models.OrderFilter) (*models.OrderPage, error)
+	InsertOrder(ctx context.Context, data *models.CombinedData) (bool, error)
+	InsertWithRetry(ctx context.Context, data *models.CombinedData) (bool, error)
+	InsertOrders(ctx context.Context, orders []*models.CombinedData) ([]bool, error)
+}
+
+// QuarantineRepository defines interface for working with messages which could not be processed
+type QuarantineRepository interface {
+	Quarantine(ctx context.Context, msg *models.QuarantinedMessage) error
+	ListQuarantined(ctx context.Context, filter models.QuarantineFilter) ([]models.QuarantinedMessage, error)
+	GetQuarantined(ctx context.Context, id int64) (*models.QuarantinedMessage, error)
+	UpdateQuarantinedPayload(ctx context.Context, id int64, payload []byte) error
+	ResolveQuarantined(ctx context.Context, id int64, status string) error
 }
@@ -0,0 +1,210 @@
+// Package retry provides classification of errors and retries with backoff
+//
+// Includes:
+//   - marking errors as permanent or transient
+//   - classifying database and network errors
+//   - exponential backoff with jitter
+package retry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrPermanent marks errors which can not disappear on retry: broken message, invalid data, constraint violation
+var ErrPermanent = errors.New("permanent error")
+
+// ErrTransient marks errors which may disappear on retry: lost connection, serialization failure, deadlock
+var ErrTransient = errors.New("transient error")
+
+// classified is error marked by ErrPermanent or ErrTransient
+type classified struct {
+	err  error
+	kind error
+}
+
+func (e *classified) Error() string {
+	return e.err.Error()
+}
+
+func (e *classified) Unwrap() []error {
+	return []error{e.err, e.kind}
+}
+
+// Permanent marks err as permanent, already classified error is returned as is
+// Accepts:
+//   - err: error
+//
+// Returns:
+//   - error matching ErrPermanent and err, nil if err is nil
+func Permanent(err error) error {
+	return mark(err, ErrPermanent)
+}
+
+// Transient marks err as transient, already classified error is returned as is
+// Accepts:
+//   - err: error
+//
+// Returns:
+//   - error matching ErrTransient and err, nil if err is nil
+func Transient(err error) error {
+	return mark(err, ErrTransient)
+}
+
+func mark(err, kind error) error {
+	if err == nil || IsPermanent(err) || IsTransient(err) {
+		return err
+	}
+	return &classified{err: err, kind: kind}
+}
+
+// IsPermanent reports whether err is marked as permanent
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrPermanent)
+}
+
+// IsTransient reports whether err is marked as transient
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+// transientStates are SQLSTATE codes of postgres errors which may disappear on retry
+var transientStates = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// permanentClasses are SQLSTATE classes of postgres errors caused by data or query
+var permanentClasses = map[pq.ErrorClass]bool{
+	"22": true, // data_exception
+	"23": true, // integrity_constraint_violation
+	"42": true, // syntax_error_or_access_rule_violation
+}
+
+// Classify marks database and network errors as transient or permanent
+// Errors which are already classified, context errors and unknown errors are returned as is.
+// Accepts:
+//   - err: error
+//
+// Returns:
+//   - classified error
+func Classify(err error) error {
+	if err == nil || IsPermanent(err) || IsTransient(err) {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case transientStates[pqErr.Code], pqErr.Code.Class() == "08": // connection_exception
+			return Transient(err)
+		case permanentClasses[pqErr.Code.Class()]:
+			return Permanent(err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, sql.ErrTxDone),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.As(err, &netErr):
+		return Transient(err)
+	}
+
+	return err
+}
+
+// Backoff computes delays between attempts: delay doubles after every attempt up to Max,
+// and random jitter spreads attempts of concurrent callers
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns delay after attempt, half of it is random
+// Accepts:
+//   - attempt: number of failed attempt, starting from 1
+//
+// Returns:
+//   - delay before the next attempt
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+
+	d := b.Base
+	for i := 1; i < attempt && (b.Max <= 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// Sleep waits for d or until ctx is done
+// Returns:
+//   - ctx.Err() if context is done before d passes
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do calls op until it succeeds, returns not transient error or attempts run out
+// Errors of op are classified by Classify, so transient database faults are retried.
+// Accepts:
+//   - ctx: context, waiting is interrupted when it is done
+//   - attempts: max number of calls of op
+//   - b: delays between calls
+//   - op: operation
+//
+// Returns:
+//   - nil if op succeeded
+//   - classified error of the last call, ctx.Err() if context is done while waiting
+func Do(ctx context.Context, attempts int, b Backoff, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := Classify(op())
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+
+		if attempt >= attempts {
+			return fmt.Errorf("%d attempts failed: %w", attempts, err)
+		}
+
+		if err = Sleep(ctx, b.Delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+		permanent bool
+	}{
+		{"serialization failure", &pq.Error{Code: "40001"}, true, false},
+		{"deadlock", &pq.Error{Code: "40P01"}, true, false},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true, false},
+		{"connection failure", &pq.Error{Code: "08006"}, true, false},
+		{"unique violation", &pq.Error{Code: "23505"}, false, true},
+		{"invalid text", &pq.Error{Code: "22P02"}, false, true},
+		{"disk full", &pq.Error{Code: "53100"}, false, false},
+		{"connection done", fmt.Errorf("insert: %w", sql.ErrConnDone), true, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true, false},
+		{"no rows", sql.ErrNoRows, false, false},
+		{"deadline", context.DeadlineExceeded, false, false},
+		{"marked permanent", Permanent(sql.ErrConnDone), false, true},
+		{"unknown", errors.New("db down"), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Classify(tt.err)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.transient, IsTransient(err))
+			assert.Equal(t, tt.permanent, IsPermanent(err))
+			assert.Equal(t, tt.err.Error(), err.Error())
+		})
+	}
+
+	assert.NoError(t, Classify(nil))
+}
+
+func TestPermanent_KeepsClassification(t *testing.T) {
+	err := Permanent(Transient(errors.New("timeout")))
+	assert.True(t, IsTransient(err))
+	assert.False(t, IsPermanent(err))
+
+	assert.NoError(t, Permanent(nil))
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+
+	for _, tt := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			d := b.Delay(tt.attempt)
+			assert.GreaterOrEqual(t, d, tt.max/2)
+			assert.LessOrEqual(t, d, tt.max)
+		}
+	}
+
+	assert.Zero(t, Backoff{}.Delay(3))
+}
+
+func TestDo_RetriesTransient(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), 3, Backoff{Base: time.Millisecond, Max: time.Millisecond}, func() error {
+		calls++
+		if calls < 3 {
+			return &pq.Error{Code: "40P01"}
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDo_AttemptsRunOut(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), 2, Backoff{Base: time.Millisecond, Max: time.Millisecond}, func() error {
+		calls++
+		return sql.ErrConnDone
+	})
+
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.True(t, IsTransient(err))
+	assert.Equal(t, 2, calls)
+}
+
+func TestDo_NoRetryOfOtherErrors(t *testing.T) {
+	for _, opErr := range []error{&pq.Error{Code: "23505"}, errors.New("db down")} {
+		calls := 0
+		err := Do(context.Background(), 5, Backoff{Base: time.Millisecond, Max: time.Millisecond}, func() error {
+			calls++
+			return opErr
+		})
+
+		assert.ErrorIs(t, err, opErr)
+		assert.Equal(t, 1, calls)
+	}
+}
+
+func TestDo_CancelledContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := Do(ctx, 5, Backoff{Base: time.Minute, Max: time.Minute}, func() error {
+		return sql.ErrConnDone
+	})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
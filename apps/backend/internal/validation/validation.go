@@ -0,0 +1,167 @@
+// Package validation provides checks of orders which report every failed field
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/go-playground/validator"
+)
+
+// Rule codes of failed fields
+// Rules of struct tags keep their tag name, e.g. required.
+const (
+	RuleSyntax      = "syntax"
+	RuleType        = "type"
+	RuleEmail       = "email"
+	RuleNotFuture   = "not_future"
+	RuleNonNegative = "non_negative"
+)
+
+// validate is safe for concurrent use and caches parsed structs
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// field errors are reported with names of JSON payload
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// Error is a result of failed validation, it lists every failed field
+type Error struct {
+	Fields []models.FieldError
+}
+
+// Error returns failed fields in one line
+func (e *Error) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		if f.Path == "" {
+			parts[i] = f.Message
+			continue
+		}
+		parts[i] = f.Path + ": " + f.Message
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// Fields returns failed fields of validation error
+// Accepts:
+//   - err: error which may wrap *Error
+//
+// Returns:
+//   - failed fields, nil if err is not a validation error
+func Fields(err error) []models.FieldError {
+	var verr *Error
+	if errors.As(err, &verr) {
+		return verr.Fields
+	}
+	return nil
+}
+
+// Decode unmarshals and validates order
+// Accepts:
+//   - payload: JSON of order
+//
+// Returns:
+//   - order
+//   - *Error if payload is not valid order
+func Decode(payload []byte) (*models.CombinedData, error) {
+	var data models.CombinedData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, decodeError(err)
+	}
+	if err := Validate(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// decodeError describes error of unmarshalling as failed field
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &Error{Fields: []models.FieldError{{
+			Path:    typeErr.Field,
+			Rule:    RuleType,
+			Message: fmt.Sprintf("must be %s, got %s", typeErr.Type, typeErr.Value),
+		}}}
+	}
+	return &Error{Fields: []models.FieldError{{Rule: RuleSyntax, Message: err.Error()}}}
+}
+
+// Validate checks all fields of order
+// Accepts:
+//   - data: order
+//
+// Returns:
+//   - *Error with every failed field, nil if order is valid
+func Validate(data *models.CombinedData) error {
+	var fields []models.FieldError
+
+	var verrs validator.ValidationErrors
+	if err := validate.Struct(data); errors.As(err, &verrs) {
+		for _, fe := range verrs {
+			fields = append(fields, models.FieldError{
+				Path:    fieldPath(fe.Namespace()),
+				Rule:    fe.Tag(),
+				Message: ruleMessage(fe.Tag(), fe.Param()),
+			})
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if data.Order.DateCreated != nil && data.Order.DateCreated.After(time.Now()) {
+		fields = append(fields, models.FieldError{Path: "order.dateCreated", Rule: RuleNotFuture, Message: "must not be in the future"})
+	}
+
+	if data.Delivery.Email != nil {
+		if _, err := mail.ParseAddress(*data.Delivery.Email); err != nil {
+			fields = append(fields, models.FieldError{Path: "delivery.email", Rule: RuleEmail, Message: "must be valid email address: " + err.Error()})
+		}
+	}
+
+	for i, item := range data.Items {
+		if item.Price != nil && *item.Price < 0 {
+			fields = append(fields, models.FieldError{Path: fmt.Sprintf("items[%d].price", i), Rule: RuleNonNegative, Message: "must not be negative"})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &Error{Fields: fields}
+	}
+	return nil
+}
+
+// fieldPath removes name of root struct from namespace of validator
+func fieldPath(namespace string) string {
+	if _, path, ok := strings.Cut(namespace, "."); ok {
+		return path
+	}
+	return namespace
+}
+
+// ruleMessage describes rule of struct tag
+func ruleMessage(tag, param string) string {
+	if tag == "required" {
+		return "is required"
+	}
+	if param != "" {
+		return fmt.Sprintf("failed on %s=%s", tag, param)
+	}
+	return "failed on " + tag
+}
@@ -0,0 +1,115 @@
+package validation
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Kost0/L0/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createValidData reads order which passes validation, handlers tests share the same file
+func createValidData(t *testing.T) *models.CombinedData {
+	payload, err := os.ReadFile("testdata/order.json")
+	require.NoError(t, err)
+
+	data := models.CombinedData{}
+	require.NoError(t, json.Unmarshal(payload, &data))
+	return &data
+}
+
+func TestValidate_ValidData(t *testing.T) {
+	data := createValidData(t)
+
+	err := Validate(data)
+	assert.NoError(t, err)
+}
+
+func TestValidate_FutureDate(t *testing.T) {
+	data := createValidData(t)
+	futureTime := time.Now().Add(2 * time.Hour)
+	data.Order.DateCreated = &futureTime
+
+	err := Validate(data)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "future")
+	assert.Equal(t, []models.FieldError{{Path: "order.dateCreated", Rule: RuleNotFuture, Message: "must not be in the future"}}, Fields(err))
+}
+
+func TestValidate_InvalidEmail(t *testing.T) {
+	data := createValidData(t)
+	wrongEmail := ""
+
+	data.Delivery.Email = &wrongEmail
+
+	err := Validate(data)
+	assert.Error(t, err)
+	assert.Equal(t, []models.FieldError{{Path: "delivery.email", Rule: RuleEmail, Message: "must be valid email address: mail: no address"}}, Fields(err))
+}
+
+func TestValidate_NegativePrice(t *testing.T) {
+	data := createValidData(t)
+	wrongPrice := -100
+
+	data.Items[0].Price = &wrongPrice
+
+	err := Validate(data)
+	assert.Error(t, err)
+	assert.Equal(t, []models.FieldError{{Path: "items[0].price", Rule: RuleNonNegative, Message: "must not be negative"}}, Fields(err))
+}
+
+func TestValidate_ReportsEveryField(t *testing.T) {
+	data := createValidData(t)
+	wrongEmail := "not an email"
+	wrongPrice := -1
+	data.Order.TrackNumber = nil
+	data.Payment.Currency = nil
+	data.Delivery.Email = &wrongEmail
+	data.Items = append(data.Items, data.Items[0], data.Items[0])
+	data.Items[2].Price = &wrongPrice
+
+	err := Validate(data)
+	require.Error(t, err)
+	assert.Equal(t, []models.FieldError{
+		{Path: "order.trackNumber", Rule: "required", Message: "is required"},
+		{Path: "payment.currency", Rule: "required", Message: "is required"},
+		{Path: "delivery.email", Rule: RuleEmail, Message: "must be valid email address: mail: no angle-addr"},
+		{Path: "items[2].price", Rule: RuleNonNegative, Message: "must not be negative"},
+	}, Fields(err))
+	assert.Equal(t, "validation failed: order.trackNumber: is required; payment.currency: is required; "+
+		"delivery.email: must be valid email address: mail: no angle-addr; items[2].price: must not be negative", err.Error())
+}
+
+func TestValidate_MissingFieldsAreNotChecked(t *testing.T) {
+	data := createValidData(t)
+	data.Order.DateCreated = nil
+	data.Delivery.Email = nil
+	data.Items[0].Price = nil
+
+	assert.Equal(t, []models.FieldError{
+		{Path: "order.dateCreated", Rule: "required", Message: "is required"},
+		{Path: "delivery.email", Rule: "required", Message: "is required"},
+	}, Fields(Validate(data)))
+}
+
+func TestDecode(t *testing.T) {
+	_, err := Decode([]byte(`{"order": {"smID": "99"}}`))
+	assert.Equal(t, []models.FieldError{{Path: "order.smID", Rule: RuleType, Message: "must be int, got string"}}, Fields(err))
+
+	_, err = Decode([]byte(`{invalid json}`))
+	fields := Fields(err)
+	require.Len(t, fields, 1)
+	assert.Equal(t, RuleSyntax, fields[0].Rule)
+	assert.Empty(t, fields[0].Path)
+
+	_, err = Decode([]byte(`{}`))
+	assert.NotEmpty(t, Fields(err))
+}
+
+func TestFields_NotValidationError(t *testing.T) {
+	assert.Nil(t, Fields(assert.AnError))
+	assert.Nil(t, Fields(nil))
+}
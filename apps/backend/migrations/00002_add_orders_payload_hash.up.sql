@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN payload_hash VARCHAR(64);
@@ -0,0 +1,80 @@
+ALTER TABLE orders ADD COLUMN version INT NOT NULL DEFAULT 1;
+
+CREATE TABLE order_versions (
+    order_uid UUID NOT NULL REFERENCES orders(order_uid),
+    version INT NOT NULL,
+    payload JSONB NOT NULL,
+    kafka_topic VARCHAR(255),
+    kafka_partition INT,
+    kafka_offset BIGINT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (order_uid, version)
+);
+
+-- orders saved before history get their current data as the first version
+INSERT INTO order_versions (order_uid, version, payload)
+SELECT o.order_uid, 1, jsonb_build_object(
+    'order', jsonb_build_object(
+        'orderUID', o.order_uid,
+        'trackNumber', o.track_number,
+        'entry', o.entry,
+        'deliveryID', o.delivery_id,
+        'locale', o.locale,
+        'internalSignature', o.internal_signature,
+        'customerID', o.customer_id,
+        'deliveryService', o.delivery_service,
+        'shardKey', o.shardkey,
+        'smID', o.sm_id,
+        'dateCreated', to_char(o.date_created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+        'oofShard', o.oof_shard
+    ),
+    'payment', (
+        SELECT jsonb_build_object(
+            'transaction', p.transaction,
+            'requestID', p.request_id,
+            'currency', p.currency,
+            'provider', p.provider,
+            'amount', p.amount,
+            'paymentDT', p.payment_dt,
+            'bank', p.bank,
+            'deliveryCost', p.delivery_cost,
+            'goodsTotal', p.goods_total,
+            'customFee', p.custom_fee
+        )
+        FROM payment p
+        WHERE p.transaction = o.order_uid
+        LIMIT 1
+    ),
+    'delivery', (
+        SELECT jsonb_build_object(
+            'id', d.id,
+            'name', d.name,
+            'phone', d.phone,
+            'zip', d.zip,
+            'city', d.city,
+            'address', d.address,
+            'region', d.region,
+            'email', d.email
+        )
+        FROM delivery d
+        WHERE d.id = o.delivery_id
+    ),
+    'items', COALESCE((
+        SELECT jsonb_agg(jsonb_build_object(
+            'chrtID', i.chrt_id,
+            'trackNumber', i.track_number,
+            'price', i.price,
+            'rid', i.rid,
+            'name', i.name,
+            'sale', i.sale,
+            'size', i.size,
+            'totalPrice', i.total_price,
+            'nmID', i.nm_id,
+            'brand', i.brand,
+            'status', i.status
+        ))
+        FROM items i
+        WHERE i.track_number = o.track_number
+    ), '[]'::jsonb)
+)
+FROM orders o;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_delivery_phone;
+DROP INDEX IF EXISTS idx_delivery_email;
+DROP INDEX IF EXISTS idx_items_nm_id;
+DROP INDEX IF EXISTS idx_items_brand;
+DROP INDEX IF EXISTS idx_items_track_number;
+DROP INDEX IF EXISTS idx_orders_delivery_service;
+DROP INDEX IF EXISTS idx_orders_customer_id;
@@ -0,0 +1,7 @@
+CREATE INDEX IF NOT EXISTS idx_orders_customer_id ON orders (customer_id, date_created DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_delivery_service ON orders (delivery_service, date_created DESC);
+CREATE INDEX IF NOT EXISTS idx_items_track_number ON items (track_number);
+CREATE INDEX IF NOT EXISTS idx_items_brand ON items (brand);
+CREATE INDEX IF NOT EXISTS idx_items_nm_id ON items (nm_id);
+CREATE INDEX IF NOT EXISTS idx_delivery_email ON delivery (email);
+CREATE INDEX IF NOT EXISTS idx_delivery_phone ON delivery (phone);
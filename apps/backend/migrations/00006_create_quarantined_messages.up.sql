@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS quarantined_messages (
+    id BIGSERIAL PRIMARY KEY,
+    kafka_topic VARCHAR(255) NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    original_topic VARCHAR(255) NOT NULL,
+    message_key BYTEA,
+    payload BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    error TEXT NOT NULL,
+    error_chain JSONB NOT NULL DEFAULT '[]',
+    attempts INT NOT NULL DEFAULT 1,
+    status VARCHAR(16) NOT NULL DEFAULT 'quarantined',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (kafka_topic, kafka_partition, kafka_offset)
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_messages_status ON quarantined_messages (status, id DESC);
@@ -13,7 +13,8 @@ async function fetchOrder() {
         const response = await fetch(`${window.API_URL || `http://localhost:8080`}/orders/${orderId}`);
 
         if (!response.ok) {
-            throw new Error(`Заказ не найден: ${response.status}`);
+            const body = await response.json().catch(() => ({}));
+            throw new Error(body.message ? `${body.message} (${body.code}, request ${body.requestID})` : `Заказ не найден: ${response.status}`);
         }
 
         const rawOrder = await response.json();
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"producer/models"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,8 +20,8 @@ import (
 // StartProducer launches kafka producer
 func StartProducer() {
 	writer := &kafka.Writer{
-		Addr:     kafka.TCP("kafka:9092"),
-		Topic:    "test1",
+		Addr:     kafka.TCP(strings.Split(getEnv("KAFKA_BROKERS", "kafka:9092"), ",")...),
+		Topic:    getEnv("KAFKA_TOPIC", "test1234"),
 		Balancer: &kafka.LeastBytes{},
 	}
 	defer func() {
@@ -56,6 +57,13 @@ func StartProducer() {
 	wg.Wait()
 }
 
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
 func sendTestMessage(writer *kafka.Writer) {
 	data := createValidData()
 
@@ -65,7 +73,7 @@ func sendTestMessage(writer *kafka.Writer) {
 	}
 
 	err = writer.WriteMessages(context.Background(), kafka.Message{
-		Key:   []byte("test"),
+		Key:   []byte(data.Order.OrderUID),
 		Value: buf,
 		Time:  time.Now(),
 	})